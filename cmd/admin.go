@@ -0,0 +1,269 @@
+/*
+Copyright © 2020 pyama86
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pyama86/kagiana/kagiana"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var adminEndpoint string
+var adminToken string
+var adminTokenFile string
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "manage issued credentials",
+	Long:  `It calls the admin api with the vault token saved by kagiana client.`,
+}
+
+var adminCertsUser string
+var adminCertsProfile string
+var adminCertsExpiresWithin time.Duration
+var adminCertsIncludeRevoked bool
+
+var adminCertsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "list issued certificates",
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{}
+		q.Set("user", adminCertsUser)
+		q.Set("profile", adminCertsProfile)
+		if adminCertsExpiresWithin != 0 {
+			q.Set("expires_within", adminCertsExpiresWithin.String())
+		}
+		if adminCertsIncludeRevoked {
+			q.Set("include_revoked", "true")
+		}
+
+		ret := kagiana.AdminCertsResponse{}
+		if err := adminRequest(http.MethodGet, "api/v1/admin/certs", q, nil, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tPROFILE\tUSER\tNOT AFTER\tREVOKED")
+		for _, c := range ret.Certs {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", c.SerialNumber, c.Profile, c.User, c.NotAfter.Format(time.RFC3339), c.Revoked)
+		}
+		w.Flush()
+	},
+}
+
+var adminRevokeCertCmd = &cobra.Command{
+	Use:   "revoke-cert <serial number>",
+	Short: "revoke an issued certificate",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ret := kagiana.InventoryCert{}
+		if err := adminRequest(http.MethodPost, "api/v1/admin/certs/revoke", nil, &kagiana.AdminRevokeCertRequest{SerialNumber: args[0]}, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("revoked %s of %s\n", ret.SerialNumber, ret.User)
+	},
+}
+
+var adminRevokeTokenUser string
+
+var adminRevokeTokenCmd = &cobra.Command{
+	Use:   "revoke-token [accessor]",
+	Short: "revoke vault tokens by accessor or of a user",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := &kagiana.AdminRevokeTokensRequest{User: adminRevokeTokenUser}
+		if len(args) > 0 {
+			req.Accessor = args[0]
+		}
+
+		ret := kagiana.AdminRevokeTokensResponse{}
+		if err := adminRequest(http.MethodPost, "api/v1/admin/tokens/revoke", nil, req, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+		for _, a := range ret.Revoked {
+			fmt.Printf("revoked %s\n", a)
+		}
+		for a, e := range ret.Errors {
+			logrus.Errorf("%s: %s", a, e)
+		}
+		if len(ret.Errors) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var adminDenyKind string
+var adminDenyReason string
+var adminDenyRevoke bool
+
+var adminBlockCmd = &cobra.Command{
+	Use:   "block <value>",
+	Short: "stop issuing to a user, github login, key fingerprint or ip range",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ret := kagiana.AdminDenylistResponse{}
+		req := &kagiana.AdminDenyRequest{
+			DenyEntry: kagiana.DenyEntry{Kind: adminDenyKind, Value: args[0], Reason: adminDenyReason},
+			Revoke:    adminDenyRevoke,
+		}
+		if err := adminRequest(http.MethodPost, "api/v1/admin/denylist", nil, req, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+		printDenylist(ret.Entries)
+		if ret.Revoked != nil {
+			for _, r := range ret.Revoked.Revoked {
+				fmt.Printf("revoked %s\n", r)
+			}
+			for r, e := range ret.Revoked.Errors {
+				logrus.Errorf("%s: %s", r, e)
+			}
+		}
+	},
+}
+
+var adminUnblockCmd = &cobra.Command{
+	Use:   "unblock <value>",
+	Short: "remove a user from the denylist",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		q := url.Values{}
+		q.Set("kind", adminDenyKind)
+		q.Set("value", args[0])
+
+		ret := kagiana.AdminDenylistResponse{}
+		if err := adminRequest(http.MethodDelete, "api/v1/admin/denylist", q, nil, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+		printDenylist(ret.Entries)
+	},
+}
+
+var adminDenylistCmd = &cobra.Command{
+	Use:   "denylist",
+	Short: "list the denylist",
+	Run: func(cmd *cobra.Command, args []string) {
+		ret := kagiana.AdminDenylistResponse{}
+		if err := adminRequest(http.MethodGet, "api/v1/admin/denylist", nil, nil, &ret); err != nil {
+			logrus.Fatal(err)
+		}
+		printDenylist(ret.Entries)
+	},
+}
+
+func printDenylist(entries []kagiana.DenyEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tVALUE\tREASON\tCREATED BY\tCREATED AT")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Kind, e.Value, e.Reason, e.CreatedBy, e.CreatedAt.Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func adminVaultToken() (string, error) {
+	if adminToken != "" {
+		return adminToken, nil
+	}
+	b, err := ioutil.ReadFile(expandPath(adminTokenFile))
+	if err != nil {
+		return "", fmt.Errorf("vault token is required, login with kagiana client or set --vault-token: %w", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func adminRequest(method, p string, q url.Values, body, ret interface{}) error {
+	u, err := url.Parse(adminEndpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Join(u.Path, p)
+	u.RawQuery = q.Encode()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	token, err := adminVaultToken()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(ret)
+}
+
+func init() {
+	adminCmd.PersistentFlags().StringVarP(&adminEndpoint, "endpoint", "e", "", "Kagiana admin endpoint")
+	adminCmd.PersistentFlags().StringVar(&adminToken, "vault-token", os.Getenv("KAGIANA_ADMIN_TOKEN"), "Vault token of the admin")
+	adminCmd.PersistentFlags().StringVar(&adminTokenFile, "vault-token-file", "~/.kagiana/token", "Vault token file saved by kagiana client")
+	adminCmd.MarkPersistentFlagRequired("endpoint")
+
+	adminCertsCmd.Flags().StringVar(&adminCertsUser, "user", "", "filter by user")
+	adminCertsCmd.Flags().StringVar(&adminCertsProfile, "profile", "", "filter by profile")
+	adminCertsCmd.Flags().DurationVar(&adminCertsExpiresWithin, "expires-within", 0, "filter by certs expiring within the duration")
+	adminCertsCmd.Flags().BoolVar(&adminCertsIncludeRevoked, "include-revoked", false, "include revoked certs")
+
+	adminRevokeTokenCmd.Flags().StringVar(&adminRevokeTokenUser, "user", "", "revoke every token issued to the user")
+
+	for _, c := range []*cobra.Command{adminBlockCmd, adminUnblockCmd} {
+		c.Flags().StringVar(&adminDenyKind, "kind", kagiana.DenyKindUser, "kind of the value(user,github_login,key_fingerprint,ip_range)")
+	}
+	adminBlockCmd.Flags().StringVar(&adminDenyReason, "reason", "", "reason of the block")
+	adminBlockCmd.Flags().BoolVar(&adminDenyRevoke, "revoke", false, "revoke the certs and tokens of the user in the inventory")
+
+	adminCmd.AddCommand(adminCertsCmd, adminRevokeCertCmd, adminRevokeTokenCmd, adminBlockCmd, adminUnblockCmd, adminDenylistCmd)
+	rootCmd.AddCommand(adminCmd)
+}
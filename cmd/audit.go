@@ -0,0 +1,100 @@
+/*
+Copyright © 2020 pyama86
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pyama86/kagiana/kagiana"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "audit log utilities",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <audit log>",
+	Short: "verify the hash chain of an audit log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cp, err := auditCheckpoint(cmd)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		n, err := verifyAuditLog(args[0], cp)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Printf("%s: %d records ok\n", args[0], n)
+	},
+}
+
+// auditCheckpoint reads the expected head of the chain from --head or
+// --checkpoint.
+func auditCheckpoint(cmd *cobra.Command) (*kagiana.AuditCheckpoint, error) {
+	if head, _ := cmd.Flags().GetString("head"); head != "" {
+		return parseAuditHead(head)
+	}
+	if path, _ := cmd.Flags().GetString("checkpoint"); path != "" {
+		return kagiana.ReadAuditCheckpoint(path)
+	}
+	return nil, nil
+}
+
+func parseAuditHead(head string) (*kagiana.AuditCheckpoint, error) {
+	seq, hash, ok := strings.Cut(head, ":")
+	if !ok || hash == "" {
+		return nil, fmt.Errorf("head must be <seq>:<hash>: %s", head)
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("head must be <seq>:<hash>: %w", err)
+	}
+	return &kagiana.AuditCheckpoint{Seq: n, Hash: hash}, nil
+}
+
+func verifyAuditLog(path string, cp *kagiana.AuditCheckpoint) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	_, n, err := kagiana.VerifyAuditLogCheckpoint(f, cp)
+	if err != nil {
+		return n, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, nil
+}
+
+func init() {
+	auditVerifyCmd.Flags().String("checkpoint", "", "checkpoint file with the expected head of the chain")
+	auditVerifyCmd.Flags().String("head", "", "expected head of the chain as <seq>:<hash>, e.g. from syslog")
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
@@ -31,6 +31,7 @@ import (
 	"os/user"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/STNS/libstns-go/libstns"
 	"github.com/pyama86/kagiana/kagiana"
@@ -59,6 +60,12 @@ var token string
 var savePath string
 
 func runClient() error {
+	if authType == "device" {
+		return runDeviceClient(endpoint, savePath)
+	}
+	if userName == "" {
+		return fmt.Errorf("user is required")
+	}
 
 	if token == "" {
 		token = viper.GetString("token")
@@ -74,7 +81,15 @@ func runClient() error {
 		return err
 	}
 
-	code, err := getChallengeCode(endpoint, authType)
+	version := negotiateAPIVersion(endpoint)
+	logrus.Debugf("use api version %q", version)
+
+	var code []byte
+	if version == kagiana.APIVersionV1 {
+		code, err = getChallengeCodeV1(endpoint, authType)
+	} else {
+		code, err = getChallengeCode(endpoint, authType)
+	}
 	if err != nil {
 		return err
 	}
@@ -84,11 +99,42 @@ func runClient() error {
 		return err
 	}
 
-	if err := verify(endpoint, authType, token, string(signature), userName, savePath, string(code)); err != nil {
-		return err
+	if version == kagiana.APIVersionV1 {
+		return verifyV1(endpoint, authType, token, string(signature), userName, savePath, string(code))
 	}
+	return verify(endpoint, authType, token, string(signature), userName, savePath, string(code))
+}
 
-	return nil
+// negotiateAPIVersion returns the newest api version supported by both the
+// client and the server, or an empty string for the legacy endpoints.
+func negotiateAPIVersion(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	u.Path = path.Join(u.Path, "api/versions")
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	ret := kagiana.APIVersionsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return ""
+	}
+
+	for _, v := range ret.Versions {
+		if v == kagiana.APIVersionV1 {
+			return v
+		}
+	}
+	return ""
 }
 
 func getChallengeCode(endpoint, authType string) ([]byte, error) {
@@ -156,48 +202,201 @@ func verify(endpoint, authType, token, signature, userName, savePath, code strin
 			return err
 		}
 
-		usr, _ := user.Current()
-
-		err = os.MkdirAll(strings.Replace(savePath, "~", usr.HomeDir, 1), 0755)
+		return saveCredentials(savePath, ret.Token, ret.Certs)
+	default:
+		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return err
 		}
+		return fmt.Errorf("status code=%d, body=%s", resp.StatusCode, string(body))
+	}
+}
 
-		file, err := os.Create(strings.Replace(path.Join(savePath, "token"), "~", usr.HomeDir, 1))
-		if err != nil {
-			return err
-		}
-		defer file.Close()
+func getChallengeCodeV1(endpoint, authType string) ([]byte, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = file.Write([]byte(ret.Token))
-		if err != nil {
-			return err
-		}
+	u.Path = path.Join(u.Path, fmt.Sprintf("api/v1/auth/%s/challenge", authType))
+	u.RawQuery = url.Values{"user": []string{userName}}.Encode()
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	ret := kagiana.APIChallengeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return []byte(ret.Challenge), nil
+}
+
+func verifyV1(endpoint, authType, token, signature, userName, savePath, code string) error {
+	values := url.Values{}
+	values.Set("code", code)
+	values.Set("token", token)
+	values.Set("signature", signature)
+	values.Set("user", userName)
 
-		for name, keys := range ret.Certs {
-			for keyType, keyValue := range keys {
-				file, err := os.Create(strings.Replace(path.Join(savePath, fmt.Sprintf("%s.%s", name, keyType)), "~", usr.HomeDir, 1))
-				if err != nil {
-					return err
-				}
-				defer file.Close()
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
 
-				_, err = file.Write([]byte(keyValue))
-				if err != nil {
-					return err
-				}
+	u.Path = path.Join(u.Path, fmt.Sprintf("api/v1/auth/%s/verify", authType))
+	resp, err := http.PostForm(u.String(), values)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-			}
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	ret := kagiana.APIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return err
+	}
+
+	return saveAPIResponse(savePath, &ret)
+}
+
+func saveAPIResponse(savePath string, ret *kagiana.APIResponse) error {
+	for _, e := range ret.Errors {
+		logrus.Warnf("%s could not be issued: %s", e.Name, e.Message)
+	}
 
+	certs := map[string]map[string]string{}
+	for _, c := range ret.Certs {
+		certs[c.Name] = map[string]string{
+			"ca":   kagiana.CAChainPEM(c.CAChain),
+			"cert": c.Certificate,
+			"key":  c.PrivateKey,
 		}
-		return nil
-	default:
+	}
+	return saveCredentials(savePath, ret.Token.Token, certs)
+}
+
+// runDeviceClient logs in with the device flow, so the login can be approved
+// in a browser on another machine.
+func runDeviceClient(endpoint, savePath string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	base := u.Path
+
+	u.Path = path.Join(base, "api/v1/device/code")
+	resp, err := http.PostForm(u.String(), url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return apiError(resp)
+	}
+
+	code := kagiana.APIDeviceCodeResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+	fmt.Fprintf(os.Stderr, "or open %s\n", code.VerificationURIComplete)
+
+	u.Path = path.Join(base, "api/v1/device/token")
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		ret, errCode, err := pollDeviceToken(u.String(), code.DeviceCode)
+		switch {
+		case ret != nil:
+			return saveAPIResponse(savePath, ret)
+		case errCode == kagiana.ErrCodeAuthorizationPending:
+		case errCode == kagiana.ErrCodeSlowDown:
+			interval += 5 * time.Second
+		default:
+			return err
+		}
+	}
+	return fmt.Errorf("device code expired")
+}
+
+func pollDeviceToken(u, deviceCode string) (*kagiana.APIResponse, string, error) {
+	resp, err := http.PostForm(u, url.Values{
+		"grant_type":  []string{kagiana.DeviceGrantType},
+		"device_code": []string{deviceCode},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return nil, "", err
 		}
+		ret := kagiana.APIErrorResponse{}
+		if err := json.Unmarshal(body, &ret); err != nil || ret.Error == nil {
+			return nil, "", fmt.Errorf("status code=%d, body=%s", resp.StatusCode, string(body))
+		}
+		return nil, ret.Error.Code, fmt.Errorf("code=%s, message=%s", ret.Error.Code, ret.Error.Message)
+	}
+
+	ret := kagiana.APIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, "", err
+	}
+	return &ret, "", nil
+}
+
+func apiError(resp *http.Response) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	ret := kagiana.APIErrorResponse{}
+	if err := json.Unmarshal(body, &ret); err != nil || ret.Error == nil {
 		return fmt.Errorf("status code=%d, body=%s", resp.StatusCode, string(body))
 	}
+	return fmt.Errorf("status code=%d, code=%s, message=%s, request_id=%s", resp.StatusCode, ret.Error.Code, ret.Error.Message, ret.Error.RequestID)
+}
+
+func expandPath(p string) string {
+	usr, err := user.Current()
+	if err != nil {
+		return p
+	}
+	return strings.Replace(p, "~", usr.HomeDir, 1)
+}
+
+func saveCredentials(savePath, token string, certs map[string]map[string]string) error {
+	if err := os.MkdirAll(expandPath(savePath), 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(expandPath(path.Join(savePath, "token")), []byte(token), 0600); err != nil {
+		return err
+	}
+
+	for name, keys := range certs {
+		for keyType, keyValue := range keys {
+			if err := ioutil.WriteFile(expandPath(path.Join(savePath, fmt.Sprintf("%s.%s", name, keyType))), []byte(keyValue), 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -206,7 +405,7 @@ func init() {
 	viper.BindEnv("token")
 
 	clientCmd.PersistentFlags().StringVarP(&endpoint, "endpoint", "e", "", "Kagiana Endpoint")
-	clientCmd.PersistentFlags().StringVarP(&authType, "auth-type", "a", "stns", "Authentication type")
+	clientCmd.PersistentFlags().StringVarP(&authType, "auth-type", "a", "stns", "Authentication type(stns,device)")
 	clientCmd.PersistentFlags().StringVarP(&userName, "user", "u", "", "Authentication User")
 	clientCmd.PersistentFlags().StringVarP(&token, "token", "t", "", "Authentication Token")
 	clientCmd.PersistentFlags().StringVarP(&savePath, "savePath", "k", "~/.kagiana", "Certificate save path")
@@ -215,7 +414,6 @@ func init() {
 	clientCmd.PersistentFlags().StringVarP(&keyPass, "privatekey-password", "s", "", "PrivateKey Password")
 
 	clientCmd.MarkPersistentFlagRequired("endpoint")
-	clientCmd.MarkPersistentFlagRequired("user")
 
 	rootCmd.AddCommand(clientCmd)
 }
@@ -24,11 +24,11 @@ package cmd
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -82,7 +82,7 @@ func Test_requestSTNS(t *testing.T) {
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.URL.Path == "/auth/stns/challenge" {
 					w.WriteHeader(http.StatusOK)
-					fmt.Fprintf(w, tt.name)
+					w.Write([]byte(tt.name))
 				} else if r.URL.Path == "/auth/stns/verify" {
 					if err := r.ParseForm(); err != nil {
 						t.Error(err)
@@ -113,7 +113,7 @@ func Test_requestSTNS(t *testing.T) {
 					if err != nil {
 						t.Error(err)
 					}
-					fmt.Fprintf(w, string(b))
+					w.Write(b)
 
 				} else {
 					w.WriteHeader(http.StatusBadRequest)
@@ -145,3 +145,108 @@ func Test_requestSTNS(t *testing.T) {
 		})
 	}
 }
+
+func Test_verifyV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "ok",
+			status: http.StatusOK,
+			want: []string{
+				"test.example.com.ca",
+				"test.example.com.cert",
+				"test.example.com.key",
+				"token",
+			},
+			wantErr: false,
+		},
+		{
+			name:    "unauthorized",
+			status:  http.StatusUnauthorized,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/api/versions":
+					kagiana.APIVersionsHandler(w, r)
+				case "/api/v1/auth/stns/challenge":
+					kagiana.RenderJSON(w, http.StatusOK, &kagiana.APIChallengeResponse{
+						Version:   kagiana.APIVersionV1,
+						User:      r.FormValue("user"),
+						Challenge: "test-code",
+					})
+				case "/api/v1/auth/stns/verify":
+					if tt.status != http.StatusOK {
+						kagiana.RenderAPIError(w, "test-id", kagiana.NewAPIError(tt.status, kagiana.ErrCodeUnauthorized, "verify failed"))
+						return
+					}
+					kagiana.RenderJSON(w, http.StatusOK, &kagiana.APIResponse{
+						Version: kagiana.APIVersionV1,
+						Token:   kagiana.APIToken{Token: "test token"},
+						Certs: []kagiana.APICert{
+							{
+								Name:        "test.example.com",
+								Certificate: "cert value",
+								PrivateKey:  "key value",
+								CAChain:     []string{"ca1", "ca2"},
+							},
+						},
+					})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer ts.Close()
+
+			if v := negotiateAPIVersion(ts.URL); v != kagiana.APIVersionV1 {
+				t.Errorf("negotiateAPIVersion() = %q, want %q", v, kagiana.APIVersionV1)
+			}
+
+			code, err := getChallengeCodeV1(ts.URL, "stns")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dir, err := ioutil.TempDir("", "example")
+			if err != nil {
+				t.Error(err)
+			}
+			defer os.RemoveAll(dir)
+
+			err = verifyV1(ts.URL, "stns", "test token", "test sig", "test-user", dir, string(code))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyV1() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Error(err)
+			}
+			var paths []string
+			for _, file := range files {
+				paths = append(paths, file.Name())
+			}
+
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("verifyV1() = %v, want %v", paths, tt.want)
+			}
+
+			if !tt.wantErr {
+				ca, err := ioutil.ReadFile(filepath.Join(dir, "test.example.com.ca"))
+				if err != nil {
+					t.Error(err)
+				}
+				if string(ca) != "ca1\nca2" {
+					t.Errorf("ca chain = %q, want %q", ca, "ca1\nca2")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright © 2020 pyama86
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/pyama86/kagiana/kagiana"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var loginEndpoint string
+var loginSavePath string
+var loginNoBrowser bool
+var loginTimeout time.Duration
+
+var loginCmd = &cobra.Command{
+	Use:   "login",
+	Short: "log in with the browser",
+	Long:  `It opens the login of kagiana in the browser, and saves the issued credentials received on a loopback address.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runLogin(loginEndpoint, loginSavePath); err != nil {
+			logrus.Fatal(err)
+		}
+	},
+}
+
+const loginDonePage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>kagiana</title></head>
+<body><p>%s</p></body></html>
+`
+
+func randomURLString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func openBrowser(u string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("open", u).Start()
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
+
+type loginResult struct {
+	ret *kagiana.APIResponse
+	err error
+}
+
+// runLogin receives a one-time code on 127.0.0.1 and exchanges it with the
+// PKCE verifier, so the credentials never pass through the browser.
+func runLogin(endpoint, savePath string) error {
+	verifier, err := randomURLString()
+	if err != nil {
+		return err
+	}
+	state, err := randomURLString()
+	if err != nil {
+		return err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	redirectURI := fmt.Sprintf("http://%s/callback", l.Addr().String())
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	tokenURL := *u
+	tokenURL.Path = path.Join(u.Path, "api/v1/login/token")
+	u.Path = path.Join(u.Path, "/")
+	u.RawQuery = url.Values{
+		"redirect_uri":          []string{redirectURI},
+		"code_challenge":        []string{base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": []string{kagiana.CodeChallengeS256},
+		"state":                 []string{state},
+	}.Encode()
+
+	results := make(chan loginResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", loginCallback(tokenURL.String(), state, verifier, results))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+
+	fmt.Fprintf(os.Stderr, "Open %s to log in\n", u.String())
+	if !loginNoBrowser {
+		if err := openBrowser(u.String()); err != nil {
+			logrus.Debugf("open browser: %s", err)
+		}
+	}
+
+	select {
+	case res := <-results:
+		if res.err != nil {
+			return res.err
+		}
+		return saveAPIResponse(savePath, res.ret)
+	case <-time.After(loginTimeout):
+		return fmt.Errorf("login timed out after %s", loginTimeout)
+	}
+}
+
+// loginCallback receives the code, or the error of a failed login, from the
+// browser.
+func loginCallback(tokenURL, state, verifier string, results chan<- loginResult) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("state") != state {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, loginDonePage, "Login failed: state mismatch.")
+			return
+		}
+
+		var ret *kagiana.APIResponse
+		var err error
+		if e := q.Get("error"); e != "" {
+			err = fmt.Errorf("login failed: %s: %s", e, q.Get("error_description"))
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, loginDonePage, html.EscapeString(err.Error()))
+		} else if ret, err = exchangeLoginCode(tokenURL, q.Get("code"), verifier); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, loginDonePage, "Login failed, see the terminal.")
+		} else {
+			fmt.Fprintf(w, loginDonePage, "Login succeeded, you can close this window.")
+		}
+		select {
+		case results <- loginResult{ret: ret, err: err}:
+		default:
+		}
+	}
+}
+
+func exchangeLoginCode(u, code, verifier string) (*kagiana.APIResponse, error) {
+	resp, err := http.PostForm(u, url.Values{"code": []string{code}, "code_verifier": []string{verifier}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiError(resp)
+	}
+
+	ret := kagiana.APIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func init() {
+	loginCmd.PersistentFlags().StringVarP(&loginEndpoint, "endpoint", "e", "", "Kagiana Endpoint")
+	loginCmd.PersistentFlags().StringVarP(&loginSavePath, "savePath", "k", "~/.kagiana", "Certificate save path")
+	loginCmd.PersistentFlags().BoolVar(&loginNoBrowser, "no-browser", false, "Print the login url without opening the browser")
+	loginCmd.PersistentFlags().DurationVar(&loginTimeout, "timeout", 5*time.Minute, "Time to wait for the login in the browser")
+
+	loginCmd.MarkPersistentFlagRequired("endpoint")
+
+	rootCmd.AddCommand(loginCmd)
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoginCallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good-code" || r.FormValue("code_verifier") != "verifier" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":{"code":"invalid_request","message":"code is invalid"}}`))
+			return
+		}
+		w.Write([]byte(`{"token":{"token":"login-token"}}`))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantResult bool
+		wantErr    string
+		wantToken  string
+	}{
+		{name: "ok", query: "code=good-code&state=xyz", wantStatus: http.StatusOK, wantResult: true, wantToken: "login-token"},
+		{name: "state mismatch", query: "code=good-code&state=abc", wantStatus: http.StatusBadRequest},
+		{name: "denied", query: "error=access_denied&error_description=alice+is+denied&state=xyz", wantStatus: http.StatusUnauthorized, wantResult: true, wantErr: "access_denied: alice is denied"},
+		{name: "exchange fails", query: "code=bad-code&state=xyz", wantStatus: http.StatusBadGateway, wantResult: true, wantErr: "code is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan loginResult, 1)
+			w := httptest.NewRecorder()
+			loginCallback(ts.URL, "xyz", "verifier", results)(w, httptest.NewRequest(http.MethodGet, "/callback?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+
+			select {
+			case res := <-results:
+				if !tt.wantResult {
+					t.Fatalf("result = %+v, want none", res)
+				}
+				if tt.wantErr != "" {
+					if res.err == nil || !strings.Contains(res.err.Error(), tt.wantErr) {
+						t.Errorf("err = %v, want %s", res.err, tt.wantErr)
+					}
+					return
+				}
+				if res.err != nil || res.ret == nil || res.ret.Token.Token != tt.wantToken {
+					t.Errorf("result = %+v, %v", res.ret, res.err)
+				}
+			default:
+				if tt.wantResult {
+					t.Error("no result")
+				}
+			}
+		})
+	}
+}
@@ -23,14 +23,21 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-playground/validator"
 	"github.com/pyama86/kagiana/kagiana"
 	"github.com/sirupsen/logrus"
@@ -44,28 +51,18 @@ var serverCmd = &cobra.Command{
 	Short: "starting kagiana server",
 	Long:  `It is starting kagiana servercommand.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		config := &kagiana.Config{}
 		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-
 		viper.AutomaticEnv()
-		if err := viper.Unmarshal(&config); err != nil {
+
+		config, err := loadConfig()
+		if err != nil {
 			logrus.Fatal(err)
 		}
+		setLogLevel(config)
 
-		validate := validator.New()
-		if err := validate.Struct(config); err != nil {
+		if err := setupLogger(config); err != nil {
 			logrus.Fatal(err)
 		}
-		switch config.LogLevel {
-		case "debug":
-			logrus.SetLevel(logrus.DebugLevel)
-		case "info":
-			logrus.SetLevel(logrus.InfoLevel)
-		case "warn":
-			logrus.SetLevel(logrus.WarnLevel)
-		case "error":
-			logrus.SetLevel(logrus.ErrorLevel)
-		}
 
 		if err := runServer(config); err != nil {
 			logrus.Fatal(err)
@@ -73,60 +70,573 @@ var serverCmd = &cobra.Command{
 	},
 }
 
-func runServer(config *kagiana.Config) error {
-	var provider kagiana.OAuthProvider
-	tokenType := "github_token"
-	switch config.OAuthProvider {
-	case "github":
-		provider = kagiana.NewGitHub(config)
+func loadConfig() (*kagiana.Config, error) {
+	config := &kagiana.Config{}
+	if err := viper.Unmarshal(&config); err != nil {
+		return nil, err
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func setLogLevel(config *kagiana.Config) {
+	switch config.LogLevel {
+	case "debug":
+		logrus.SetLevel(logrus.DebugLevel)
+	case "info":
+		logrus.SetLevel(logrus.InfoLevel)
+	case "warn":
+		logrus.SetLevel(logrus.WarnLevel)
+	case "error":
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+}
+
+func setupLogger(config *kagiana.Config) error {
+	switch config.LogFormat {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
 	default:
-		return fmt.Errorf("unknown provider %s", config.OAuthProvider)
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+
+	if config.LogFile == "" {
+		return nil
+	}
+
+	logFile, err := kagiana.OpenLogFile(config.LogFile)
+	if err != nil {
+		return err
+	}
+	logrus.SetOutput(logFile)
+
+	go func() {
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGUSR1)
+		for range reopen {
+			if err := logFile.Reopen(); err != nil {
+				logrus.Errorf("reopen log file: %s", err)
+				continue
+			}
+			logrus.Infof("reopened log file %s", config.LogFile)
+		}
+	}()
+	return nil
+}
+
+func writePIDFile(path string) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// store holds the state which outlives config reloads.
+type store struct {
+	auditor   *kagiana.Auditor
+	inventory *kagiana.Inventory
+	denylist  *kagiana.Denylist
+	devices   *kagiana.DeviceStore
+	loopbacks *kagiana.LoopbackStore
+	passwords *kagiana.PasswordStore
+
+	// the limiter and the stns key cache of the running app, kept until
+	// their section of the config changes
+	mu          sync.Mutex
+	config      *kagiana.Config
+	limiter     *kagiana.RateLimiter
+	limitStore  kagiana.RateLimitStore
+	stnsKeys    *kagiana.UserKeyCache
+	stnsRetired kagiana.CacheStats
+}
+
+func newStore(config *kagiana.Config) (*store, error) {
+	inventory, err := kagiana.OpenInventory(config.InventoryFile)
+	if err != nil {
+		return nil, err
+	}
+	denylist, err := kagiana.OpenDenylist(config.DenylistFile)
+	if err != nil {
+		return nil, err
+	}
+	return &store{inventory: inventory, denylist: denylist, devices: kagiana.NewDeviceStore(), loopbacks: kagiana.NewLoopbackStore(), passwords: kagiana.NewPasswordStore()}, nil
+}
+
+func (st *store) applyConfig(config *kagiana.Config) error {
+	return st.denylist.SetStatic(kagiana.NewAuditContext(context.Background(), st.auditor), config.Denylist)
+}
+
+func sameRateLimitStore(a, b kagiana.RateLimitConfig) bool {
+	return a.Store == b.Store && a.RedisAddr == b.RedisAddr && a.RedisPassword == b.RedisPassword && a.RedisDB == b.RedisDB
+}
+
+func sameSTNSCache(a, b *kagiana.Config) bool {
+	return a.STNSEndpoint == b.STNSEndpoint && reflect.DeepEqual(a.STNSOptions, b.STNSOptions) &&
+		a.STNSCacheTTL == b.STNSCacheTTL && a.STNSNegativeCacheTTL == b.STNSNegativeCacheTTL && a.STNSCacheSize == b.STNSCacheSize
+}
+
+// rateLimiter returns the running limiter while rate_limit is unchanged,
+// and keeps its buckets when only the limits change.
+func (st *store) rateLimiter(config kagiana.RateLimitConfig) (*kagiana.RateLimiter, kagiana.RateLimitStore, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.config != nil && reflect.DeepEqual(st.config.RateLimit, config) {
+		return st.limiter, st.limitStore, nil
+	}
+	s := kagiana.NewRateLimitStore(config)
+	if st.config != nil && sameRateLimitStore(st.config.RateLimit, config) {
+		s = st.limitStore
+	}
+	l, err := kagiana.NewRateLimiterWithStore(config, s)
+	return l, s, err
+}
+
+func (st *store) stnsKeyCache(config *kagiana.Config) (*kagiana.UserKeyCache, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.config != nil && sameSTNSCache(st.config, config) {
+		return st.stnsKeys, nil
+	}
+	return kagiana.NewSTNSKeyCache(config)
+}
+
+// keep makes the limiter and the key cache of a the ones of the next
+// reloads, and closes the rate limit store they replaced.
+func (st *store) keep(a *app) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.limitStore != a.limitStore {
+		closeRateLimitStore(st.limitStore)
+	}
+	if st.stnsKeys != nil && st.stnsKeys != a.stnsKeys {
+		st.stnsRetired = st.stnsRetired.Add(st.stnsKeys.Stats())
+	}
+	st.config, st.limiter, st.limitStore, st.stnsKeys = a.config, a.limiter, a.limitStore, a.stnsKeys
+}
+
+// release closes the rate limit store of an app which is not used.
+func (st *store) release(a *app) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.limitStore != a.limitStore {
+		closeRateLimitStore(a.limitStore)
+	}
+}
+
+func (st *store) close() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	closeRateLimitStore(st.limitStore)
+}
+
+func closeRateLimitStore(s kagiana.RateLimitStore) {
+	if c, ok := s.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logrus.Errorf("closing the rate limit store: %s", err)
+		}
+	}
+}
+
+// stnsCacheStats counts the caches replaced by reloads as well, so the
+// metrics don't go back.
+func (st *store) stnsCacheStats() kagiana.CacheStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stnsKeys == nil {
+		return st.stnsRetired
+	}
+	return st.stnsRetired.Add(st.stnsKeys.Stats())
+}
+
+// app holds everything built from a config. It is replaced as a whole
+// when the config is reloaded.
+type app struct {
+	config       *kagiana.Config
+	handler      http.Handler
+	adminHandler http.Handler
+	stns         *kagiana.STNS
+	stnsKeys     *kagiana.UserKeyCache
+	limiter      *kagiana.RateLimiter
+	limitStore   kagiana.RateLimitStore
+}
+
+func newApp(config *kagiana.Config, st *store) (*app, error) {
+	vault, err := kagiana.NewVaultClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	providers, err := kagiana.NewProviders(config, vault, st.passwords)
+	if err != nil {
+		return nil, err
+	}
+
+	var renewer *kagiana.Renewer
+	if config.Renew.Enabled() {
+		renewer, err = kagiana.NewRenewer(config, vault, st.inventory)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stnsKeys, err := st.stnsKeyCache(config)
+	if err != nil {
+		return nil, err
+	}
+	tokenType := "github_token"
+	stns, err := kagiana.NewSTNSWithCache(config, tokenType, vault, stnsKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// built last, a new redis client is closed by release when the app is
+	// not used
+	limiter, limitStore, err := st.rateLimiter(config.RateLimit)
+	if err != nil {
+		return nil, err
 	}
 
-	stns := kagiana.NewSTNS(config, tokenType)
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", provider.Login)
-	mux.HandleFunc("/auth/stns/challenge", stns.Challenge)
-	mux.HandleFunc("/auth/stns/verify", stns.Verify)
-	mux.HandleFunc("/auth/stns", stns.Call)
-	mux.HandleFunc("/callback", provider.Callback)
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.Handle(pattern, kagiana.TraceHandler(pattern, kagiana.InstrumentHandler(pattern, h)))
+	}
+	loopback := kagiana.NewLoopbackFlow(config, st.loopbacks)
+	landing := kagiana.LandingHandler(providers)
+	handle("/", loopback.WithLogin(landing))
+	handle("/auth/stns/challenge", limiter.Limit(stns.Challenge))
+	handle("/auth/stns/verify", limiter.Limit(stns.Verify))
+	handle("/auth/stns", limiter.Limit(stns.Call))
+	handle("/api/versions", kagiana.APIVersionsHandler)
+	handle("/api/v1/auth/stns/challenge", limiter.Limit(stns.ChallengeV1))
+	handle("/api/v1/auth/stns/verify", limiter.Limit(stns.VerifyV1))
+	handle("/api/v1/auth/stns", limiter.Limit(stns.CallV1))
+	device := kagiana.NewDeviceFlow(config, st.devices, landing)
+	handle("POST /api/v1/device/code", limiter.Limit(device.Code))
+	handle("POST /api/v1/device/token", limiter.Limit(device.Token))
+	handle("/device", limiter.Limit(device.Verify))
+	handle("POST /api/v1/login/token", limiter.Limit(loopback.Token))
+	for _, p := range providers {
+		callback := limiter.Limit(device.WithSession(loopback.WithSession(p.Callback)))
+		// password providers take the password on the login path
+		handle(p.LoginPath(), limiter.Limit(p.Login))
+		handle(p.CallbackPath(), callback)
+		if m, ok := p.OAuthProvider.(kagiana.MetadataProvider); ok {
+			handle(p.MetadataPath(), m.Metadata)
+		}
+		// the single provider of oauth_provider keeps the redirect url
+		// registered with the OAuth app
+		if len(config.Providers) == 0 {
+			handle("/callback", callback)
+		}
+	}
+
+	if renewer != nil {
+		handle("POST /api/renew", limiter.Limit(renewer.Renew))
+	}
+
+	health := kagiana.NewHealth(config, vault)
+	handle("/healthz", health.Healthz)
+	handle("/readyz", health.Readyz)
+
+	if config.MetricsListener == "" {
+		mux.Handle("/metrics", kagiana.MetricsHandler())
+	}
+
+	adminMux := mux
+	if config.AdminListener != "" {
+		adminMux = http.NewServeMux()
+	}
+	admin := kagiana.NewAdmin(config, vault, st.inventory, st.denylist)
+	handleAdmin := func(pattern string, h http.HandlerFunc) {
+		adminMux.Handle(pattern, kagiana.TraceHandler(pattern, kagiana.InstrumentHandler(pattern, limiter.Limit(h))))
+	}
+	handleAdmin("GET /api/v1/admin/certs", admin.Certs())
+	handleAdmin("POST /api/v1/admin/certs/revoke", admin.RevokeCert())
+	handleAdmin("POST /api/v1/admin/tokens/revoke", admin.RevokeTokens())
+	handleAdmin("GET /api/v1/admin/denylist", admin.Denylist())
+	handleAdmin("POST /api/v1/admin/denylist", admin.AddDenylist())
+	handleAdmin("DELETE /api/v1/admin/denylist", admin.RemoveDenylist())
+	handleAdmin("GET /api/v1/admin/readyz", admin.Readiness(health))
+
+	return &app{
+		config:       config,
+		handler:      kagiana.WithRequestTimeout(kagiana.WithDenylist(st.denylist, mux), config.RequestTimeout),
+		adminHandler: kagiana.WithRequestTimeout(adminMux, config.RequestTimeout),
+		stns:         stns,
+		stnsKeys:     stnsKeys,
+		limiter:      limiter,
+		limitStore:   limitStore,
+	}, nil
+}
+
+// reloader swaps the running app when the config changes. A config which
+// fails validation or can't be built keeps the current app running.
+type reloader struct {
+	mu      sync.Mutex
+	current atomic.Pointer[app]
+	load    func() (*kagiana.Config, error)
+	store   *store
+}
+
+func (rl *reloader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rl.current.Load().handler.ServeHTTP(w, r)
+}
+
+func (rl *reloader) reload() error {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	err := rl.swap()
+	kagiana.ObserveConfigReload(err)
+	if err != nil {
+		logrus.Errorf("config reload failed, keep the current config: %s", err)
+		return err
+	}
+	logrus.Info("config reloaded")
+	return nil
+}
 
-	server := http.Server{
-		Handler: mux,
-		Addr:    config.Listener,
+func (rl *reloader) swap() error {
+	config, err := rl.load()
+	if err != nil {
+		return err
+	}
+
+	a, err := newApp(config, rl.store)
+	if err != nil {
+		return err
+	}
+	if err := rl.store.applyConfig(config); err != nil {
+		rl.store.release(a)
+		return err
+	}
+
+	old := rl.current.Load().config
+	if old.Listener != config.Listener || old.MetricsListener != config.MetricsListener ||
+		old.AdminListener != config.AdminListener || old.InventoryFile != config.InventoryFile || old.DenylistFile != config.DenylistFile ||
+		old.LogFile != config.LogFile || old.PIDFile != config.PIDFile ||
+		!reflect.DeepEqual(old.Tracing, config.Tracing) || !reflect.DeepEqual(old.Audit, config.Audit) ||
+		!reflect.DeepEqual(old.Webhooks, config.Webhooks) || !reflect.DeepEqual(old.TLS, config.TLS) {
+		logrus.Warn("listener, metrics_listener, admin_listener, inventory_file, denylist_file, log_file, pid_file, tracing, audit, webhooks and tls changes need a restart")
+	}
+	setLogLevel(config)
+	rl.current.Store(a)
+	rl.store.keep(a)
+	return nil
+}
+
+func (rl *reloader) watch() {
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			logrus.Infof("config file changed: %s", e.Name)
+			rl.reload()
+		})
+		viper.WatchConfig()
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			logrus.Info("reloading config by SIGHUP")
+			if err := viper.ReadInConfig(); err != nil && viper.ConfigFileUsed() != "" {
+				logrus.Errorf("config reload failed, keep the current config: %s", err)
+				kagiana.ObserveConfigReload(err)
+				continue
+			}
+			rl.reload()
+		}
+	}()
+}
+
+func runServer(config *kagiana.Config) error {
+	if config.PIDFile != "" {
+		if err := writePIDFile(config.PIDFile); err != nil {
+			return err
+		}
+		defer os.Remove(config.PIDFile)
+	}
+
+	shutdownTracing, err := kagiana.SetupTracing(context.Background(), config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logrus.Errorf("shutting down the tracer: %s", err)
+		}
+	}()
+
+	auditor, err := kagiana.NewAuditor(config.Audit)
+	if err != nil {
+		return err
+	}
+	defer auditor.Close()
+
+	webhooks := kagiana.NewWebhooks(config.Webhooks)
+	defer webhooks.Close()
+	auditor.AddNotifier(webhooks)
+
+	st, err := newStore(config)
+	if err != nil {
+		return err
+	}
+	defer st.inventory.Close()
+	st.auditor = auditor
+	auditor.AddNotifier(st.inventory)
+	if err := st.applyConfig(config); err != nil {
+		return err
+	}
+
+	a, err := newApp(config, st)
+	if err != nil {
+		return err
+	}
+
+	st.keep(a)
+	defer st.close()
+
+	rl := &reloader{load: loadConfig, store: st}
+	rl.current.Store(a)
+	rl.watch()
+
+	if err := kagiana.RegisterSTNSCacheMetrics(st.stnsCacheStats); err != nil {
+		return err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var tlsConfig *tls.Config
+	if config.TLS.Enabled() {
+		vault, err := kagiana.NewVaultClient(config)
+		if err != nil {
+			return err
+		}
+		cert, err := kagiana.NewTLSCertificate(ctx, config.TLS, vault)
+		if err != nil {
+			return err
+		}
+		go cert.Run(ctx)
+
+		tlsConfig, err = kagiana.NewServerTLSConfig(config.TLS, cert)
+		if err != nil {
+			return err
+		}
+	}
+
+	clientIP := func(r *http.Request) string {
+		return rl.current.Load().limiter.ClientIP(r)
+	}
+	servers := []*http.Server{
+		{
+			Handler:   kagiana.WithRequestID(kagiana.WithAccessLog(kagiana.WithAuditor(auditor, clientIP, rl))),
+			Addr:      config.Listener,
+			TLSConfig: tlsConfig,
+		},
+	}
+
+	if config.AdminListener != "" {
+		adminHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rl.current.Load().adminHandler.ServeHTTP(w, r)
+		})
+		servers = append(servers, &http.Server{
+			Handler:   kagiana.WithRequestID(kagiana.WithAccessLog(kagiana.WithAuditor(auditor, clientIP, adminHandler))),
+			Addr:      config.AdminListener,
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	if config.MetricsListener != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", kagiana.MetricsHandler())
+		servers = append(servers, &http.Server{
+			Handler: metricsMux,
+			Addr:    config.MetricsListener,
+		})
+	}
+
+	// the audit sinks and the webhooks are closed by the deferred calls, so
+	// every server must have drained its handlers before runServer returns
+	stop := make(chan struct{})
+	drained := make(chan struct{})
 	go func() {
-		quit := make(chan os.Signal)
+		defer close(drained)
+		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
-		<-quit
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		select {
+		case <-quit:
+		case <-stop:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		logrus.Info("starting shutdown kagiana")
-		if err := server.Shutdown(ctx); err != nil {
-			logrus.Errorf("shutting down the server: %s", err)
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				if err := server.Shutdown(ctx); err != nil {
+					logrus.Errorf("shutting down the server: %s", err)
+				}
+			}(server)
 		}
+		wg.Wait()
 	}()
+
+	for _, server := range servers[1:] {
+		go func(server *http.Server) {
+			logrus.Infof("starting listener %s", server.Addr)
+			if err := listenAndServe(server); err != nil && err != http.ErrServerClosed {
+				logrus.Error(err)
+			}
+		}(server)
+	}
+
 	logrus.Info("starting kagiana")
-	if err := server.ListenAndServe(); err != nil {
-		if err.Error() != "http: Server closed" {
+	if err := listenAndServe(servers[0]); err != nil {
+		if err != http.ErrServerClosed {
 			logrus.Error(err)
+			close(stop)
 		} else {
 			logrus.Info("shutdown kagiana")
 		}
 	}
+	<-drained
 
 	return nil
 
 }
 
+// listenAndServe serves over TLS when the server has a tls config, whose
+// GetCertificate provides the cert.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
 func init() {
 	serverCmd.PersistentFlags().String("log-level", "info", "log level(debug,info,warn,error)")
 	viper.BindPFlag("log_level", serverCmd.PersistentFlags().Lookup("log-level"))
 
+	serverCmd.PersistentFlags().String("log-format", "json", "log format(json,text)")
+	viper.BindPFlag("log_format", serverCmd.PersistentFlags().Lookup("log-format"))
+
+	serverCmd.PersistentFlags().String("log-file", "", "log file path (default stderr)")
+	viper.BindPFlag("log_file", serverCmd.PersistentFlags().Lookup("log-file"))
+
+	serverCmd.PersistentFlags().String("pid-file", "", "pid file path")
+	viper.BindPFlag("pid_file", serverCmd.PersistentFlags().Lookup("pid-file"))
+
+	serverCmd.PersistentFlags().String("external-url", "", "url of kagiana seen by browsers (default derived from the redirect url)")
+	viper.BindPFlag("external_url", serverCmd.PersistentFlags().Lookup("external-url"))
+	viper.BindEnv("oauth_state_secret")
+
 	serverCmd.PersistentFlags().String("oauth-provider", "github", "use oauth provier")
 	viper.BindPFlag("oauth_provider", serverCmd.PersistentFlags().Lookup("oauth-provider"))
 
@@ -148,8 +658,125 @@ func init() {
 	serverCmd.PersistentFlags().StringSlice("oauth-scopes", []string{"user"}, "oauth scopes")
 	viper.BindPFlag("oauth.scopes", serverCmd.PersistentFlags().Lookup("oauth-scopes"))
 
+	serverCmd.PersistentFlags().Duration("stns-cache-ttl", kagiana.DefaultSTNSCacheTTL, "cache ttl of stns user keys")
+	viper.BindPFlag("stns_cache_ttl", serverCmd.PersistentFlags().Lookup("stns-cache-ttl"))
+
+	serverCmd.PersistentFlags().Duration("stns-negative-cache-ttl", kagiana.DefaultSTNSNegativeCacheTTL, "cache ttl of unknown stns users")
+	viper.BindPFlag("stns_negative_cache_ttl", serverCmd.PersistentFlags().Lookup("stns-negative-cache-ttl"))
+
+	serverCmd.PersistentFlags().Int("stns-cache-size", kagiana.DefaultSTNSCacheSize, "max number of cached stns users")
+	viper.BindPFlag("stns_cache_size", serverCmd.PersistentFlags().Lookup("stns-cache-size"))
+
+	serverCmd.PersistentFlags().Duration("vault-timeout", kagiana.DefaultVaultTimeout, "timeout of vault requests")
+	viper.BindPFlag("vault_timeout", serverCmd.PersistentFlags().Lookup("vault-timeout"))
+
+	serverCmd.PersistentFlags().Int("vault-max-idle-conns", kagiana.DefaultVaultMaxIdleConns, "max idle connections to vault")
+	viper.BindPFlag("vault_max_idle_conns", serverCmd.PersistentFlags().Lookup("vault-max-idle-conns"))
+
+	serverCmd.PersistentFlags().Duration("vault-idle-conn-timeout", kagiana.DefaultVaultIdleConnTimeout, "idle connection timeout to vault")
+	viper.BindPFlag("vault_idle_conn_timeout", serverCmd.PersistentFlags().Lookup("vault-idle-conn-timeout"))
+
+	serverCmd.PersistentFlags().Int("issue-concurrency", kagiana.DefaultIssueConcurrency, "number of certs issued in parallel")
+	viper.BindPFlag("issue_concurrency", serverCmd.PersistentFlags().Lookup("issue-concurrency"))
+
+	serverCmd.PersistentFlags().String("issue-failure-mode", kagiana.IssueFailureModePartial, "behavior when some certs can't be issued(partial,revoke)")
+	viper.BindPFlag("issue_failure_mode", serverCmd.PersistentFlags().Lookup("issue-failure-mode"))
+
+	serverCmd.PersistentFlags().Duration("request-timeout", kagiana.DefaultRequestTimeout, "deadline of each request")
+	viper.BindPFlag("request_timeout", serverCmd.PersistentFlags().Lookup("request-timeout"))
+
+	serverCmd.PersistentFlags().Duration("readiness-cache-ttl", kagiana.DefaultReadinessCacheTTL, "cache ttl of readiness checks")
+	viper.BindPFlag("readiness_cache_ttl", serverCmd.PersistentFlags().Lookup("readiness-cache-ttl"))
+
+	serverCmd.PersistentFlags().Float64("rate-limit-ip-rate", 10, "requests per second allowed for each client ip on auth endpoints (0 disables)")
+	viper.BindPFlag("rate_limit.ip_rate", serverCmd.PersistentFlags().Lookup("rate-limit-ip-rate"))
+
+	serverCmd.PersistentFlags().Int("rate-limit-ip-burst", 100, "burst of requests allowed for each client ip on auth endpoints")
+	viper.BindPFlag("rate_limit.ip_burst", serverCmd.PersistentFlags().Lookup("rate-limit-ip-burst"))
+
+	serverCmd.PersistentFlags().Float64("rate-limit-user-rate", 0.5, "requests per second allowed for each user from each client ip on auth endpoints (0 disables)")
+	viper.BindPFlag("rate_limit.user_rate", serverCmd.PersistentFlags().Lookup("rate-limit-user-rate"))
+
+	serverCmd.PersistentFlags().Int("rate-limit-user-burst", 10, "burst of requests allowed for each user from each client ip on auth endpoints")
+	viper.BindPFlag("rate_limit.user_burst", serverCmd.PersistentFlags().Lookup("rate-limit-user-burst"))
+
+	serverCmd.PersistentFlags().StringSlice("rate-limit-trusted-proxies", []string{}, "cidrs of proxies whose X-Forwarded-For is trusted")
+	viper.BindPFlag("rate_limit.trusted_proxies", serverCmd.PersistentFlags().Lookup("rate-limit-trusted-proxies"))
+
+	serverCmd.PersistentFlags().String("rate-limit-store", kagiana.RateLimitStoreMemory, "rate limit store(memory,redis)")
+	viper.BindPFlag("rate_limit.store", serverCmd.PersistentFlags().Lookup("rate-limit-store"))
+
 	serverCmd.PersistentFlags().String("listener", "localhost:18080", "listen host")
 	viper.BindPFlag("listener", serverCmd.PersistentFlags().Lookup("listener"))
 
+	serverCmd.PersistentFlags().String("tls-cert-file", "", "tls cert file of the listener")
+	viper.BindPFlag("tls.cert_file", serverCmd.PersistentFlags().Lookup("tls-cert-file"))
+
+	serverCmd.PersistentFlags().String("tls-key-file", "", "tls key file of the listener")
+	viper.BindPFlag("tls.key_file", serverCmd.PersistentFlags().Lookup("tls-key-file"))
+
+	serverCmd.PersistentFlags().String("tls-vault-path", "", "vault pki path(pki/issue/role) to issue the tls cert of the listener from")
+	viper.BindPFlag("tls.vault_path", serverCmd.PersistentFlags().Lookup("tls-vault-path"))
+
+	serverCmd.PersistentFlags().String("tls-vault-token-file", "", "vault token file of kagiana to issue the tls cert with")
+	viper.BindPFlag("tls.vault_token_file", serverCmd.PersistentFlags().Lookup("tls-vault-token-file"))
+
+	serverCmd.PersistentFlags().String("tls-common-name", "", "common name of the tls cert issued from vault")
+	viper.BindPFlag("tls.common_name", serverCmd.PersistentFlags().Lookup("tls-common-name"))
+
+	serverCmd.PersistentFlags().String("tls-client-ca-file", "", "ca file to verify client certs with")
+	viper.BindPFlag("tls.client_ca_file", serverCmd.PersistentFlags().Lookup("tls-client-ca-file"))
+
+	serverCmd.PersistentFlags().String("tls-client-auth", kagiana.TLSClientAuthNone, "client cert policy(none,request,verify_if_given,require_and_verify)")
+	viper.BindPFlag("tls.client_auth", serverCmd.PersistentFlags().Lookup("tls-client-auth"))
+
+	serverCmd.PersistentFlags().String("renew-vault-token-file", "", "vault token file of kagiana to renew certs with (enables /api/renew)")
+	viper.BindPFlag("renew.vault_token_file", serverCmd.PersistentFlags().Lookup("renew-vault-token-file"))
+
+	serverCmd.PersistentFlags().Duration("renew-max-session-age", kagiana.DefaultRenewMaxSessionAge, "max age of a chain of renewals since the login")
+	viper.BindPFlag("renew.max_session_age", serverCmd.PersistentFlags().Lookup("renew-max-session-age"))
+
+	serverCmd.PersistentFlags().StringSlice("renew-trusted-proxies", []string{}, "cidrs of ingresses whose X-Client-Cert is trusted")
+	viper.BindPFlag("renew.trusted_proxies", serverCmd.PersistentFlags().Lookup("renew-trusted-proxies"))
+
+	serverCmd.PersistentFlags().String("metrics-listener", "", "listen host of /metrics (default serves it on the listener)")
+	viper.BindPFlag("metrics_listener", serverCmd.PersistentFlags().Lookup("metrics-listener"))
+
+	serverCmd.PersistentFlags().String("admin-listener", "", "listen host of the admin api (default serves it on the listener)")
+	viper.BindPFlag("admin_listener", serverCmd.PersistentFlags().Lookup("admin-listener"))
+
+	serverCmd.PersistentFlags().StringSlice("admin-users", []string{}, "users allowed to use the admin api")
+	viper.BindPFlag("admin.users", serverCmd.PersistentFlags().Lookup("admin-users"))
+
+	serverCmd.PersistentFlags().StringSlice("admin-policies", []string{}, "vault policies allowed to use the admin api")
+	viper.BindPFlag("admin.policies", serverCmd.PersistentFlags().Lookup("admin-policies"))
+
+	serverCmd.PersistentFlags().String("inventory-file", "", "path to persist the issued certs (default in memory)")
+	viper.BindPFlag("inventory_file", serverCmd.PersistentFlags().Lookup("inventory-file"))
+
+	serverCmd.PersistentFlags().String("denylist-file", "", "path to persist the denylist (default in memory)")
+	viper.BindPFlag("denylist_file", serverCmd.PersistentFlags().Lookup("denylist-file"))
+
+	serverCmd.PersistentFlags().String("tracing-endpoint", "", "otlp/http endpoint(host:port) to export traces to")
+	viper.BindPFlag("tracing.endpoint", serverCmd.PersistentFlags().Lookup("tracing-endpoint"))
+
+	serverCmd.PersistentFlags().Bool("tracing-insecure", false, "export traces without tls")
+	viper.BindPFlag("tracing.insecure", serverCmd.PersistentFlags().Lookup("tracing-insecure"))
+
+	serverCmd.PersistentFlags().Float64("tracing-sample-ratio", 1.0, "ratio of traces to sample(0.0-1.0)")
+	viper.BindPFlag("tracing.sample_ratio", serverCmd.PersistentFlags().Lookup("tracing-sample-ratio"))
+
+	serverCmd.PersistentFlags().String("audit-file", "", "path of the hash chained audit log")
+	viper.BindPFlag("audit.file", serverCmd.PersistentFlags().Lookup("audit-file"))
+
+	serverCmd.PersistentFlags().String("audit-checkpoint-file", "", "path to keep the head of the audit log hash chain")
+	viper.BindPFlag("audit.checkpoint_file", serverCmd.PersistentFlags().Lookup("audit-checkpoint-file"))
+
+	serverCmd.PersistentFlags().Bool("audit-syslog", false, "send audit events to syslog")
+	viper.BindPFlag("audit.syslog", serverCmd.PersistentFlags().Lookup("audit-syslog"))
+
+	serverCmd.PersistentFlags().String("audit-http-url", "", "url to post audit events to")
+	viper.BindPFlag("audit.http_url", serverCmd.PersistentFlags().Lookup("audit-http-url"))
+
 	rootCmd.AddCommand(serverCmd)
 }
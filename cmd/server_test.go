@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pyama86/kagiana/kagiana"
+)
+
+func Test_reloader_reload(t *testing.T) {
+	valid := func(cn string) *kagiana.Config {
+		return &kagiana.Config{
+			OAuthProvider: "github",
+			Certs: []kagiana.Cert{
+				{CommonName: cn, Path: "pki/issue/example"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		load    func() (*kagiana.Config, error)
+		wantCN  string
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			load:   func() (*kagiana.Config, error) { return valid("new.example.com"), nil },
+			wantCN: "new.example.com",
+		},
+		{
+			name:    "invalid",
+			load:    func() (*kagiana.Config, error) { return nil, errors.New("Key: 'Config.Certs' Error:Field validation for 'Certs' failed on the 'required' tag") },
+			wantCN:  "old.example.com",
+			wantErr: true,
+		},
+		{
+			name: "unknown provider",
+			load: func() (*kagiana.Config, error) {
+				c := valid("new.example.com")
+				c.OAuthProvider = "unknown"
+				return c, nil
+			},
+			wantCN:  "old.example.com",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := newStore(&kagiana.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, err := newApp(valid("old.example.com"), st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rl := &reloader{load: tt.load, store: st}
+			rl.current.Store(a)
+
+			if err := rl.reload(); (err != nil) != tt.wantErr {
+				t.Errorf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cn := rl.current.Load().config.Certs[0].CommonName; cn != tt.wantCN {
+				t.Errorf("current config = %s, want %s", cn, tt.wantCN)
+			}
+		})
+	}
+}
+
+type closeStore struct {
+	closed bool
+}
+
+func (s *closeStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	return true, 0, nil
+}
+
+func (s *closeStore) Close() error {
+	s.closed = true
+	return nil
+}
+
+func Test_reloader_keep(t *testing.T) {
+	config := func(cn string) *kagiana.Config {
+		return &kagiana.Config{
+			OAuthProvider: "github",
+			Certs:         []kagiana.Cert{{CommonName: cn, Path: "pki/issue/example"}},
+			RateLimit:     kagiana.RateLimitConfig{IPRate: 1, IPBurst: 5},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		change      func(*kagiana.Config)
+		sameLimiter bool
+		sameStore   bool
+		sameKeys    bool
+	}{
+		{
+			name:        "other section",
+			change:      func(c *kagiana.Config) { c.Certs[0].CommonName = "new.example.com" },
+			sameLimiter: true,
+			sameStore:   true,
+			sameKeys:    true,
+		},
+		{
+			name:      "limits",
+			change:    func(c *kagiana.Config) { c.RateLimit.IPRate = 2 },
+			sameStore: true,
+			sameKeys:  true,
+		},
+		{
+			name: "rate limit store",
+			change: func(c *kagiana.Config) {
+				c.RateLimit.Store, c.RateLimit.RedisAddr = kagiana.RateLimitStoreRedis, "127.0.0.1:6379"
+			},
+			sameKeys: true,
+		},
+		{
+			name:        "stns cache",
+			change:      func(c *kagiana.Config) { c.STNSCacheTTL = time.Minute },
+			sameLimiter: true,
+			sameStore:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st, err := newStore(&kagiana.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.close()
+			a, err := newApp(config("old.example.com"), st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			old := &closeStore{}
+			a.limitStore = old
+			st.keep(a)
+
+			rl := &reloader{load: func() (*kagiana.Config, error) {
+				c := config("old.example.com")
+				tt.change(c)
+				return c, nil
+			}, store: st}
+			rl.current.Store(a)
+			if err := rl.reload(); err != nil {
+				t.Fatal(err)
+			}
+
+			b := rl.current.Load()
+			if (b.limiter == a.limiter) != tt.sameLimiter {
+				t.Errorf("limiter kept = %v, want %v", b.limiter == a.limiter, tt.sameLimiter)
+			}
+			if (b.limitStore == old) != tt.sameStore || old.closed == tt.sameStore {
+				t.Errorf("store kept = %v, closed = %v, want kept %v", b.limitStore == old, old.closed, tt.sameStore)
+			}
+			if (b.stnsKeys == a.stnsKeys) != tt.sameKeys {
+				t.Errorf("stns keys kept = %v, want %v", b.stnsKeys == a.stnsKeys, tt.sameKeys)
+			}
+		})
+	}
+}
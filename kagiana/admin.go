@@ -0,0 +1,376 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// AdminConfig lists who may use the admin api. Admins log in like everyone
+// else and call the api with their Vault token. Users are listed as
+// <mount>:<alias>, the auth method and the entity alias of the token, so the
+// user of one auth method can't pass for the admin of another.
+type AdminConfig struct {
+	Users    []string `mapstructure:"users"`
+	Policies []string `mapstructure:"policies"`
+}
+
+type AdminCertsResponse struct {
+	Certs []InventoryCert `json:"certs"`
+}
+
+type AdminRevokeCertRequest struct {
+	SerialNumber string `json:"serial_number"`
+}
+
+type AdminRevokeTokensRequest struct {
+	Accessor string `json:"accessor,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+type AdminRevokeTokensResponse struct {
+	Revoked []string          `json:"revoked"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+type AdminDenyRequest struct {
+	DenyEntry
+	// Revoke revokes the certs and tokens in the inventory of the denied
+	// user or GitHub login.
+	Revoke bool `json:"revoke,omitempty"`
+}
+
+type AdminDenylistResponse struct {
+	Entries []DenyEntry                `json:"entries"`
+	Revoked *AdminRevokeTokensResponse `json:"revoked,omitempty"`
+}
+
+type Admin struct {
+	config    *Config
+	vault     *api.Client
+	inventory *Inventory
+	denylist  *Denylist
+}
+
+func NewAdmin(config *Config, vault *api.Client, inventory *Inventory, denylist *Denylist) *Admin {
+	return &Admin{
+		config:    config,
+		vault:     vault,
+		inventory: inventory,
+		denylist:  denylist,
+	}
+}
+
+type adminSession struct {
+	name   string
+	client *api.Client
+}
+
+func stringsFrom(v interface{}) []string {
+	ret := []string{}
+	if l, ok := v.([]interface{}); ok {
+		for _, s := range l {
+			if s, ok := s.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+	}
+	return ret
+}
+
+// authenticate looks up the Vault token of the request, so the admin is
+// identified by the same auth methods as the users.
+func (a *Admin) authenticate(r *http.Request) (*adminSession, *APIError) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return nil, NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "vault token is required")
+	}
+
+	client, err := a.vault.Clone()
+	if err != nil {
+		return nil, NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error())
+	}
+	client.SetToken(token)
+
+	secret, err := client.Auth().Token().LookupSelfWithContext(r.Context())
+	if err != nil || secret == nil {
+		return nil, withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "invalid vault token"))
+	}
+
+	name, apiErr := adminIdentity(r, client, secret)
+	if apiErr != nil {
+		Audit(r.Context(), AuditEvent{Type: AuditTypeAdmin, Outcome: AuditOutcomeFailure, Error: apiErr.Message, Details: map[string]string{"path": r.URL.Path}})
+		return nil, apiErr
+	}
+	policies := append(stringsFrom(secret.Data["policies"]), stringsFrom(secret.Data["identity_policies"])...)
+	SetRequestUser(r, name, "admin")
+
+	allowed := contains(a.config.Admin.Users, name)
+	for _, p := range policies {
+		allowed = allowed || contains(a.config.Admin.Policies, p)
+	}
+	if !allowed {
+		Audit(r.Context(), AuditEvent{Type: AuditTypeAdmin, Outcome: AuditOutcomeFailure, Error: "not an admin", Details: map[string]string{"path": r.URL.Path}})
+		return nil, NewAPIError(http.StatusForbidden, ErrCodeForbidden, "%s is not an admin", name)
+	}
+	return &adminSession{name: name, client: client}, nil
+}
+
+// adminIdentity names the admin <mount>:<alias> after the entity alias of
+// the auth method which issued the token. The metadata of a token is set by
+// whoever created it, so it is never trusted.
+func adminIdentity(r *http.Request, client *api.Client, secret *api.Secret) (string, *APIError) {
+	entityID, _ := secret.Data["entity_id"].(string)
+	path, _ := secret.Data["path"].(string)
+	if entityID == "" {
+		return "", NewAPIError(http.StatusForbidden, ErrCodeForbidden, "vault token has no entity")
+	}
+
+	// the admin reads its own entity, with identity/entity/id/{{identity.entity.id}}
+	entity, err := client.Logical().ReadWithContext(r.Context(), "identity/entity/id/"+entityID)
+	if err != nil || entity == nil {
+		return "", withContextAPIError(r.Context(), NewAPIError(http.StatusForbidden, ErrCodeForbidden, "entity of the vault token can't be read"))
+	}
+	if l, ok := entity.Data["aliases"].([]interface{}); ok {
+		for _, v := range l {
+			alias, _ := v.(map[string]interface{})
+			mount, _ := alias["mount_path"].(string)
+			name, _ := alias["name"].(string)
+			if mount != "" && name != "" && strings.HasPrefix(path, mount) {
+				return strings.TrimSuffix(strings.TrimPrefix(mount, "auth/"), "/") + ":" + name, nil
+			}
+		}
+	}
+	return "", NewAPIError(http.StatusForbidden, ErrCodeForbidden, "vault token has no entity alias")
+}
+
+func (a *Admin) handle(f func(http.ResponseWriter, *http.Request, *adminSession) *APIError) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, apiErr := a.authenticate(r)
+		if apiErr == nil {
+			apiErr = f(w, r, s)
+		}
+		if apiErr != nil {
+			logRequestError(r, apiErr)
+			RenderAPIError(w, RequestID(r), apiErr)
+		}
+	}
+}
+
+func auditAdmin(r *http.Request, action, target string, err error) {
+	outcome, msg := auditOutcome(err)
+	Audit(r.Context(), AuditEvent{
+		Type:    AuditTypeAdmin,
+		Outcome: outcome,
+		Error:   msg,
+		Details: map[string]string{"action": action, "target": target},
+	})
+}
+
+func decodeJSON(r *http.Request, v interface{}) *APIError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
+	}
+	return nil
+}
+
+// Readiness serves the details of the readiness checks, which /readyz hides.
+func (a *Admin) Readiness(h *Health) http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		h.Details(w, r)
+		return nil
+	})
+}
+
+func (a *Admin) Certs() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		q := r.URL.Query()
+		f := InventoryFilter{
+			User:           q.Get("user"),
+			Profile:        q.Get("profile"),
+			IncludeRevoked: q.Get("include_revoked") == "true",
+		}
+		if v := q.Get("expires_within"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
+			}
+			f.ExpiresBefore = time.Now().Add(d)
+		}
+		RenderJSON(w, http.StatusOK, &AdminCertsResponse{Certs: a.inventory.List(f)})
+		return nil
+	})
+}
+
+func (a *Admin) certConfig(profile string) (Cert, bool) {
+	for _, c := range a.config.Certs {
+		if c.CommonName == profile {
+			return c, true
+		}
+	}
+	return Cert{}, false
+}
+
+func (a *Admin) RevokeCert() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		req := AdminRevokeCertRequest{}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			return apiErr
+		}
+
+		ic, ok := a.inventory.Get(req.SerialNumber)
+		if !ok {
+			return NewAPIError(http.StatusNotFound, ErrCodeNotFound, "serial %s is not found", req.SerialNumber)
+		}
+		if apiErr := a.revokeCert(r, s, ic); apiErr != nil {
+			return apiErr
+		}
+
+		ic, _ = a.inventory.Get(req.SerialNumber)
+		RenderJSON(w, http.StatusOK, &ic)
+		return nil
+	})
+}
+
+func (a *Admin) revokeCert(r *http.Request, s *adminSession, ic InventoryCert) *APIError {
+	c, ok := a.certConfig(ic.Profile)
+	if !ok {
+		return NewAPIError(http.StatusNotFound, ErrCodeNotFound, "profile %s is not configured", ic.Profile)
+	}
+
+	_, err := s.client.Logical().WriteWithContext(r.Context(), c.ToRevokePath(), map[string]interface{}{
+		"serial_number": ic.SerialNumber,
+	})
+	auditAdmin(r, "revoke_cert", ic.SerialNumber, err)
+	if err != nil {
+		return withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeInternal, "revoke %s: %s", ic.SerialNumber, err.Error()))
+	}
+	Audit(r.Context(), AuditEvent{
+		Type:    AuditTypeRevoke,
+		Outcome: AuditOutcomeSuccess,
+		User:    ic.User,
+		Certs:   []AuditCert{{Name: ic.Profile, SerialNumber: ic.SerialNumber, NotAfter: ic.NotAfter}},
+		Details: map[string]string{"admin": s.name},
+	})
+	return nil
+}
+
+func (a *Admin) revokeTokens(r *http.Request, s *adminSession, accessors []string) *AdminRevokeTokensResponse {
+	ret := &AdminRevokeTokensResponse{Revoked: []string{}}
+	for _, accessor := range accessors {
+		err := s.client.Auth().Token().RevokeAccessorWithContext(r.Context(), accessor)
+		auditAdmin(r, "revoke_token", accessor, err)
+		if err != nil {
+			if ret.Errors == nil {
+				ret.Errors = map[string]string{}
+			}
+			ret.Errors[accessor] = err.Error()
+			continue
+		}
+		ret.Revoked = append(ret.Revoked, accessor)
+	}
+	return ret
+}
+
+func (a *Admin) userAccessors(user string) []string {
+	accessors := []string{}
+	seen := map[string]bool{}
+	for _, c := range a.inventory.List(InventoryFilter{User: user, IncludeRevoked: true}) {
+		if c.TokenAccessor != "" && !seen[c.TokenAccessor] {
+			seen[c.TokenAccessor] = true
+			accessors = append(accessors, c.TokenAccessor)
+		}
+	}
+	return accessors
+}
+
+// RevokeTokens revokes a token by its accessor, or every token which was
+// handed out to the user with a cert.
+func (a *Admin) RevokeTokens() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		req := AdminRevokeTokensRequest{}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			return apiErr
+		}
+
+		var accessors []string
+		switch {
+		case req.Accessor != "":
+			accessors = []string{req.Accessor}
+		case req.User != "":
+			accessors = a.userAccessors(req.User)
+		default:
+			return NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "accessor or user is required")
+		}
+		RenderJSON(w, http.StatusOK, a.revokeTokens(r, s, accessors))
+		return nil
+	})
+}
+
+func (a *Admin) Denylist() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		RenderJSON(w, http.StatusOK, &AdminDenylistResponse{Entries: a.denylist.List()})
+		return nil
+	})
+}
+
+func (a *Admin) AddDenylist() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		req := AdminDenyRequest{}
+		if apiErr := decodeJSON(r, &req); apiErr != nil {
+			return apiErr
+		}
+		e := req.DenyEntry
+		e.CreatedBy = s.name
+		e.CreatedAt = time.Time{}
+
+		err := a.denylist.Add(e)
+		auditDeny(r.Context(), "deny", e, err)
+		if err != nil {
+			return NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
+		}
+
+		ret := &AdminDenylistResponse{Entries: a.denylist.List()}
+		if req.Revoke && (e.Kind == DenyKindUser || e.Kind == DenyKindGitHubLogin) {
+			ret.Revoked = a.revokeUser(r, s, e.Value)
+		}
+		RenderJSON(w, http.StatusOK, ret)
+		return nil
+	})
+}
+
+func (a *Admin) RemoveDenylist() http.HandlerFunc {
+	return a.handle(func(w http.ResponseWriter, r *http.Request, s *adminSession) *APIError {
+		kind, value := r.URL.Query().Get("kind"), r.URL.Query().Get("value")
+		ok, err := a.denylist.Remove(kind, value)
+		auditDeny(r.Context(), "allow", DenyEntry{Kind: kind, Value: value, CreatedBy: s.name}, err)
+		if err != nil {
+			return NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error())
+		}
+		if !ok {
+			return NewAPIError(http.StatusNotFound, ErrCodeNotFound, "%s:%s is not denied", kind, value)
+		}
+		RenderJSON(w, http.StatusOK, &AdminDenylistResponse{Entries: a.denylist.List()})
+		return nil
+	})
+}
+
+// revokeUser revokes the certs and tokens of the user in the inventory. The
+// certs which fail to be revoked are reported with their serial number.
+func (a *Admin) revokeUser(r *http.Request, s *adminSession, user string) *AdminRevokeTokensResponse {
+	ret := a.revokeTokens(r, s, a.userAccessors(user))
+	for _, ic := range a.inventory.List(InventoryFilter{User: user}) {
+		if apiErr := a.revokeCert(r, s, ic); apiErr != nil {
+			if ret.Errors == nil {
+				ret.Errors = map[string]string{}
+			}
+			ret.Errors[ic.SerialNumber] = apiErr.Message
+			continue
+		}
+		ret.Revoked = append(ret.Revoked, ic.SerialNumber)
+	}
+	return ret
+}
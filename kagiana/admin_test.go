@@ -0,0 +1,297 @@
+package kagiana
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func newAdminVaultServer(t *testing.T, revoked *[]string) *httptest.Server {
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			switch r.Header.Get("X-Vault-Token") {
+			case "admin-token":
+				data = map[string]interface{}{"entity_id": "alice", "path": "auth/github/login", "policies": []interface{}{"default"}}
+			case "policy-token":
+				data = map[string]interface{}{"entity_id": "bob", "path": "auth/userpass/login/bob", "policies": []interface{}{"kagiana-admin"}}
+			case "provider-token":
+				data = map[string]interface{}{"entity_id": "corp-alice", "path": "auth/token/create/kagiana-corp", "policies": []interface{}{"default"}}
+			case "provider-admin-token":
+				data = map[string]interface{}{"entity_id": "sso-frank", "path": "auth/token/create/kagiana-sso", "policies": []interface{}{"default"}}
+			case "user-token":
+				data = map[string]interface{}{"entity_id": "carol", "path": "auth/github/login", "policies": []interface{}{"default"}}
+			case "userpass-token":
+				data = map[string]interface{}{"entity_id": "userpass-alice", "path": "auth/userpass/login/alice", "policies": []interface{}{"default"}}
+			case "forged-token":
+				data = map[string]interface{}{"display_name": "token-alice", "meta": map[string]interface{}{"username": "alice"}, "path": "auth/token/create", "policies": []interface{}{"default"}}
+			default:
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors":["permission denied"]}`))
+				return
+			}
+		case "/v1/identity/entity/id/alice":
+			data = adminEntity("auth/userpass/", "alice-old", "auth/github/", "alice")
+		case "/v1/identity/entity/id/bob":
+			data = adminEntity("auth/userpass/", "bob")
+		case "/v1/identity/entity/id/corp-alice":
+			data = adminEntity("auth/token/", "corp:alice")
+		case "/v1/identity/entity/id/sso-frank":
+			data = adminEntity("auth/token/", "sso:frank")
+		case "/v1/identity/entity/id/carol":
+			data = adminEntity("auth/github/", "carol")
+		case "/v1/identity/entity/id/userpass-alice":
+			data = adminEntity("auth/userpass/", "alice")
+		case "/v1/pki/revoke", "/v1/auth/token/revoke-accessor":
+			body := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&body)
+			mu.Lock()
+			*revoked = append(*revoked, body["serial_number"]+body["accessor"])
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			t.Errorf("unexpected request %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s, _ := json.Marshal(&api.Secret{Data: data})
+		w.Write(s)
+	}))
+}
+
+// adminEntity returns an entity with the aliases of mount path and name
+// pairs.
+func adminEntity(aliases ...string) map[string]interface{} {
+	l := []interface{}{}
+	for i := 0; i < len(aliases); i += 2 {
+		l = append(l, map[string]interface{}{"mount_path": aliases[i], "name": aliases[i+1]})
+	}
+	return map[string]interface{}{"aliases": l}
+}
+
+func TestAdmin(t *testing.T) {
+	revoked := []string{}
+	ts := newAdminVaultServer(t, &revoked)
+	defer ts.Close()
+
+	config := &Config{
+		VaultAddr: ts.URL,
+		Admin:     AdminConfig{Users: []string{"github:alice", "token:sso:frank"}, Policies: []string{"kagiana-admin"}},
+		Certs:     []Cert{{CommonName: "prod.example.com", Path: "pki/issue/prod"}},
+	}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inventory, err := OpenInventory(filepath.Join(t.TempDir(), "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	inventory.Notify(AuditEvent{
+		Type:          AuditTypeIssue,
+		Outcome:       AuditOutcomeSuccess,
+		User:          "dave",
+		TokenAccessor: "accessor-1",
+		Time:          now,
+		Certs: []AuditCert{
+			{Name: "prod.example.com", SerialNumber: "01", NotAfter: now.Add(time.Hour)},
+		},
+	})
+	inventory.Notify(AuditEvent{
+		Type:          AuditTypeIssue,
+		Outcome:       AuditOutcomeSuccess,
+		User:          "erin",
+		TokenAccessor: "accessor-2",
+		Time:          now,
+		Certs: []AuditCert{
+			{Name: "prod.example.com", SerialNumber: "02", NotAfter: now.Add(48 * time.Hour)},
+		},
+	})
+
+	denylist, err := OpenDenylist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Auditor{}
+	a.AddNotifier(inventory)
+	admin := NewAdmin(config, vault, inventory, denylist)
+	mux := http.NewServeMux()
+	mux.Handle("GET /api/v1/admin/certs", admin.Certs())
+	mux.Handle("POST /api/v1/admin/certs/revoke", admin.RevokeCert())
+	mux.Handle("POST /api/v1/admin/tokens/revoke", admin.RevokeTokens())
+	mux.Handle("POST /api/v1/admin/denylist", admin.AddDenylist())
+	mux.Handle("GET /api/v1/admin/readyz", admin.Readiness(NewHealth(config, vault)))
+	h := WithRequestID(WithAuditor(a, func(*http.Request) string { return "192.0.2.1" }, mux))
+
+	tests := []struct {
+		name        string
+		token       string
+		method      string
+		path        string
+		body        string
+		wantStatus  int
+		wantBody    string
+		wantRevoked []string
+	}{
+		{
+			name:       "no token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "readiness details without a token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/readyz",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid token",
+			token:      "invalid-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "not an admin",
+			token:      "user-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "provider user with the name of an admin",
+			token:      "provider-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "token:corp:alice is not an admin",
+		},
+		{
+			name:       "userpass user with the name of an admin",
+			token:      "userpass-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "userpass:alice is not an admin",
+		},
+		{
+			name:       "forged metadata",
+			token:      "forged-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "vault token has no entity",
+		},
+		{
+			name:       "admin of a provider",
+			token:      "provider-admin-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "list by expiry",
+			token:      "admin-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs?expires_within=24h",
+			wantStatus: http.StatusOK,
+			wantBody:   `"serial_number":"01"`,
+		},
+		{
+			name:       "list by user",
+			token:      "policy-token",
+			method:     http.MethodGet,
+			path:       "/api/v1/admin/certs?user=erin",
+			wantStatus: http.StatusOK,
+			wantBody:   `"serial_number":"02"`,
+		},
+		{
+			name:        "revoke cert",
+			token:       "admin-token",
+			method:      http.MethodPost,
+			path:        "/api/v1/admin/certs/revoke",
+			body:        `{"serial_number":"01"}`,
+			wantStatus:  http.StatusOK,
+			wantBody:    `"revoked":true`,
+			wantRevoked: []string{"01"},
+		},
+		{
+			name:       "revoke unknown cert",
+			token:      "admin-token",
+			method:     http.MethodPost,
+			path:       "/api/v1/admin/certs/revoke",
+			body:       `{"serial_number":"ff"}`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:        "revoke tokens of user",
+			token:       "admin-token",
+			method:      http.MethodPost,
+			path:        "/api/v1/admin/tokens/revoke",
+			body:        `{"user":"erin"}`,
+			wantStatus:  http.StatusOK,
+			wantBody:    `"revoked":["accessor-2"]`,
+			wantRevoked: []string{"accessor-2"},
+		},
+		{
+			name:       "block user",
+			token:      "admin-token",
+			method:     http.MethodPost,
+			path:       "/api/v1/admin/denylist",
+			body:       `{"kind":"user","value":"dave","reason":"stolen laptop"}`,
+			wantStatus: http.StatusOK,
+			wantBody:   `"created_by":"github:alice"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked = revoked[:0]
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+			if strings.Join(revoked, ",") != strings.Join(tt.wantRevoked, ",") {
+				t.Errorf("revoked = %v, want %v", revoked, tt.wantRevoked)
+			}
+		})
+	}
+
+	inventory.Close()
+	reopened, err := OpenInventory(inventory.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if c, _ := reopened.Get("01"); !c.Revoked {
+		t.Error("revocation is not persisted")
+	}
+
+	ctx := context.WithValue(context.Background(), denylistKey, denylist)
+	if apiErr := CheckDenylist(ctx, DenyQuery{User: "dave"}); apiErr == nil || apiErr.Status != http.StatusForbidden {
+		t.Errorf("CheckDenylist() = %v, want denied", apiErr)
+	}
+}
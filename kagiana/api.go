@@ -0,0 +1,205 @@
+package kagiana
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	APIVersionV1    = "v1"
+	RequestIDHeader = "X-Request-Id"
+)
+
+var APIVersions = []string{APIVersionV1}
+
+const (
+	ErrCodeInvalidRequest    = "invalid_request"
+	ErrCodeUnauthorized      = "unauthorized"
+	ErrCodeChallengeMismatch = "challenge_mismatch"
+	ErrCodeIssueFailed       = "issue_failed"
+	ErrCodeInternal          = "internal_error"
+	ErrCodeDenied            = "denied"
+	ErrCodeForbidden         = "forbidden"
+	ErrCodeNotFound          = "not_found"
+)
+
+type APIVersionsResponse struct {
+	Versions []string `json:"versions"`
+}
+
+type APIChallengeResponse struct {
+	Version   string `json:"version"`
+	RequestID string `json:"request_id"`
+	User      string `json:"user"`
+	Challenge string `json:"challenge"`
+}
+
+type APIToken struct {
+	Token     string   `json:"token"`
+	TTL       int      `json:"ttl"`
+	Renewable bool     `json:"renewable"`
+	Policies  []string `json:"policies"`
+}
+
+type APICert struct {
+	Name           string    `json:"name"`
+	Certificate    string    `json:"certificate"`
+	PrivateKey     string    `json:"private_key"`
+	PrivateKeyType string    `json:"private_key_type"`
+	IssuingCA      string    `json:"issuing_ca"`
+	CAChain        []string  `json:"ca_chain"`
+	SerialNumber   string    `json:"serial_number"`
+	Issuer         string    `json:"issuer"`
+	NotAfter       time.Time `json:"not_after"`
+}
+
+type APICertError struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+type APIResponse struct {
+	Version   string         `json:"version"`
+	RequestID string         `json:"request_id"`
+	Token     APIToken       `json:"token"`
+	Certs     []APICert      `json:"certs"`
+	Errors    []APICertError `json:"errors,omitempty"`
+}
+
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+func NewAPIError(status int, code, format string, args ...interface{}) *APIError {
+	return &APIError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// CAChainPEM joins the CA chain into the content of one PEM file, as the
+// legacy endpoints return it and the client saves it.
+func CAChainPEM(chain []string) string {
+	return strings.Join(chain, "\n")
+}
+
+func NewAPICert(name string, cb *certutil.CertBundle) (APICert, error) {
+	c := APICert{
+		Name:           name,
+		Certificate:    cb.Certificate,
+		PrivateKey:     cb.PrivateKey,
+		PrivateKeyType: string(cb.PrivateKeyType),
+		IssuingCA:      cb.IssuingCA,
+		CAChain:        cb.CAChain,
+		SerialNumber:   cb.SerialNumber,
+	}
+	if c.CAChain == nil {
+		c.CAChain = []string{}
+	}
+
+	p, err := cb.ToParsedCertBundle()
+	if err != nil {
+		return c, err
+	}
+	if p.Certificate != nil {
+		c.Issuer = p.Certificate.Issuer.String()
+		c.NotAfter = p.Certificate.NotAfter
+	}
+	return c, nil
+}
+
+func NewAPIResponse(requestID string, vlt *Vault, cbs map[string]*certutil.CertBundle, failures map[string]string) (*APIResponse, error) {
+	ret := &APIResponse{
+		Version:   APIVersionV1,
+		RequestID: requestID,
+		Token: APIToken{
+			Token:     vlt.Token(),
+			TTL:       vlt.TokenTTL(),
+			Renewable: vlt.Renewable(),
+			Policies:  vlt.Policies(),
+		},
+		Certs: []APICert{},
+	}
+
+	for _, name := range sortedCertNames(cbs) {
+		c, err := NewAPICert(name, cbs[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s parse cert failed: %s", name, err.Error())
+		}
+		ret.Certs = append(ret.Certs, c)
+	}
+
+	for _, name := range sortedFailureNames(failures) {
+		ret.Errors = append(ret.Errors, APICertError{Name: name, Message: failures[name]})
+	}
+	return ret, nil
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID returns the id assigned by WithRequestID, or the id sent by the
+// client, or a new random id.
+func RequestID(r *http.Request) string {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return info.id
+	}
+	if id := r.Header.Get(RequestIDHeader); requestIDPattern.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func RenderJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.Errorf("json marshal failed: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
+
+func RenderAPIError(w http.ResponseWriter, requestID string, apiErr *APIError) {
+	apiErr.RequestID = requestID
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, apiErr.Status, &APIErrorResponse{Error: apiErr})
+}
+
+func APIVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	RenderJSON(w, http.StatusOK, &APIVersionsResponse{Versions: APIVersions})
+}
+
+func sortedFailureNames(failures map[string]string) []string {
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
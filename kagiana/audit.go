@@ -0,0 +1,598 @@
+package kagiana
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	AuditTypeLogin     = "login"
+	AuditTypeChallenge = "challenge"
+	AuditTypeIssue     = "issue"
+	AuditTypeRevoke    = "revoke"
+	AuditTypeAdmin     = "admin"
+	// AuditTypeCheckpoint is sent to the sinks other than the file, with the
+	// head of its hash chain.
+	AuditTypeCheckpoint = "checkpoint"
+)
+
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+	AuditOutcomePartial = "partial"
+)
+
+const (
+	DefaultAuditSyslogTag   = "kagiana"
+	DefaultAuditHTTPTimeout = 5 * time.Second
+	// DefaultAuditCheckpointInterval is how often the head of the hash chain
+	// is written out of the file.
+	DefaultAuditCheckpointInterval = time.Minute
+	// DefaultAuditHTTPQueueSize is the number of events waiting to be posted.
+	DefaultAuditHTTPQueueSize = 1000
+)
+
+type AuditConfig struct {
+	File          string            `mapstructure:"file"`
+	Syslog        bool              `mapstructure:"syslog"`
+	SyslogNetwork string            `mapstructure:"syslog_network"`
+	SyslogAddr    string            `mapstructure:"syslog_addr"`
+	SyslogTag     string            `mapstructure:"syslog_tag"`
+	HTTPURL       string            `mapstructure:"http_url" validate:"omitempty,url"`
+	HTTPHeaders   map[string]string `mapstructure:"http_headers"`
+	HTTPTimeout   time.Duration     `mapstructure:"http_timeout"`
+	// CheckpointFile keeps the head of the hash chain of File, which is also
+	// sent to the other sinks, so removing records from the tail is detected.
+	CheckpointFile     string        `mapstructure:"checkpoint_file"`
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+}
+
+type AuditCert struct {
+	Name         string    `json:"name"`
+	SerialNumber string    `json:"serial_number"`
+	NotAfter     time.Time `json:"not_after,omitempty"`
+}
+
+// AuditEvent is one entry of the audit log. It must never carry a token,
+// only the accessor of the Vault token.
+type AuditEvent struct {
+	Time          time.Time         `json:"time"`
+	Type          string            `json:"type"`
+	Outcome       string            `json:"outcome"`
+	RequestID     string            `json:"request_id,omitempty"`
+	User          string            `json:"user,omitempty"`
+	Method        string            `json:"method,omitempty"`
+	IP            string            `json:"ip,omitempty"`
+	TokenAccessor string            `json:"token_accessor,omitempty"`
+	Certs         []AuditCert       `json:"certs,omitempty"`
+	Error         string            `json:"error,omitempty"`
+	Details       map[string]string `json:"details,omitempty"`
+}
+
+func auditCerts(cbs map[string]*certutil.CertBundle) []AuditCert {
+	certs := []AuditCert{}
+	for _, name := range sortedCertNames(cbs) {
+		c := AuditCert{Name: name, SerialNumber: cbs[name].SerialNumber}
+		if p, err := cbs[name].ToParsedCertBundle(); err == nil && p.Certificate != nil {
+			c.NotAfter = p.Certificate.NotAfter
+		}
+		certs = append(certs, c)
+	}
+	return certs
+}
+
+func auditOutcome(err error) (string, string) {
+	if err != nil {
+		return AuditOutcomeFailure, err.Error()
+	}
+	return AuditOutcomeSuccess, ""
+}
+
+type AuditSink interface {
+	Write(event []byte) error
+	Close() error
+}
+
+// AuditNotifier is told about every audit event, e.g. to send webhooks.
+type AuditNotifier interface {
+	Notify(e AuditEvent)
+}
+
+type namedAuditSink struct {
+	name string
+	sink AuditSink
+}
+
+// Auditor writes every event to all of the configured sinks.
+type Auditor struct {
+	sinks     []namedAuditSink
+	notifiers []AuditNotifier
+
+	file           *FileAuditSink
+	checkpointFile string
+	checkpoint     AuditCheckpoint
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+func NewAuditor(config AuditConfig) (*Auditor, error) {
+	a := &Auditor{checkpointFile: config.CheckpointFile}
+	if config.File != "" {
+		var cp *AuditCheckpoint
+		if config.CheckpointFile != "" {
+			c, err := ReadAuditCheckpoint(config.CheckpointFile)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			cp = c
+		}
+		s, err := openFileAuditSink(config.File, cp)
+		if err != nil {
+			return nil, err
+		}
+		a.AddSink("file", s)
+		a.file = s
+		if cp != nil {
+			a.checkpoint = *cp
+		}
+	}
+	if config.Syslog || config.SyslogAddr != "" {
+		s, err := NewSyslogAuditSink(config.SyslogNetwork, config.SyslogAddr, config.SyslogTag)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.AddSink("syslog", s)
+	}
+	if config.HTTPURL != "" {
+		a.AddSink("http", NewHTTPAuditSink(config.HTTPURL, config.HTTPHeaders, config.HTTPTimeout))
+	}
+	if a.file != nil {
+		interval := config.CheckpointInterval
+		if interval <= 0 {
+			interval = DefaultAuditCheckpointInterval
+		}
+		a.stop = make(chan struct{})
+		a.wg.Add(1)
+		go a.runCheckpoints(interval)
+	}
+	return a, nil
+}
+
+func (a *Auditor) AddSink(name string, sink AuditSink) {
+	a.sinks = append(a.sinks, namedAuditSink{name: name, sink: sink})
+}
+
+func (a *Auditor) AddNotifier(n AuditNotifier) {
+	a.notifiers = append(a.notifiers, n)
+}
+
+func (a *Auditor) Log(ctx context.Context, e AuditEvent) {
+	b, err := json.Marshal(&e)
+	if err != nil {
+		Logger(ctx).Errorf("audit marshal failed: %s", err.Error())
+		return
+	}
+	for _, s := range a.sinks {
+		if err := s.sink.Write(b); err != nil {
+			auditWriteErrorsTotal.WithLabelValues(s.name).Inc()
+			Logger(ctx).Errorf("audit %s sink write failed: %s", s.name, err.Error())
+		}
+	}
+	for _, n := range a.notifiers {
+		n.Notify(e)
+	}
+}
+
+func (a *Auditor) runCheckpoints(interval time.Duration) {
+	defer a.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.writeCheckpoint()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// writeCheckpoint anchors the head of the file sink in the checkpoint file
+// and the other sinks, when it has moved since the last checkpoint.
+func (a *Auditor) writeCheckpoint() {
+	seq, hash := a.file.Head()
+	if seq == 0 || seq == a.checkpoint.Seq && hash == a.checkpoint.Hash {
+		return
+	}
+	cp := AuditCheckpoint{Type: AuditTypeCheckpoint, Time: time.Now().UTC(), Seq: seq, Hash: hash}
+	if a.checkpointFile != "" {
+		if err := writeJSONFile(a.checkpointFile, &cp); err != nil {
+			auditWriteErrorsTotal.WithLabelValues("checkpoint").Inc()
+			logrus.Errorf("audit checkpoint write failed: %s", err.Error())
+			return
+		}
+	}
+	b, err := json.Marshal(&cp)
+	if err != nil {
+		logrus.Errorf("audit checkpoint marshal failed: %s", err.Error())
+		return
+	}
+	for _, s := range a.sinks {
+		if s.sink == AuditSink(a.file) {
+			continue
+		}
+		if err := s.sink.Write(b); err != nil {
+			auditWriteErrorsTotal.WithLabelValues(s.name).Inc()
+			logrus.Errorf("audit %s sink checkpoint write failed: %s", s.name, err.Error())
+		}
+	}
+	a.checkpoint = cp
+}
+
+func (a *Auditor) Close() error {
+	if a.stop != nil {
+		close(a.stop)
+		a.wg.Wait()
+		a.writeCheckpoint()
+		a.stop = nil
+	}
+	var errs []error
+	for _, s := range a.sinks {
+		errs = append(errs, s.sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type auditContext struct {
+	auditor  *Auditor
+	clientIP string
+}
+
+// WithAuditor makes the auditor and the client address available to Audit.
+func WithAuditor(a *Auditor, clientIP func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac := &auditContext{auditor: a, clientIP: clientIP(r)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), auditContextKey, ac)))
+	})
+}
+
+// NewAuditContext returns a context for the events outside of a request.
+func NewAuditContext(ctx context.Context, a *Auditor) context.Context {
+	return context.WithValue(ctx, auditContextKey, &auditContext{auditor: a})
+}
+
+func clientIPFrom(ctx context.Context) string {
+	if ac, ok := ctx.Value(auditContextKey).(*auditContext); ok {
+		return ac.clientIP
+	}
+	return ""
+}
+
+// Audit records the event with the request id, client address and user of
+// ctx filled in. It does nothing when ctx has no auditor.
+func Audit(ctx context.Context, e AuditEvent) {
+	ac, ok := ctx.Value(auditContextKey).(*auditContext)
+	if !ok || ac.auditor == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if e.IP == "" {
+		e.IP = ac.clientIP
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		e.RequestID = info.id
+		info.mu.Lock()
+		if e.User == "" {
+			e.User = info.user
+		}
+		if e.Method == "" {
+			e.Method = info.authMethod
+		}
+		info.mu.Unlock()
+	}
+	ac.auditor.Log(ctx, e)
+}
+
+// AuditRecord is a line of the file sink. Hash covers the sequence number,
+// the hash of the previous record and the event, so removing or editing a
+// record breaks the chain.
+type AuditRecord struct {
+	Seq      uint64          `json:"seq"`
+	PrevHash string          `json:"prev_hash"`
+	Hash     string          `json:"hash"`
+	Event    json.RawMessage `json:"event"`
+}
+
+func auditHash(seq uint64, prevHash string, event []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", seq, prevHash)
+	h.Write(event)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditCheckpoint is the head of the hash chain of a file sink, kept out of
+// the file. Records removed from the tail can't be detected by the chain
+// itself, only by a head which is missing from the file.
+type AuditCheckpoint struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Seq  uint64    `json:"seq"`
+	Hash string    `json:"hash"`
+}
+
+func ReadAuditCheckpoint(path string) (*AuditCheckpoint, error) {
+	cp := &AuditCheckpoint{}
+	if err := readJSONFile(path, cp); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+type FileAuditSink struct {
+	mu       sync.Mutex
+	file     *os.File
+	seq      uint64
+	prevHash string
+}
+
+// OpenFileAuditSink continues the hash chain of an existing file.
+func OpenFileAuditSink(path string) (*FileAuditSink, error) {
+	return openFileAuditSink(path, nil)
+}
+
+// openFileAuditSink refuses to continue a file which lost the records up to
+// the checkpoint cp, as the new records would hide it.
+func openFileAuditSink(path string, cp *AuditCheckpoint) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileAuditSink{file: f}
+	last, _, err := VerifyAuditLogCheckpoint(f, cp)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("audit log %s is broken: %w", path, err)
+	}
+	if last != nil {
+		s.seq = last.Seq
+		s.prevHash = last.Hash
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) Write(event []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := AuditRecord{
+		Seq:      s.seq + 1,
+		PrevHash: s.prevHash,
+		Event:    event,
+	}
+	rec.Hash = auditHash(rec.Seq, rec.PrevHash, rec.Event)
+	b, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.seq = rec.Seq
+	s.prevHash = rec.Hash
+	return nil
+}
+
+// Head returns the sequence number and the hash of the last record.
+func (s *FileAuditSink) Head() (uint64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq, s.prevHash
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of a file sink and returns the last
+// record and the number of records.
+func VerifyAuditLog(r io.Reader) (*AuditRecord, int, error) {
+	return VerifyAuditLogCheckpoint(r, nil)
+}
+
+// VerifyAuditLogCheckpoint checks the hash chain as VerifyAuditLog, and that
+// the record of the checkpoint cp is still in the log, when cp isn't nil.
+func VerifyAuditLogCheckpoint(r io.Reader, cp *AuditCheckpoint) (*AuditRecord, int, error) {
+	last, n, err := verifyAuditLog(r, func(rec *AuditRecord) error {
+		if cp != nil && rec.Seq == cp.Seq && rec.Hash != cp.Hash {
+			return fmt.Errorf("hash doesn't match the checkpoint")
+		}
+		return nil
+	})
+	if err != nil || cp == nil || cp.Seq == 0 {
+		return last, n, err
+	}
+	if last == nil || last.Seq < cp.Seq {
+		end := uint64(0)
+		if last != nil {
+			end = last.Seq
+		}
+		return last, n, fmt.Errorf("log ends at seq %d before the checkpoint at seq %d, records were removed", end, cp.Seq)
+	}
+	return last, n, nil
+}
+
+func verifyAuditLog(r io.Reader, check func(*AuditRecord) error) (*AuditRecord, int, error) {
+	var last *AuditRecord
+	n := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		n++
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return last, n, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		want := AuditRecord{Seq: 1}
+		if last != nil {
+			want = AuditRecord{Seq: last.Seq + 1, PrevHash: last.Hash}
+		}
+		if rec.Seq != want.Seq {
+			return last, n, fmt.Errorf("line %d: seq is %d, want %d", n, rec.Seq, want.Seq)
+		}
+		if rec.PrevHash != want.PrevHash {
+			return last, n, fmt.Errorf("line %d: prev_hash doesn't match the previous record", n)
+		}
+		if rec.Hash != auditHash(rec.Seq, rec.PrevHash, rec.Event) {
+			return last, n, fmt.Errorf("line %d: hash doesn't match the record", n)
+		}
+		if err := check(rec); err != nil {
+			return last, n, fmt.Errorf("line %d: %w", n, err)
+		}
+		last = rec
+	}
+	return last, n, scanner.Err()
+}
+
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogAuditSink connects to the local syslog when addr is empty.
+func NewSyslogAuditSink(network, addr, tag string) (*SyslogAuditSink, error) {
+	if tag == "" {
+		tag = DefaultAuditSyslogTag
+	}
+	w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogAuditSink{writer: w}, nil
+}
+
+func (s *SyslogAuditSink) Write(event []byte) error {
+	return s.writer.Info(string(event))
+}
+
+func (s *SyslogAuditSink) Close() error {
+	return s.writer.Close()
+}
+
+// HTTPAuditSink posts the events in the background, so a slow collector
+// doesn't hold up logins. Events are dropped when the queue is full.
+type HTTPAuditSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+	queue   chan []byte
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewHTTPAuditSink(url string, headers map[string]string, timeout time.Duration) *HTTPAuditSink {
+	return newHTTPAuditSink(url, headers, timeout, DefaultAuditHTTPQueueSize)
+}
+
+func newHTTPAuditSink(url string, headers map[string]string, timeout time.Duration, queueSize int) *HTTPAuditSink {
+	if timeout == 0 {
+		timeout = DefaultAuditHTTPTimeout
+	}
+	s := &HTTPAuditSink{
+		url:     url,
+		headers: headers,
+		client:  &http.Client{Timeout: timeout, Transport: tracingTransport(http.DefaultTransport)},
+		queue:   make(chan []byte, queueSize),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+// Write drops the events after Close, as a handler still running at
+// shutdown may audit a login.
+func (s *HTTPAuditSink) Write(event []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		auditEventsDroppedTotal.WithLabelValues("http").Inc()
+		return fmt.Errorf("sink is closed, drop the event")
+	}
+	select {
+	case s.queue <- event:
+		return nil
+	default:
+		auditEventsDroppedTotal.WithLabelValues("http").Inc()
+		return fmt.Errorf("queue is full, drop the event")
+	}
+}
+
+func (s *HTTPAuditSink) run() {
+	defer s.wg.Done()
+	for event := range s.queue {
+		if err := s.post(event); err != nil {
+			auditWriteErrorsTotal.WithLabelValues("http").Inc()
+			logrus.Errorf("audit http sink write failed: %s", err.Error())
+		}
+	}
+}
+
+func (s *HTTPAuditSink) post(event []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(event))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("status code=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Close waits for the queued events to be posted.
+func (s *HTTPAuditSink) Close() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
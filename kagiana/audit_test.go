@@ -0,0 +1,301 @@
+package kagiana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeAuditLog(t *testing.T, path string, users ...string) {
+	s, err := OpenFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	a := &Auditor{}
+	a.AddSink("file", s)
+	for _, u := range users {
+		a.Log(context.Background(), AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeSuccess, User: u})
+	}
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		tamper  func([]string) []string
+		wantErr string
+	}{
+		{
+			name:   "ok",
+			tamper: func(lines []string) []string { return lines },
+		},
+		{
+			name: "deleted",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			wantErr: "line 2: seq is 3, want 2",
+		},
+		{
+			name: "edited",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], `"user":"bob"`, `"user":"eve"`, 1)
+				return lines
+			},
+			wantErr: "line 2: hash doesn't match the record",
+		},
+		{
+			name: "rehashed",
+			tamper: func(lines []string) []string {
+				rec := AuditRecord{}
+				json.Unmarshal([]byte(lines[1]), &rec)
+				rec.Event = json.RawMessage(strings.Replace(string(rec.Event), `"user":"bob"`, `"user":"eve"`, 1))
+				rec.Hash = auditHash(rec.Seq, rec.PrevHash, rec.Event)
+				b, _ := json.Marshal(&rec)
+				lines[1] = string(b)
+				return lines
+			},
+			wantErr: "line 3: prev_hash doesn't match the previous record",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			writeAuditLog(t, path, "alice", "bob")
+			// reopening continues the chain
+			writeAuditLog(t, path, "carol")
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := tt.tamper(strings.Split(strings.TrimSpace(string(b)), "\n"))
+
+			_, n, err := VerifyAuditLog(strings.NewReader(strings.Join(lines, "\n")))
+			if tt.wantErr == "" {
+				if err != nil || n != 3 {
+					t.Errorf("VerifyAuditLog() = %d, %v", n, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("VerifyAuditLog() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAudit_VaultLogin(t *testing.T) {
+	var received bytes.Buffer
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(&received, r.Body)
+	}))
+	defer sink.Close()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := json.Marshal(&api.Secret{Auth: &api.SecretAuth{
+			ClientToken: "secret-token",
+			Accessor:    "test-accessor",
+			Metadata:    map[string]string{"username": "alice"},
+		}})
+		w.Write(s)
+	}))
+	defer ts.Close()
+
+	config := &Config{OAuthProvider: "github", VaultAddr: ts.URL}
+	base, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Auditor{}
+	a.AddSink("http", NewHTTPAuditSink(sink.URL, nil, 0))
+	h := WithRequestID(WithAuditor(a, func(*http.Request) string { return "192.0.2.1" }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRequestUser(r, "", "github")
+		if _, err := NewVault(r.Context(), base, config, map[string]string{"github_token": "github-token"}); err != nil {
+			t.Fatal(err)
+		}
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	a.Close()
+
+	if strings.Contains(received.String(), "secret-token") || strings.Contains(received.String(), "github-token") {
+		t.Fatalf("audit event contains a token: %s", received.String())
+	}
+
+	got := AuditEvent{}
+	if err := json.Unmarshal(received.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := AuditEvent{
+		Time:          got.Time,
+		Type:          AuditTypeLogin,
+		Outcome:       AuditOutcomeSuccess,
+		RequestID:     "req-1",
+		User:          "alice",
+		Method:        "github",
+		IP:            "192.0.2.1",
+		TokenAccessor: "test-accessor",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("audit event = %+v, want %+v", got, want)
+	}
+}
+
+func TestHTTPAuditSink_Queue(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	received := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, string(b))
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	dropped := testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("http"))
+	s := newHTTPAuditSink(ts.URL, nil, 0, 1)
+	// the collector is stuck, so one event is posted, one waits and the rest
+	// are dropped without blocking
+	errs := 0
+	for i := 0; i < 4; i++ {
+		if err := s.Write([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+			errs++
+		}
+	}
+	if errs < 2 {
+		t.Errorf("dropped %d events, want at least 2", errs)
+	}
+	if got := testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("http")) - dropped; got != float64(errs) {
+		t.Errorf("audit_events_dropped_total = %v, want %d", got, errs)
+	}
+
+	close(release)
+	s.Close()
+	if len(received) != 4-errs {
+		t.Errorf("received %v, want %d events", received, 4-errs)
+	}
+
+	// a handler still running at shutdown writes after Close
+	dropped = testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("http"))
+	if err := s.Write([]byte(`{"n":4}`)); err == nil {
+		t.Error("Write() after Close() succeeded")
+	}
+	if got := testutil.ToFloat64(auditEventsDroppedTotal.WithLabelValues("http")) - dropped; got != 1 {
+		t.Errorf("audit_events_dropped_total after Close() = %v, want 1", got)
+	}
+	s.Close()
+}
+
+type memoryAuditSink struct {
+	events []string
+}
+
+func (s *memoryAuditSink) Write(event []byte) error {
+	s.events = append(s.events, string(event))
+	return nil
+}
+
+func (s *memoryAuditSink) Close() error { return nil }
+
+func TestAuditor_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	config := AuditConfig{File: filepath.Join(dir, "audit.log"), CheckpointFile: filepath.Join(dir, "audit.checkpoint")}
+	a, err := NewAuditor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := &memoryAuditSink{}
+	a.AddSink("memory", mem)
+	for _, u := range []string{"alice", "bob", "carol"} {
+		a.Log(context.Background(), AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeSuccess, User: u})
+	}
+	a.Close()
+
+	cp, err := ReadAuditCheckpoint(config.CheckpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Seq != 3 {
+		t.Fatalf("checkpoint seq = %d, want 3", cp.Seq)
+	}
+	sent := AuditCheckpoint{}
+	if err := json.Unmarshal([]byte(mem.events[len(mem.events)-1]), &sent); err != nil || sent != *cp {
+		t.Errorf("checkpoint sent to the other sinks = %+v, want %+v", sent, *cp)
+	}
+
+	b, err := os.ReadFile(config.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	tests := []struct {
+		name    string
+		log     []string
+		head    AuditCheckpoint
+		wantErr string
+	}{
+		{name: "ok", log: lines, head: *cp},
+		{
+			name:    "truncated",
+			log:     lines[:2],
+			head:    *cp,
+			wantErr: "log ends at seq 2 before the checkpoint at seq 3, records were removed",
+		},
+		{
+			name:    "emptied",
+			log:     nil,
+			head:    *cp,
+			wantErr: "log ends at seq 0 before the checkpoint at seq 3, records were removed",
+		},
+		{
+			name:    "other head",
+			log:     lines,
+			head:    AuditCheckpoint{Seq: 3, Hash: "forged"},
+			wantErr: "line 3: hash doesn't match the checkpoint",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := VerifyAuditLogCheckpoint(strings.NewReader(strings.Join(tt.log, "\n")), &tt.head)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyAuditLogCheckpoint() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("VerifyAuditLogCheckpoint() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	// kagiana doesn't continue a truncated log, which would move the
+	// checkpoint past the removed records
+	if err := os.WriteFile(config.File, []byte(strings.Join(lines[:2], "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewAuditor(config); err == nil || !strings.Contains(err.Error(), "records were removed") {
+		t.Errorf("NewAuditor() of a truncated log error = %v", err)
+	}
+}
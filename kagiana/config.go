@@ -1,32 +1,146 @@
 package kagiana
 
 import (
+	"path"
+	"strings"
+	"time"
+
 	"github.com/STNS/libstns-go/libstns"
 	"golang.org/x/oauth2"
 )
 
 type Config struct {
-	PIDFile       string          `mapstructure:"pid_file"`
-	LogFile       string          `mapstructure:"log_file"`
-	LogLevel      string          `mapstructure:"log_level"`
-	Listener      string          `mapstructure:"listener"`
-	OAuthProvider string          `mapstructure:"oauth_provider"`
-	OAuth         oauth2.Config   `mapstructure:"oauth"`
-	Certs         []Cert          `mapstructure:"certs" validate:"required"`
-	STNSEndpoint  string          `mapstructure:"stns_endpoint"`
-	STNSOptions   libstns.Options `mapstructure:"stns_options"`
-	VaultAuthPath string          `mapstructure:"vault_auth_path"`
+	PIDFile              string           `mapstructure:"pid_file"`
+	LogFile              string           `mapstructure:"log_file"`
+	LogLevel             string           `mapstructure:"log_level"`
+	LogFormat            string           `mapstructure:"log_format" validate:"omitempty,oneof=json text"`
+	Listener             string           `mapstructure:"listener"`
+	MetricsListener      string           `mapstructure:"metrics_listener"`
+	AdminListener        string           `mapstructure:"admin_listener"`
+	TLS                  TLSConfig        `mapstructure:"tls"`
+	Renew                RenewConfig      `mapstructure:"renew"`
+	Admin                AdminConfig      `mapstructure:"admin"`
+	InventoryFile        string           `mapstructure:"inventory_file"`
+	DenylistFile         string           `mapstructure:"denylist_file"`
+	Denylist             []DenyEntry      `mapstructure:"denylist"`
+	GitHubAPIURL         string           `mapstructure:"github_api_url"`
+	ReadinessCacheTTL    time.Duration    `mapstructure:"readiness_cache_ttl"`
+	RateLimit            RateLimitConfig  `mapstructure:"rate_limit"`
+	RequestTimeout       time.Duration    `mapstructure:"request_timeout"`
+	Tracing              TracingConfig    `mapstructure:"tracing"`
+	Audit                AuditConfig      `mapstructure:"audit"`
+	Webhooks             []WebhookConfig  `mapstructure:"webhooks" validate:"dive"`
+	ExternalURL          string           `mapstructure:"external_url"`
+	Device               DeviceConfig     `mapstructure:"device"`
+	OAuthProvider        string           `mapstructure:"oauth_provider"`
+	OAuth                oauth2.Config    `mapstructure:"oauth"`
+	OAuthStateSecret     string           `mapstructure:"oauth_state_secret"`
+	Providers            []ProviderConfig `mapstructure:"providers" validate:"dive"`
+	Certs                []Cert           `mapstructure:"certs" validate:"required"`
+	STNSEndpoint         string           `mapstructure:"stns_endpoint"`
+	STNSOptions          libstns.Options  `mapstructure:"stns_options"`
+	STNSCacheTTL         time.Duration    `mapstructure:"stns_cache_ttl"`
+	STNSNegativeCacheTTL time.Duration    `mapstructure:"stns_negative_cache_ttl"`
+	STNSCacheSize        int              `mapstructure:"stns_cache_size"`
+	VaultAuthPath        string           `mapstructure:"vault_auth_path"`
+	VaultAddr            string           `mapstructure:"vault_addr"`
+	VaultTimeout         time.Duration    `mapstructure:"vault_timeout"`
+	VaultMaxIdleConns    int              `mapstructure:"vault_max_idle_conns"`
+	VaultIdleConnTimeout time.Duration    `mapstructure:"vault_idle_conn_timeout"`
+	IssueConcurrency     int              `mapstructure:"issue_concurrency"`
+	IssueFailureMode     string           `mapstructure:"issue_failure_mode" validate:"omitempty,oneof=partial revoke"`
+}
+
+// ProviderConfig is a login method listed on the landing page, served under
+// /auth/<name>/login and /auth/<name>/callback.
+type ProviderConfig struct {
+	Name          string        `mapstructure:"name" validate:"required,alphanum,ne=stns"`
+	Type          string        `mapstructure:"type" validate:"required"`
+	DisplayName   string        `mapstructure:"display_name"`
+	OAuth         oauth2.Config `mapstructure:"oauth"`
+	VaultAuthPath string        `mapstructure:"vault_auth_path"`
+	// BaseURL is the url of a self-hosted provider.
+	BaseURL string `mapstructure:"base_url"`
+	// VaultLogin is how a user verified by the provider logs in to Vault:
+	// jwt with the id token of the provider and VaultRole, or token to have
+	// a token created by kagiana with VaultTokenRole.
+	VaultLogin     string `mapstructure:"vault_login" validate:"omitempty,oneof=jwt token"`
+	VaultRole      string `mapstructure:"vault_role"`
+	VaultToken     string `mapstructure:"vault_token"`
+	VaultTokenFile string `mapstructure:"vault_token_file"`
+	VaultTokenRole string `mapstructure:"vault_token_role"`
+	// VaultTokenEntityAlias creates the token with the entity alias
+	// <provider>:<user>, which the token role must allow.
+	VaultTokenEntityAlias bool          `mapstructure:"vault_token_entity_alias"`
+	AllowedGroups         []string      `mapstructure:"allowed_groups"`
+	SAML                  SAMLConfig    `mapstructure:"saml"`
+	Lockout               LockoutConfig `mapstructure:"lockout"`
+	Header                HeaderConfig  `mapstructure:"header"`
+}
+
+func (p ProviderConfig) Title() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Name
+}
+
+// ProviderConfigs returns the providers, or the single provider of
+// oauth_provider and oauth when none are configured.
+func (c *Config) ProviderConfigs() []ProviderConfig {
+	if len(c.Providers) > 0 {
+		return c.Providers
+	}
+	typ := c.OAuthProvider
+	if typ == "" {
+		typ = "github"
+	}
+	return []ProviderConfig{{Name: typ, Type: typ, OAuth: c.OAuth, VaultAuthPath: c.VaultAuthPath}}
+}
+
+// ForProvider returns the config seen by the handlers of a provider.
+func (c *Config) ForProvider(p ProviderConfig) *Config {
+	pc := *c
+	pc.OAuthProvider = p.Type
+	pc.OAuth = p.OAuth
+	pc.VaultAuthPath = p.VaultAuthPath
+	if pc.OAuth.RedirectURL == "" {
+		pc.OAuth.RedirectURL = externalURL(c, "/auth/"+p.Name+"/callback")
+	}
+	if p.Type == "gitlab" {
+		gitlabOAuthDefaults(&pc.OAuth, p)
+	}
+	return &pc
 }
 
 type Cert struct {
 	CommonName string `mapstructure:"common_name" validate:"required"`
 	Path       string `validate:"required"`
+	RevokePath string `mapstructure:"revoke_path"`
 	Format     string
 	TTL        string
 	AltNames   string
 	IPSans     string
 }
 
+// ToMountPath returns the PKI mount which issues the cert.
+func (c Cert) ToMountPath() string {
+	for _, sep := range []string{"/issue/", "/sign/"} {
+		if i := strings.LastIndex(c.Path, sep); i >= 0 {
+			return c.Path[:i]
+		}
+	}
+	return path.Dir(path.Dir(c.Path))
+}
+
+// ToRevokePath returns the revoke endpoint of the PKI mount which issues the cert.
+func (c Cert) ToRevokePath() string {
+	if c.RevokePath != "" {
+		return c.RevokePath
+	}
+	return path.Join(c.ToMountPath(), "revoke")
+}
+
 func (c Cert) ToVaultOptions() map[string]interface{} {
 	r := map[string]interface{}{}
 	r["common_name"] = c.CommonName
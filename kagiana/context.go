@@ -0,0 +1,87 @@
+package kagiana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StatusClientClosedRequest is returned when the client went away before
+// the response was written.
+const StatusClientClosedRequest = 499
+
+const DefaultRequestTimeout = 60 * time.Second
+
+const (
+	ErrCodeTimeout  = "timeout"
+	ErrCodeCanceled = "canceled"
+)
+
+// WithRequestTimeout sets the server-wide deadline on the request context.
+func WithRequestTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// contextAPIError returns the error to respond with when the request context
+// is done, or nil when the request is still alive.
+func contextAPIError(ctx context.Context) *APIError {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return NewAPIError(http.StatusGatewayTimeout, ErrCodeTimeout, "request deadline exceeded")
+	case errors.Is(ctx.Err(), context.Canceled):
+		return NewAPIError(StatusClientClosedRequest, ErrCodeCanceled, "request canceled by client")
+	}
+	return nil
+}
+
+// withContextAPIError replaces apiErr with the context error when the
+// failure was caused by the request being cancelled or timing out.
+func withContextAPIError(ctx context.Context, apiErr *APIError) *APIError {
+	if ctxErr := contextAPIError(ctx); ctxErr != nil {
+		ctxErr.Message = fmt.Sprintf("%s: %s", ctxErr.Message, apiErr.Message)
+		return ctxErr
+	}
+	return apiErr
+}
+
+// logRequestError logs err, distinguishing requests which were cancelled or
+// timed out from real failures.
+func logRequestError(r *http.Request, err error) {
+	if err == nil {
+		err = errors.New("unknown error")
+	}
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		Logger(r.Context()).Warnf("request canceled %s %s (%s): %s", r.Method, r.URL.Path, ctxErr.Error(), err.Error())
+		return
+	}
+	Logger(r.Context()).Error(err)
+}
+
+// withContext runs f, which can't be cancelled by itself, and returns early
+// when ctx is done.
+func withContext(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,63 @@
+package kagiana
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name       string
+		timeout    time.Duration
+		wait       time.Duration
+		wantStatus int
+	}{
+		{
+			name:       "ok",
+			timeout:    time.Second,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "deadline exceeded",
+			timeout:    10 * time.Millisecond,
+			wait:       time.Second,
+			wantStatus: http.StatusGatewayTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := WithRequestTimeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				err := withContext(r.Context(), func() error {
+					time.Sleep(tt.wait)
+					return nil
+				})
+				if err != nil {
+					apiErr := withContextAPIError(r.Context(), NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error()))
+					w.WriteHeader(apiErr.Status)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}), tt.timeout)
+
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, httptest.NewRequest("GET", "/", nil))
+			if resp.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestContextAPIError(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if apiErr := contextAPIError(ctx); apiErr != nil {
+		t.Errorf("contextAPIError() = %v, want nil", apiErr)
+	}
+	cancel()
+	if apiErr := contextAPIError(ctx); apiErr == nil || apiErr.Status != StatusClientClosedRequest {
+		t.Errorf("contextAPIError() = %v, want status %d", apiErr, StatusClientClosedRequest)
+	}
+}
@@ -0,0 +1,391 @@
+package kagiana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	DenyKindUser           = "user"
+	DenyKindGitHubLogin    = "github_login"
+	DenyKindKeyFingerprint = "key_fingerprint"
+	DenyKindIPRange        = "ip_range"
+)
+
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+type DenyEntry struct {
+	Kind      string    `json:"kind" mapstructure:"kind"`
+	Value     string    `json:"value" mapstructure:"value"`
+	Reason    string    `json:"reason,omitempty" mapstructure:"reason"`
+	CreatedBy string    `json:"created_by,omitempty" mapstructure:"-"`
+	CreatedAt time.Time `json:"created_at" mapstructure:"-"`
+}
+
+// normalize lowers the case of the names which are matched case
+// insensitively, like GitHub logins and LDAP users.
+func (e DenyEntry) normalize() DenyEntry {
+	switch e.Kind {
+	case DenyKindUser, DenyKindGitHubLogin:
+		e.Value = strings.ToLower(e.Value)
+	}
+	return e
+}
+
+func (e DenyEntry) key() string {
+	e = e.normalize()
+	return e.Kind + ":" + e.Value
+}
+
+func (e DenyEntry) validate() error {
+	if e.Value == "" {
+		return fmt.Errorf("value is empty")
+	}
+	switch e.Kind {
+	case DenyKindUser, DenyKindGitHubLogin:
+	case DenyKindKeyFingerprint:
+		if !strings.HasPrefix(e.Value, "SHA256:") {
+			return fmt.Errorf("key fingerprint %q must be a SHA256 fingerprint", e.Value)
+		}
+	case DenyKindIPRange:
+		if _, _, err := net.ParseCIDR(e.Value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", e.Kind)
+	}
+	return nil
+}
+
+// DenyQuery is what is known about a login at the time of the check.
+type DenyQuery struct {
+	User        string
+	GitHubLogin string
+	IP          string
+}
+
+// Denylist holds the blocked accounts. Entries from the config are replaced
+// on reload, entries added through the admin api are persisted to path
+// unless it is empty.
+type Denylist struct {
+	path string
+
+	mu      sync.RWMutex
+	entries map[string]DenyEntry
+	static  map[string]DenyEntry
+}
+
+func OpenDenylist(path string) (*Denylist, error) {
+	d := &Denylist{path: path, entries: map[string]DenyEntry{}, static: map[string]DenyEntry{}}
+	if path == "" {
+		return d, nil
+	}
+
+	entries := []DenyEntry{}
+	if err := readJSONFile(path, &entries); err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		d.entries[e.key()] = e.normalize()
+	}
+	return d, nil
+}
+
+// SetStatic replaces the entries of the config and records the changes in
+// the audit log of ctx.
+func (d *Denylist) SetStatic(ctx context.Context, entries []DenyEntry) error {
+	static := map[string]DenyEntry{}
+	for _, e := range entries {
+		if err := e.validate(); err != nil {
+			return err
+		}
+		e.CreatedBy = "config"
+		static[e.key()] = e.normalize()
+	}
+
+	d.mu.Lock()
+	old := d.static
+	d.static = static
+	d.mu.Unlock()
+
+	for key, e := range static {
+		if _, ok := old[key]; !ok {
+			auditDeny(ctx, "deny", e, nil)
+		}
+	}
+	for key, e := range old {
+		if _, ok := static[key]; !ok {
+			auditDeny(ctx, "allow", e, nil)
+		}
+	}
+	return nil
+}
+
+func (d *Denylist) Add(e DenyEntry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	e = e.normalize()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries[e.key()] = e
+	return d.save()
+}
+
+// Remove only removes the entries added through the admin api.
+func (d *Denylist) Remove(kind, value string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := DenyEntry{Kind: kind, Value: value}.key()
+	if _, ok := d.entries[key]; !ok {
+		return false, nil
+	}
+	delete(d.entries, key)
+	return true, d.save()
+}
+
+func (d *Denylist) List() []DenyEntry {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	ret := []DenyEntry{}
+	for _, m := range []map[string]DenyEntry{d.static, d.entries} {
+		for _, e := range m {
+			ret = append(ret, e)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].key() == ret[j].key() {
+			return ret[i].CreatedBy < ret[j].CreatedBy
+		}
+		return ret[i].key() < ret[j].key()
+	})
+	return ret
+}
+
+func (d *Denylist) lookup(kind, value string) (DenyEntry, bool) {
+	key := DenyEntry{Kind: kind, Value: value}.key()
+	if e, ok := d.static[key]; ok {
+		return e, true
+	}
+	e, ok := d.entries[key]
+	return e, ok
+}
+
+func (d *Denylist) HasKind(kind string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, m := range []map[string]DenyEntry{d.static, d.entries} {
+		for _, e := range m {
+			if e.Kind == kind {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check returns the entry blocking the login.
+func (d *Denylist) Check(q DenyQuery) (DenyEntry, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if q.User != "" {
+		if e, ok := d.lookup(DenyKindUser, q.User); ok {
+			return e, true
+		}
+	}
+	if q.GitHubLogin != "" {
+		if e, ok := d.lookup(DenyKindGitHubLogin, q.GitHubLogin); ok {
+			return e, true
+		}
+	}
+	if ip := net.ParseIP(q.IP); ip != nil {
+		for _, m := range []map[string]DenyEntry{d.static, d.entries} {
+			for _, e := range m {
+				if e.Kind != DenyKindIPRange {
+					continue
+				}
+				if _, n, err := net.ParseCIDR(e.Value); err == nil && n.Contains(ip) {
+					return e, true
+				}
+			}
+		}
+	}
+	return DenyEntry{}, false
+}
+
+// FilterKeys drops the public keys whose fingerprint is denied.
+func (d *Denylist) FilterKeys(keys []string) ([]string, []DenyEntry) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	allowed := []string{}
+	denied := []DenyEntry{}
+	for _, k := range keys {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err == nil {
+			if e, ok := d.lookup(DenyKindKeyFingerprint, ssh.FingerprintSHA256(pub)); ok {
+				denied = append(denied, e)
+				continue
+			}
+		}
+		allowed = append(allowed, k)
+	}
+	return allowed, denied
+}
+
+// save must be called with mu held.
+func (d *Denylist) save() error {
+	if d.path == "" {
+		return nil
+	}
+	entries := []DenyEntry{}
+	for _, e := range d.entries {
+		entries = append(entries, e)
+	}
+	return writeJSONFile(d.path, entries)
+}
+
+func auditDeny(ctx context.Context, action string, e DenyEntry, err error) {
+	outcome, msg := auditOutcome(err)
+	Audit(ctx, AuditEvent{
+		Type:    AuditTypeAdmin,
+		Outcome: outcome,
+		Error:   msg,
+		Details: map[string]string{"action": action, "target": e.key(), "reason": e.Reason, "created_by": e.CreatedBy},
+	})
+}
+
+// WithDenylist makes the denylist available to CheckDenylist.
+func WithDenylist(d *Denylist, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), denylistKey, d)))
+	})
+}
+
+func denylistFrom(ctx context.Context) *Denylist {
+	d, _ := ctx.Value(denylistKey).(*Denylist)
+	return d
+}
+
+func deniedError(ctx context.Context, user string, e DenyEntry) *APIError {
+	Audit(ctx, AuditEvent{
+		Type:    AuditTypeLogin,
+		Outcome: AuditOutcomeFailure,
+		User:    user,
+		Error:   "denied",
+		Details: map[string]string{"deny_kind": e.Kind, "deny_value": e.Value},
+	})
+	return NewAPIError(http.StatusForbidden, ErrCodeDenied, "%s is denied", user)
+}
+
+// CheckDenylist returns an error when the login or the client address is
+// denied, and records the rejected attempt in the audit log.
+func CheckDenylist(ctx context.Context, q DenyQuery) *APIError {
+	d := denylistFrom(ctx)
+	if d == nil {
+		return nil
+	}
+	if q.IP == "" {
+		q.IP = clientIPFrom(ctx)
+	}
+
+	e, denied := d.Check(q)
+	if !denied {
+		return nil
+	}
+	user := q.User
+	if user == "" {
+		user = q.GitHubLogin
+	}
+	if user == "" {
+		user = q.IP
+	}
+	return deniedError(ctx, user, e)
+}
+
+// checkVaultUser checks the login name reported by Vault, which is only known
+// after the login, and revokes the token of a denied user.
+func checkVaultUser(ctx context.Context, vlt *Vault) *APIError {
+	q := DenyQuery{User: vlt.UserName()}
+	if vlt.config.OAuthProvider == "github" {
+		q.GitHubLogin = vlt.UserName()
+	}
+	apiErr := CheckDenylist(ctx, q)
+	if apiErr != nil {
+		if err := vlt.RevokeToken(context.Background()); err != nil {
+			Logger(ctx).Errorf("%s revoke token failed: %s", vlt.UserName(), err.Error())
+		}
+	}
+	return apiErr
+}
+
+// checkGitHubToken asks GitHub whose token it is before the token is sent
+// to Vault. GitHub is only asked when GitHub logins are denied.
+func checkGitHubToken(ctx context.Context, config *Config, user, token string) *APIError {
+	d := denylistFrom(ctx)
+	if d == nil || !d.HasKind(DenyKindGitHubLogin) {
+		return nil
+	}
+
+	login, err := fetchGitHubLogin(ctx, config.GitHubAPIURL, token)
+	if err != nil {
+		return withContextAPIError(ctx, NewAPIError(http.StatusBadGateway, ErrCodeUnauthorized, "can't get github login: %s", err.Error()))
+	}
+	if e, denied := d.Check(DenyQuery{GitHubLogin: login}); denied {
+		if user == "" {
+			user = login
+		}
+		return deniedError(ctx, user, e)
+	}
+	return nil
+}
+
+func fetchGitHubLogin(ctx context.Context, apiURL, token string) (string, error) {
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+
+	ctx, span := startSpan(ctx, "github.user")
+	defer span.End()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(apiURL, "/")+"/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status code=%d", resp.StatusCode)
+	}
+	ret := struct {
+		Login string `json:"login"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+	return ret.Login, nil
+}
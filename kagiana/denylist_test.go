@@ -0,0 +1,183 @@
+package kagiana
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testDenyKey         = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFWWqmcm/tXhmA/aQ/O9hHiAFtxrfEbxH44NnOVEvX7d alice@example.com"
+	testDenyFingerprint = "SHA256:qAdYSoDrweTr64DZgifNfKwXkj6Yf37+C8tFHI5AvKM"
+)
+
+func TestDenylist_Check(t *testing.T) {
+	d, err := OpenDenylist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetStatic(context.Background(), []DenyEntry{
+		{Kind: DenyKindUser, Value: "mallory"},
+		{Kind: DenyKindUser, Value: "Evil"},
+		{Kind: DenyKindIPRange, Value: "198.51.100.0/24"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add(DenyEntry{Kind: DenyKindGitHubLogin, Value: "OctoCat"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		query      DenyQuery
+		wantDenied bool
+		wantKind   string
+	}{
+		{name: "allowed", query: DenyQuery{User: "alice", IP: "192.0.2.1"}},
+		{name: "user", query: DenyQuery{User: "mallory"}, wantDenied: true, wantKind: DenyKindUser},
+		{name: "github login", query: DenyQuery{User: "alice", GitHubLogin: "octocat"}, wantDenied: true, wantKind: DenyKindGitHubLogin},
+		{name: "user in another case", query: DenyQuery{User: "Mallory"}, wantDenied: true, wantKind: DenyKindUser},
+		{name: "static user in another case", query: DenyQuery{User: "evil"}, wantDenied: true, wantKind: DenyKindUser},
+		{name: "github login in another case", query: DenyQuery{User: "alice", GitHubLogin: "OCTOCAT"}, wantDenied: true, wantKind: DenyKindGitHubLogin},
+		{name: "ip range", query: DenyQuery{User: "alice", IP: "198.51.100.7"}, wantDenied: true, wantKind: DenyKindIPRange},
+		{name: "invalid ip", query: DenyQuery{IP: "unknown"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, denied := d.Check(tt.query)
+			if denied != tt.wantDenied {
+				t.Fatalf("Check() denied = %v, want %v", denied, tt.wantDenied)
+			}
+			if e.Kind != tt.wantKind {
+				t.Errorf("Check() kind = %s, want %s", e.Kind, tt.wantKind)
+			}
+		})
+	}
+}
+
+func TestDenylist_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   DenyEntry
+		wantErr bool
+	}{
+		{name: "user", entry: DenyEntry{Kind: DenyKindUser, Value: "mallory"}},
+		{name: "fingerprint", entry: DenyEntry{Kind: DenyKindKeyFingerprint, Value: testDenyFingerprint}},
+		{name: "md5 fingerprint", entry: DenyEntry{Kind: DenyKindKeyFingerprint, Value: "a0:b1:c2"}, wantErr: true},
+		{name: "invalid cidr", entry: DenyEntry{Kind: DenyKindIPRange, Value: "198.51.100.0"}, wantErr: true},
+		{name: "unknown kind", entry: DenyEntry{Kind: "email", Value: "mallory@example.com"}, wantErr: true},
+		{name: "empty value", entry: DenyEntry{Kind: DenyKindUser}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.entry.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDenylist_FilterKeys(t *testing.T) {
+	d, err := OpenDenylist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := "ssh-rsa invalid bob@example.com"
+	if err := d.Add(DenyEntry{Kind: DenyKindKeyFingerprint, Value: testDenyFingerprint}); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed, denied := d.FilterKeys([]string{testDenyKey, other})
+	if len(allowed) != 1 || allowed[0] != other {
+		t.Errorf("allowed = %v, want %v", allowed, []string{other})
+	}
+	if len(denied) != 1 || denied[0].Value != testDenyFingerprint {
+		t.Errorf("denied = %v", denied)
+	}
+}
+
+func TestDenylist_Persist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "denylist.json")
+	d, err := OpenDenylist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetStatic(context.Background(), []DenyEntry{{Kind: DenyKindUser, Value: "static"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add(DenyEntry{Kind: DenyKindUser, Value: "dynamic", CreatedBy: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := d.Remove(DenyKindUser, "static"); ok {
+		t.Error("static entry must not be removed")
+	}
+
+	reopened, err := OpenDenylist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, denied := reopened.Check(DenyQuery{User: "Dynamic"}); !denied {
+		t.Error("dynamic entry is not persisted")
+	}
+	if _, denied := reopened.Check(DenyQuery{User: "static"}); denied {
+		t.Error("static entry is persisted")
+	}
+
+	if err := d.SetStatic(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, denied := d.Check(DenyQuery{User: "static"}); denied {
+		t.Error("static entry is not replaced")
+	}
+}
+
+func TestCheckGitHubToken(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user" {
+			t.Errorf("unexpected request %s", r.URL.Path)
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer octocat-token":
+			w.Write([]byte(`{"login":"octocat"}`))
+		case "Bearer alice-token":
+			w.Write([]byte(`{"login":"alice"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	d, err := OpenDenylist("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Add(DenyEntry{Kind: DenyKindGitHubLogin, Value: "octocat"}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), denylistKey, d)
+	config := &Config{GitHubAPIURL: ts.URL}
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{name: "allowed", token: "alice-token"},
+		{name: "denied", token: "octocat-token", wantStatus: http.StatusForbidden},
+		{name: "invalid token", token: "invalid", wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := checkGitHubToken(ctx, config, "", tt.token)
+			status := 0
+			if apiErr != nil {
+				status = apiErr.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("checkGitHubToken() status = %d, want %d", status, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+package kagiana
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+)
+
+const (
+	DefaultDeviceCodeTTL  = 10 * time.Minute
+	DefaultDeviceInterval = 5 * time.Second
+
+	DeviceGrantType  = "urn:ietf:params:oauth:grant-type:device_code"
+	DeviceCookieKey  = "kagiana_device"
+	deviceSlowDown   = 5 * time.Second
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// the error codes of RFC 8628
+const (
+	ErrCodeAuthorizationPending = "authorization_pending"
+	ErrCodeSlowDown             = "slow_down"
+	ErrCodeExpiredToken         = "expired_token"
+	ErrCodeAccessDenied         = "access_denied"
+)
+
+type DeviceConfig struct {
+	CodeTTL  time.Duration `mapstructure:"code_ttl"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+type APIDeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceSession struct {
+	deviceCode string
+	userCode   string
+	expiresAt  time.Time
+	interval   time.Duration
+	lastPoll   time.Time
+	denied     string
+	response   *APIResponse
+	// login is the user logged in for the device, held until the user
+	// confirms the device with nonce.
+	login *Vault
+	nonce string
+}
+
+// DeviceStore holds the pending device logins. It outlives config reloads,
+// so a reload doesn't break the logins in progress.
+type DeviceStore struct {
+	mu       sync.Mutex
+	sessions map[string]*deviceSession
+	// userCodes maps a user code to its device code
+	userCodes map[string]string
+}
+
+func NewDeviceStore() *DeviceStore {
+	return &DeviceStore{sessions: map[string]*deviceSession{}, userCodes: map[string]string{}}
+}
+
+// sweep must be called with mu held.
+func (s *DeviceStore) sweep(now time.Time) {
+	for code, d := range s.sessions {
+		if now.After(d.expiresAt) {
+			if d.login != nil {
+				revokeLater(d.login)
+			}
+			delete(s.sessions, code)
+			delete(s.userCodes, d.userCode)
+		}
+	}
+}
+
+func newUserCode() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	code := make([]byte, 0, 9)
+	for i, c := range b {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+	}
+	return string(code)
+}
+
+// normalizeUserCode accepts the code typed in lower case or without dash.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+func (s *DeviceStore) create(ttl, interval time.Duration) *deviceSession {
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	userCode := newUserCode()
+	for _, ok := s.userCodes[userCode]; ok; _, ok = s.userCodes[userCode] {
+		userCode = newUserCode()
+	}
+	d := &deviceSession{
+		deviceCode: base64.RawURLEncoding.EncodeToString(b),
+		userCode:   userCode,
+		expiresAt:  now.Add(ttl),
+		interval:   interval,
+	}
+	s.sessions[d.deviceCode] = d
+	s.userCodes[userCode] = d.deviceCode
+	return d
+}
+
+func (s *DeviceStore) pending(userCode string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.sessions[s.userCodes[normalizeUserCode(userCode)]]
+	return ok && time.Now().Before(d.expiresAt) && d.response == nil && d.denied == "" && d.login == nil
+}
+
+// hold keeps the login of the user until the device is confirmed.
+func (s *DeviceStore) hold(userCode string, vlt *Vault, nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.sessions[s.userCodes[normalizeUserCode(userCode)]]
+	if !ok || time.Now().After(d.expiresAt) || d.response != nil || d.denied != "" || d.login != nil {
+		return false
+	}
+	d.login, d.nonce = vlt, nonce
+	return true
+}
+
+// release returns the login held for userCode once, when the confirmation
+// carries its nonce.
+func (s *DeviceStore) release(userCode, nonce string) (*Vault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.sessions[s.userCodes[normalizeUserCode(userCode)]]
+	if !ok || time.Now().After(d.expiresAt) || d.login == nil || subtle.ConstantTimeCompare([]byte(nonce), []byte(d.nonce)) != 1 {
+		return nil, false
+	}
+	vlt := d.login
+	d.login, d.nonce = nil, ""
+	return vlt, true
+}
+
+func (s *DeviceStore) complete(userCode string, resp *APIResponse, denied string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.sessions[s.userCodes[normalizeUserCode(userCode)]]
+	if !ok || time.Now().After(d.expiresAt) || d.response != nil || d.denied != "" {
+		return false
+	}
+	d.response = resp
+	d.denied = denied
+	return true
+}
+
+// poll returns the response once, when the user approved the login.
+func (s *DeviceStore) poll(deviceCode string) (*APIResponse, *APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.sessions[deviceCode]
+	now := time.Now()
+	switch {
+	case !ok:
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "unknown device code")
+	case now.After(d.expiresAt):
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeExpiredToken, "device code expired")
+	case d.denied != "":
+		s.remove(d)
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeAccessDenied, "%s", d.denied)
+	case d.response != nil:
+		s.remove(d)
+		return d.response, nil
+	case now.Sub(d.lastPoll) < d.interval:
+		d.interval += deviceSlowDown
+		d.lastPoll = now
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeSlowDown, "poll every %d seconds", int(d.interval.Seconds()))
+	}
+	d.lastPoll = now
+	return nil, NewAPIError(http.StatusBadRequest, ErrCodeAuthorizationPending, "waiting for the user to approve")
+}
+
+// remove must be called with mu held.
+func (s *DeviceStore) remove(d *deviceSession) {
+	delete(s.sessions, d.deviceCode)
+	delete(s.userCodes, d.userCode)
+}
+
+// DeviceFlow is the device authorization grant of RFC 8628. The user approves
+// the device in a browser through a provider, whose callback hands the
+// issued certs over to the polling device.
+type DeviceFlow struct {
+	config *Config
+	store  *DeviceStore
+	login  http.HandlerFunc
+}
+
+func NewDeviceFlow(config *Config, store *DeviceStore, login http.HandlerFunc) *DeviceFlow {
+	return &DeviceFlow{config: config, store: store, login: login}
+}
+
+// externalURL returns the url of kagiana seen by the browser, taken from
+// external_url or the oauth redirect url.
+func externalURL(config *Config, p string) string {
+	base := config.ExternalURL
+	if base == "" {
+		if u, err := url.Parse(config.OAuth.RedirectURL); err == nil {
+			base = u.Scheme + "://" + u.Host
+		}
+	}
+	return strings.TrimSuffix(base, "/") + p
+}
+
+func (df *DeviceFlow) codeTTL() time.Duration {
+	if df.config.Device.CodeTTL == 0 {
+		return DefaultDeviceCodeTTL
+	}
+	return df.config.Device.CodeTTL
+}
+
+func (df *DeviceFlow) Code(w http.ResponseWriter, r *http.Request) {
+	ttl, interval := df.codeTTL(), df.config.Device.Interval
+	if interval == 0 {
+		interval = DefaultDeviceInterval
+	}
+
+	d := df.store.create(ttl, interval)
+	uri := externalURL(df.config, "/device")
+	RenderJSON(w, http.StatusOK, &APIDeviceCodeResponse{
+		DeviceCode:              d.deviceCode,
+		UserCode:                d.userCode,
+		VerificationURI:         uri,
+		VerificationURIComplete: uri + "?" + url.Values{"user_code": []string{d.userCode}}.Encode(),
+		ExpiresIn:               int(ttl.Seconds()),
+		Interval:                int(interval.Seconds()),
+	})
+}
+
+func (df *DeviceFlow) Token(w http.ResponseWriter, r *http.Request) {
+	requestID := RequestID(r)
+	if err := r.ParseForm(); err != nil {
+		RenderAPIError(w, requestID, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
+	if r.FormValue("grant_type") != DeviceGrantType {
+		RenderAPIError(w, requestID, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "grant_type must be %s", DeviceGrantType))
+		return
+	}
+
+	resp, apiErr := df.store.poll(r.FormValue("device_code"))
+	if apiErr != nil {
+		RenderAPIError(w, requestID, apiErr)
+		return
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, http.StatusOK, resp)
+}
+
+// Verify shows the form to enter the user code, and starts the login of
+// the provider when it is posted. The form is bound to the state cookie, and
+// the user confirms the code again after the login, so neither a form posted
+// from another site nor a link sent by someone else approves a device.
+func (df *DeviceFlow) Verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		state, err := newLoginState(r)
+		if err != nil {
+			renderRequestError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		df.renderForm(w, r, http.StatusOK, state, normalizeUserCode(r.URL.Query().Get("user_code")), "")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderRequestError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if r.PostForm.Get("confirm") != "" {
+		df.confirm(w, r)
+		return
+	}
+
+	userCode := normalizeUserCode(r.PostForm.Get("user_code"))
+	state, apiErr := readLoginState(r, df.config, r.PostForm.Get("state"))
+	if apiErr != nil {
+		// the form wasn't rendered by this browser, start over
+		s, err := newLoginState(r)
+		if err != nil {
+			renderRequestError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		df.renderForm(w, r, apiErr.Status, s, userCode, apiErr.Message)
+		return
+	}
+	if !df.store.pending(userCode) {
+		df.renderForm(w, r, http.StatusBadRequest, state, userCode, "The code is invalid or expired.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     DeviceCookieKey,
+		Value:    userCode,
+		Path:     "/",
+		MaxAge:   int(df.codeTTL().Seconds()),
+		Secure:   secureCookie(df.config, r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	df.login(w, r)
+}
+
+func (df *DeviceFlow) renderForm(w http.ResponseWriter, r *http.Request, statusCode int, state *oauthState, userCode, errMsg string) {
+	if err := setLoginState(w, r, df.config, state); err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	renderDevice(w, statusCode, deviceView{UserCode: userCode, State: state.Nonce, Error: errMsg})
+}
+
+// confirm issues the certs to the device held by the login, or denies it.
+func (df *DeviceFlow) confirm(w http.ResponseWriter, r *http.Request) {
+	userCode := normalizeUserCode(r.PostForm.Get("user_code"))
+	state, apiErr := takeLoginState(w, r, df.config, r.PostForm.Get("state"))
+	if apiErr != nil {
+		renderRequestError(w, r, apiErr.Status, apiErr)
+		return
+	}
+	vlt, ok := df.store.release(userCode, state.Nonce)
+	if !ok {
+		renderRequestError(w, r, http.StatusBadRequest, fmt.Errorf("device code %s expired", userCode))
+		return
+	}
+
+	approval := &deviceApproval{config: df.config, store: df.store, userCode: userCode, confirmed: true}
+	if r.PostForm.Get("confirm") != "approve" {
+		revokeLater(vlt)
+		approval.deny(w, r, "the user denied the device")
+		Logger(r.Context()).Infof("%s denied device %s", vlt.UserName(), userCode)
+		renderDevice(w, http.StatusOK, deviceView{Denied: true, UserCode: userCode})
+		return
+	}
+	getCert(w, withHandoff(r, approval), vlt)
+}
+
+// WithSession routes the callback of a device login to the device, instead of
+// rendering the certs in the browser.
+func (df *DeviceFlow) WithSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(DeviceCookieKey)
+		if err != nil || !df.store.pending(c.Value) {
+			next(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: DeviceCookieKey, Path: "/", MaxAge: -1})
+		next(w, withHandoff(r, &deviceApproval{config: df.config, store: df.store, userCode: c.Value}))
+	}
+}
+
+type deviceApproval struct {
+	config    *Config
+	store     *DeviceStore
+	userCode  string
+	confirmed bool
+}
+
+// confirm holds the login and asks the user to confirm the code of the
+// device, before any cert is issued.
+func (d *deviceApproval) confirm(w http.ResponseWriter, r *http.Request, vlt *Vault) bool {
+	if d.confirmed {
+		return true
+	}
+	state := &oauthState{Nonce: randomString(), ExpiresAt: time.Now().Add(oauthStateTTL).Unix()}
+	if !d.store.hold(d.userCode, vlt, state.Nonce) {
+		revokeLater(vlt)
+		renderRequestError(w, r, http.StatusBadRequest, fmt.Errorf("device code %s expired", d.userCode))
+		return false
+	}
+	if err := setLoginState(w, r, d.config, state); err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return false
+	}
+	renderDevice(w, http.StatusOK, deviceView{Confirm: true, UserCode: d.userCode, User: vlt.UserName(), State: state.Nonce})
+	return false
+}
+
+// approve hands the issued certs over to the device.
+func (d *deviceApproval) approve(w http.ResponseWriter, r *http.Request, vlt *Vault, cbs map[string]*certutil.CertBundle, failures map[string]string) {
+	resp, err := NewAPIResponse(RequestID(r), vlt, cbs, failures)
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if !d.store.complete(d.userCode, resp, "") {
+		renderRequestError(w, r, http.StatusBadRequest, fmt.Errorf("device code %s expired", d.userCode))
+		return
+	}
+	Logger(r.Context()).Infof("%s approved device %s", vlt.UserName(), d.userCode)
+	renderDevice(w, http.StatusOK, deviceView{Approved: true})
+}
+
+// deny makes the device stop polling, when the login in the browser failed.
+// The browser shows the error.
+func (d *deviceApproval) deny(w http.ResponseWriter, r *http.Request, reason string) bool {
+	d.store.complete(d.userCode, nil, reason)
+	return false
+}
@@ -0,0 +1,247 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"golang.org/x/oauth2"
+)
+
+type fakeProvider struct {
+	callback http.HandlerFunc
+}
+
+func (p *fakeProvider) Login(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, "https://github.com/login/oauth/authorize", http.StatusTemporaryRedirect)
+}
+
+func (p *fakeProvider) Callback(w http.ResponseWriter, r *http.Request) {
+	p.callback(w, r)
+}
+
+// postDeviceToken waits out the poll interval of the tests, so polls in a row
+// aren't told to slow down.
+func postDeviceToken(h http.Handler, deviceCode string) *httptest.ResponseRecorder {
+	time.Sleep(2 * time.Millisecond)
+	values := url.Values{"grant_type": []string{DeviceGrantType}, "device_code": []string{deviceCode}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/device/token", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+var deviceFormState = regexp.MustCompile(`name="state" value="([^"]*)"`)
+
+func TestDeviceFlow(t *testing.T) {
+	revoked := make(chan string, 1)
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/revoke-self" {
+			revoked <- r.Header.Get("X-Vault-Token")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer tv.Close()
+	base, err := NewVaultClient(&Config{VaultAddr: tv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVault := func(token string) *Vault {
+		client, _ := base.Clone()
+		client.SetToken(token)
+		return &Vault{client: client, config: &Config{}, auth: &api.SecretAuth{Metadata: map[string]string{"username": "alice"}}}
+	}
+
+	login := newVault("device-token")
+	provider := &fakeProvider{callback: func(w http.ResponseWriter, r *http.Request) {
+		if handoffFrom(r.Context()) != nil {
+			getCert(w, r, login)
+			return
+		}
+		w.Write([]byte("browser login"))
+	}}
+	config := &Config{
+		OAuth:  oauth2.Config{RedirectURL: "https://kagiana.example.com/callback"},
+		Device: DeviceConfig{Interval: time.Millisecond},
+	}
+	df := NewDeviceFlow(config, NewDeviceStore(), provider.Login)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v1/device/code", df.Code)
+	mux.HandleFunc("POST /api/v1/device/token", df.Token)
+	mux.HandleFunc("/device", df.Verify)
+	mux.HandleFunc("/callback", df.WithSession(provider.Callback))
+
+	newCode := func(t *testing.T) APIDeviceCodeResponse {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v1/device/code", nil))
+		code := APIDeviceCodeResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&code); err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	// post sends the form of the page with its state cookie
+	post := func(page *httptest.ResponseRecorder, values url.Values) *httptest.ResponseRecorder {
+		if m := deviceFormState.FindStringSubmatch(page.Body.String()); m != nil {
+			values.Set("state", m[1])
+		}
+		req := httptest.NewRequest(http.MethodPost, "/device", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range page.Result().Cookies() {
+			if c.Name == CookieKey && c.MaxAge >= 0 {
+				req.AddCookie(c)
+			}
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	get := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	// loginDevice enters userCode and logs in, and returns the confirmation page
+	loginDevice := func(t *testing.T, userCode string) *httptest.ResponseRecorder {
+		w := post(get("/device", nil), url.Values{"user_code": {userCode}})
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("verify status = %d, want redirect to the provider", w.Code)
+		}
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == DeviceCookieKey {
+				cookie = c
+			}
+		}
+		if cookie == nil || !cookie.HttpOnly || !cookie.Secure || cookie.Value != normalizeUserCode(userCode) {
+			t.Fatalf("cookie = %+v", cookie)
+		}
+		return get("/callback", cookie)
+	}
+
+	code := newCode(t)
+	if code.VerificationURI != "https://kagiana.example.com/device" || !strings.Contains(code.VerificationURIComplete, "user_code=") {
+		t.Errorf("verification uri = %s, %s", code.VerificationURI, code.VerificationURIComplete)
+	}
+	if w := postDeviceToken(mux, code.DeviceCode); !strings.Contains(w.Body.String(), ErrCodeAuthorizationPending) {
+		t.Errorf("token = %s, want pending", w.Body.String())
+	}
+
+	// a form posted from another site has no state cookie
+	w := post(httptest.NewRecorder(), url.Values{"user_code": {code.UserCode}, "state": {"forged"}})
+	if w.Code != http.StatusBadRequest || len(w.Result().Cookies()) != 1 || w.Result().Cookies()[0].Name != CookieKey {
+		t.Errorf("forged verify status = %d, cookies = %+v", w.Code, w.Result().Cookies())
+	}
+	if w := post(get("/device", nil), url.Values{"user_code": {"BCDF-GHJK"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown code status = %d", w.Code)
+	}
+
+	page := loginDevice(t, strings.ToLower(strings.Replace(code.UserCode, "-", "", 1)))
+	if !strings.Contains(page.Body.String(), "Confirm Device") || !strings.Contains(page.Body.String(), code.UserCode) {
+		t.Fatalf("callback = %s, want the confirmation", page.Body.String())
+	}
+	if w := postDeviceToken(mux, code.DeviceCode); !strings.Contains(w.Body.String(), ErrCodeAuthorizationPending) {
+		t.Errorf("token before the confirmation = %s, want pending", w.Body.String())
+	}
+	if w := post(httptest.NewRecorder(), url.Values{"user_code": {code.UserCode}, "confirm": {"approve"}, "state": {"forged"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("forged confirmation status = %d", w.Code)
+	}
+	if w := post(page, url.Values{"user_code": {code.UserCode}, "confirm": {"approve"}}); !strings.Contains(w.Body.String(), "Device Approved") {
+		t.Errorf("confirmation = %s, want approved", w.Body.String())
+	}
+
+	// a callback without the device cookie is a normal browser login
+	if w := get("/callback", nil); w.Body.String() != "browser login" {
+		t.Errorf("callback = %s, want browser login", w.Body.String())
+	}
+
+	time.Sleep(time.Millisecond)
+	w = postDeviceToken(mux, code.DeviceCode)
+	ret := APIResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Token.Token != "device-token" {
+		t.Errorf("token = %s, want device-token", ret.Token.Token)
+	}
+	if w := postDeviceToken(mux, code.DeviceCode); w.Code != http.StatusBadRequest {
+		t.Errorf("second poll status = %d, want the device code to be used once", w.Code)
+	}
+
+	// denied by the user
+	code = newCode(t)
+	login = newVault("denied-token")
+	page = loginDevice(t, code.UserCode)
+	if w := post(page, url.Values{"user_code": {code.UserCode}, "confirm": {"deny"}}); !strings.Contains(w.Body.String(), "Device Denied") {
+		t.Errorf("confirmation = %s, want denied", w.Body.String())
+	}
+	select {
+	case token := <-revoked:
+		if token != "denied-token" {
+			t.Errorf("revoked %s, want denied-token", token)
+		}
+	case <-time.After(time.Second):
+		t.Error("the token of the denied device is not revoked")
+	}
+	time.Sleep(time.Millisecond)
+	if w := postDeviceToken(mux, code.DeviceCode); !strings.Contains(w.Body.String(), ErrCodeAccessDenied) {
+		t.Errorf("token = %s, want denied", w.Body.String())
+	}
+}
+
+func TestDeviceStore_Poll(t *testing.T) {
+	s := NewDeviceStore()
+	tests := []struct {
+		name     string
+		session  func() string
+		wantCode string
+	}{
+		{
+			name:     "unknown",
+			session:  func() string { return "unknown" },
+			wantCode: ErrCodeInvalidRequest,
+		},
+		{
+			name: "slow down",
+			session: func() string {
+				d := s.create(time.Minute, time.Hour)
+				s.poll(d.deviceCode)
+				return d.deviceCode
+			},
+			wantCode: ErrCodeSlowDown,
+		},
+		{
+			name:     "expired",
+			session:  func() string { return s.create(-time.Second, time.Second).deviceCode },
+			wantCode: ErrCodeExpiredToken,
+		},
+		{
+			name: "denied",
+			session: func() string {
+				d := s.create(time.Minute, time.Second)
+				s.complete(d.userCode, nil, "alice is denied")
+				return d.deviceCode
+			},
+			wantCode: ErrCodeAccessDenied,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, apiErr := s.poll(tt.session())
+			if apiErr == nil || apiErr.Code != tt.wantCode {
+				t.Errorf("poll() = %v, want %s", apiErr, tt.wantCode)
+			}
+		})
+	}
+}
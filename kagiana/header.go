@@ -0,0 +1,171 @@
+package kagiana
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	DefaultHeaderUser   = "X-Forwarded-User"
+	DefaultHeaderEmail  = "X-Forwarded-Email"
+	DefaultHeaderGroups = "X-Forwarded-Groups"
+	DefaultHeaderSecret = "X-Kagiana-Proxy-Secret"
+)
+
+// HeaderConfig trusts the user set by a reverse proxy, like oauth2-proxy,
+// when the request comes from TrustedProxies or carries Secret in
+// SecretHeader.
+type HeaderConfig struct {
+	UserHeader     string   `mapstructure:"user_header"`
+	EmailHeader    string   `mapstructure:"email_header"`
+	GroupsHeader   string   `mapstructure:"groups_header"`
+	TrustedProxies []string `mapstructure:"trusted_proxies" validate:"dive,cidr"`
+	SecretHeader   string   `mapstructure:"secret_header"`
+	Secret         string   `mapstructure:"secret"`
+}
+
+func headerName(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// AuthHeader logs in the user authenticated by a reverse proxy in front of
+// kagiana. Vault can't verify the user, so kagiana creates the token itself.
+type AuthHeader struct {
+	config         *Config
+	provider       ProviderConfig
+	trustedProxies []*net.IPNet
+	vault          *api.Client
+	getCert        func(http.ResponseWriter, *http.Request, *Vault)
+}
+
+func NewHeader(config *Config, p ProviderConfig, vault *api.Client) (*AuthHeader, error) {
+	if len(p.Header.TrustedProxies) == 0 && p.Header.Secret == "" {
+		return nil, fmt.Errorf("provider %s: header.trusted_proxies or header.secret is required", p.Name)
+	}
+	h := &AuthHeader{
+		config:   config,
+		provider: p,
+		vault:    vault,
+		getCert:  getCert,
+	}
+	for _, cidr := range p.Header.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %s", p.Name, err.Error())
+		}
+		h.trustedProxies = append(h.trustedProxies, n)
+	}
+	return h, nil
+}
+
+// trusted tells whether the request comes through the proxy. Only the peer
+// address is checked, as X-Forwarded-For is set by the client as well.
+func (h *AuthHeader) trusted(r *http.Request) bool {
+	c := h.provider.Header
+	if c.Secret != "" {
+		secret := r.Header.Get(headerName(c.SecretHeader, DefaultHeaderSecret))
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(c.Secret)) == 1 {
+			return true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range h.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *AuthHeader) identity(r *http.Request) Identity {
+	c := h.provider.Header
+	id := Identity{
+		User:  strings.TrimSpace(r.Header.Get(headerName(c.UserHeader, DefaultHeaderUser))),
+		Email: strings.TrimSpace(r.Header.Get(headerName(c.EmailHeader, DefaultHeaderEmail))),
+	}
+	for _, v := range r.Header.Values(headerName(c.GroupsHeader, DefaultHeaderGroups)) {
+		for _, g := range strings.Split(v, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				id.Groups = append(id.Groups, g)
+			}
+		}
+	}
+	return id
+}
+
+// Login goes on to the callback with the state cookie, as the proxy has
+// already authenticated the user. The state keeps other sites from starting
+// the callback in the browser of the user.
+func (h *AuthHeader) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := newLoginState(r)
+	if err != nil {
+		failLogin(w, r, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
+	if err := setLoginState(w, r, h.config, state); err != nil {
+		failLogin(w, r, NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error()))
+		return
+	}
+	http.Redirect(w, r, "/auth/"+h.provider.Name+"/callback?"+url.Values{"state": []string{state.Nonce}}.Encode(), http.StatusFound)
+}
+
+func (h *AuthHeader) Callback(w http.ResponseWriter, r *http.Request) {
+	SetRequestUser(r, "", "header")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+	if !h.trusted(r) {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "request is not from a trusted proxy")))
+		return
+	}
+	state, apiErr := takeLoginState(w, r, h.config, r.URL.Query().Get("state"))
+	if apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	id := h.identity(r)
+	if id.User == "" {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "the proxy sent no user")))
+		return
+	}
+	SetRequestUser(r, id.User, "header")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: id.User}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+	if apiErr := checkAllowedGroups(r.Context(), h.provider, id); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	vlt, err := exchangeVaultToken(r.Context(), h.vault, h.config, h.provider, id)
+	if err != nil {
+		failLogin(w, r, withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeUnauthorized, "%s", err.Error())))
+		return
+	}
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	h.getCert(w, withReturnTo(r, state.ReturnTo), vlt)
+}
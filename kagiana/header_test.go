@@ -0,0 +1,194 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func TestAuthHeader_Callback(t *testing.T) {
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		meta, _ := body["meta"].(map[string]interface{})
+		if r.URL.Path != "/v1/auth/token/create/kagiana-proxy" || r.Header.Get("X-Vault-Token") != "kagiana-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if meta["email"] != "alice@example.com" || meta["groups"] != "staff,sre" {
+			t.Errorf("meta = %v", meta)
+		}
+		json.NewEncoder(w).Encode(&api.Secret{Auth: &api.SecretAuth{ClientToken: "proxy-token", Metadata: map[string]string{"username": "alice"}}})
+	}))
+	defer tv.Close()
+
+	config := &Config{VaultAddr: tv.URL, ExternalURL: "https://kagiana.example.com"}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+	p := ProviderConfig{
+		Name:           "proxy",
+		Type:           "header",
+		VaultToken:     "kagiana-token",
+		VaultTokenRole: "kagiana-proxy",
+		AllowedGroups:  []string{"sre"},
+		Header: HeaderConfig{
+			GroupsHeader:   "X-Auth-Groups",
+			TrustedProxies: []string{"10.0.0.0/8"},
+			Secret:         "proxy-secret",
+		},
+	}
+	h, err := NewHeader(config.ForProvider(p), p, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		noCookie   bool
+		state      string
+		wantStatus int
+		wantIssued string
+	}{
+		{
+			name:       "trusted proxy",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Forwarded-User": "alice", "X-Forwarded-Email": "alice@example.com", "X-Auth-Groups": "staff, sre"},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name:       "shared secret",
+			remoteAddr: "192.0.2.1:4567",
+			header:     map[string]string{"X-Kagiana-Proxy-Secret": "proxy-secret", "X-Forwarded-User": "alice", "X-Forwarded-Email": "alice@example.com", "X-Auth-Groups": "staff,sre"},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name:       "untrusted",
+			remoteAddr: "192.0.2.1:4567",
+			header:     map[string]string{"X-Forwarded-For": "10.1.2.3", "X-Forwarded-User": "alice", "X-Auth-Groups": "sre"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong secret",
+			remoteAddr: "192.0.2.1:4567",
+			header:     map[string]string{"X-Kagiana-Proxy-Secret": "guess", "X-Forwarded-User": "alice", "X-Auth-Groups": "sre"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no user",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Auth-Groups": "sre"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "not in allowed groups",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Forwarded-User": "bob", "X-Auth-Groups": "staff"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "started by another site",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Forwarded-User": "alice", "X-Auth-Groups": "sre"},
+			noCookie:   true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "state mismatch",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Forwarded-User": "alice", "X-Auth-Groups": "sre"},
+			state:      "forged",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued := ""
+			h.getCert = func(w http.ResponseWriter, r *http.Request, vlt *Vault) {
+				issued = vlt.UserName()
+				w.WriteHeader(http.StatusOK)
+			}
+			login := httptest.NewRecorder()
+			h.Login(login, httptest.NewRequest(http.MethodGet, "/auth/proxy/login", nil))
+			location := login.Header().Get("Location")
+			if tt.state != "" {
+				location = "/auth/proxy/callback?state=" + tt.state
+			}
+
+			req := httptest.NewRequest(http.MethodGet, location, nil)
+			req.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			if !tt.noCookie {
+				req.AddCookie(login.Result().Cookies()[0])
+			}
+			w := httptest.NewRecorder()
+			h.Callback(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if issued != tt.wantIssued {
+				t.Errorf("issued = %q, want %q", issued, tt.wantIssued)
+			}
+		})
+	}
+}
+
+func TestAuthHeader_Login(t *testing.T) {
+	p := ProviderConfig{Name: "proxy", Type: "header", Header: HeaderConfig{Secret: "proxy-secret"}}
+	h, err := NewHeader(&Config{}, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		url          string
+		wantStatus   int
+		wantReturnTo string
+	}{
+		{name: "login", url: "/auth/proxy/login", wantStatus: http.StatusFound},
+		{name: "return to", url: "/auth/proxy/login?return_to=/device", wantStatus: http.StatusFound, wantReturnTo: "/device"},
+		{name: "open redirect", url: "/auth/proxy/login?return_to=//evil.example.com", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.Login(w, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusFound {
+				return
+			}
+
+			u, err := url.Parse(w.Header().Get("Location"))
+			if err != nil || u.Path != "/auth/proxy/callback" {
+				t.Fatalf("location = %s", w.Header().Get("Location"))
+			}
+			s, err := openOAuthState(h.config, w.Result().Cookies()[0].Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Nonce != u.Query().Get("state") || s.ReturnTo != tt.wantReturnTo {
+				t.Errorf("state = %+v, location = %s", s, u)
+			}
+		})
+	}
+
+	if _, err := NewHeader(&Config{}, ProviderConfig{Name: "proxy", Type: "header"}, nil); err == nil || !strings.Contains(err.Error(), "trusted_proxies or header.secret") {
+		t.Errorf("NewHeader() without trust error = %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package kagiana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	DefaultReadinessCacheTTL = 10 * time.Second
+	readinessCheckTimeout    = 5 * time.Second
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+)
+
+type DependencyStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ReadinessResponse is served publicly by /readyz, so it only tells the
+// status of each dependency.
+type ReadinessResponse struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies"`
+}
+
+// ReadinessDetails carries the errors of the checks, which may show internal
+// addresses, so it is only served to admins.
+type ReadinessDetails struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+type healthCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// Health serves /healthz and /readyz. The results of the dependency checks
+// are cached, so probes don't put load on Vault and STNS.
+type Health struct {
+	checks []healthCheck
+	ttl    time.Duration
+	client *http.Client
+
+	mu        sync.Mutex
+	result    *ReadinessDetails
+	checkedAt time.Time
+}
+
+func NewHealth(config *Config, vault *api.Client) *Health {
+	ttl := config.ReadinessCacheTTL
+	if ttl == 0 {
+		ttl = DefaultReadinessCacheTTL
+	}
+
+	h := &Health{
+		ttl:    ttl,
+		client: &http.Client{Timeout: readinessCheckTimeout},
+	}
+	h.checks = []healthCheck{
+		{name: "vault", check: func(ctx context.Context) error { return checkVault(ctx, vault) }},
+		{name: "oauth", check: func(ctx context.Context) error { return checkOAuth(config) }},
+	}
+	if config.STNSEndpoint != "" {
+		h.checks = append(h.checks, healthCheck{
+			name:  "stns",
+			check: func(ctx context.Context) error { return h.checkSTNS(ctx, config.STNSEndpoint) },
+		})
+	}
+	return h
+}
+
+func checkVault(ctx context.Context, vault *api.Client) error {
+	ret, err := vault.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ret.Initialized {
+		return errors.New("vault is not initialized")
+	}
+	if ret.Sealed {
+		return errors.New("vault is sealed")
+	}
+	return nil
+}
+
+func checkOAuth(config *Config) error {
+	for _, p := range config.ProviderConfigs() {
+		if !oauthProviderTypes[p.Type] {
+			continue
+		}
+		if err := checkOAuthConfig(config.ForProvider(p).OAuth); err != nil {
+			return fmt.Errorf("provider %s: %s", p.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+func checkOAuthConfig(oauth oauth2.Config) error {
+	if oauth.ClientID == "" {
+		return errors.New("client id is empty")
+	}
+	if oauth.ClientSecret == "" {
+		return errors.New("client secret is empty")
+	}
+	for name, u := range map[string]string{
+		"redirect url": oauth.RedirectURL,
+		"auth url":     oauth.Endpoint.AuthURL,
+		"token url":    oauth.Endpoint.TokenURL,
+	} {
+		p, err := url.Parse(u)
+		if err != nil || p.Scheme == "" || p.Host == "" {
+			return fmt.Errorf("%s %q is invalid", name, u)
+		}
+	}
+	return nil
+}
+
+// checkSTNS only checks that the endpoint answers, any response below 500
+// means STNS is reachable.
+func (h *Health) checkSTNS(ctx context.Context, endpoint string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("status code=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+// check runs the checks detached from the request context, because the
+// result is shared with the following probes.
+func (h *Health) check() *ReadinessDetails {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.result != nil && time.Since(h.checkedAt) < h.ttl {
+		return h.result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessCheckTimeout)
+	defer cancel()
+
+	type checkResult struct {
+		name   string
+		status DependencyStatus
+	}
+	results := make(chan checkResult, len(h.checks))
+	for _, c := range h.checks {
+		go func(c healthCheck) {
+			s := DependencyStatus{Status: HealthStatusOK, CheckedAt: time.Now()}
+			if err := c.check(ctx); err != nil {
+				s.Status = HealthStatusFail
+				s.Error = err.Error()
+			}
+			results <- checkResult{name: c.name, status: s}
+		}(c)
+	}
+
+	ret := &ReadinessDetails{
+		Status:       HealthStatusOK,
+		Dependencies: map[string]DependencyStatus{},
+	}
+	for range h.checks {
+		r := <-results
+		ret.Dependencies[r.name] = r.status
+		if r.status.Status != HealthStatusOK {
+			ret.Status = HealthStatusFail
+			logrus.Warnf("readiness check %s failed: %s", r.name, r.status.Error)
+		}
+	}
+
+	h.result = ret
+	h.checkedAt = time.Now()
+	return ret
+}
+
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	RenderJSON(w, http.StatusOK, map[string]string{"status": HealthStatusOK})
+}
+
+func readinessStatusCode(status string) int {
+	if status != HealthStatusOK {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	details := h.check()
+	ret := &ReadinessResponse{Status: details.Status, Dependencies: map[string]string{}}
+	for name, d := range details.Dependencies {
+		ret.Dependencies[name] = d.Status
+	}
+	RenderJSON(w, readinessStatusCode(ret.Status), ret)
+}
+
+// Details serves the results of the checks with their errors. It must be
+// served behind the admin authentication.
+func (h *Health) Details(w http.ResponseWriter, r *http.Request) {
+	ret := h.check()
+	RenderJSON(w, readinessStatusCode(ret.Status), ret)
+}
@@ -0,0 +1,117 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestHealth_Readyz(t *testing.T) {
+	tests := []struct {
+		name       string
+		sealed     bool
+		stnsStatus int
+		wantStatus int
+		wantFail   []string
+	}{
+		{
+			name:       "ready",
+			stnsStatus: http.StatusNotFound,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "vault sealed",
+			sealed:     true,
+			stnsStatus: http.StatusOK,
+			wantStatus: http.StatusServiceUnavailable,
+			wantFail:   []string{"vault"},
+		},
+		{
+			name:       "stns down",
+			stnsStatus: http.StatusBadGateway,
+			wantStatus: http.StatusServiceUnavailable,
+			wantFail:   []string{"stns"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vaultCalls := 0
+			tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				vaultCalls++
+				if r.URL.Path != "/v1/sys/health" {
+					t.Errorf("Unexpected vault request URL %q", r.URL)
+				}
+				json.NewEncoder(w).Encode(map[string]bool{"initialized": true, "sealed": tt.sealed})
+			}))
+			defer tv.Close()
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.stnsStatus)
+			}))
+			defer ts.Close()
+
+			config := &Config{
+				VaultAddr:    tv.URL,
+				STNSEndpoint: ts.URL,
+				OAuth: oauth2.Config{
+					ClientID:     "id",
+					ClientSecret: "secret",
+					RedirectURL:  "http://localhost:18080/callback",
+					Endpoint: oauth2.Endpoint{
+						AuthURL:  "https://github.com/login/oauth/authorize",
+						TokenURL: "https://github.com/login/oauth/access_token",
+					},
+				},
+			}
+			vault, err := NewVaultClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := NewHealth(config, vault)
+
+			for i := 0; i < 2; i++ {
+				resp := httptest.NewRecorder()
+				h.Readyz(resp, httptest.NewRequest("GET", "/readyz", nil))
+				if resp.Code != tt.wantStatus {
+					t.Errorf("Readyz() status = %d, want %d", resp.Code, tt.wantStatus)
+				}
+				if strings.Contains(resp.Body.String(), "error") || strings.Contains(resp.Body.String(), "127.0.0.1") {
+					t.Errorf("Readyz() shows the details publicly: %s", resp.Body.String())
+				}
+
+				ret := ReadinessResponse{}
+				if err := json.Unmarshal(resp.Body.Bytes(), &ret); err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range tt.wantFail {
+					if ret.Dependencies[name] != HealthStatusFail {
+						t.Errorf("Readyz() %s = %s, want fail", name, ret.Dependencies[name])
+					}
+				}
+			}
+
+			resp := httptest.NewRecorder()
+			h.Details(resp, httptest.NewRequest("GET", "/api/v1/admin/readyz", nil))
+			details := ReadinessDetails{}
+			if err := json.Unmarshal(resp.Body.Bytes(), &details); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Code != tt.wantStatus {
+				t.Errorf("Details() status = %d, want %d", resp.Code, tt.wantStatus)
+			}
+			for _, name := range tt.wantFail {
+				if d := details.Dependencies[name]; d.Status != HealthStatusFail || d.Error == "" {
+					t.Errorf("Details() %s = %+v, want fail with the error", name, d)
+				}
+			}
+
+			if vaultCalls != 1 {
+				t.Errorf("vault health is called %d times, want cached", vaultCalls)
+			}
+		})
+	}
+}
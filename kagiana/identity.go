@@ -0,0 +1,85 @@
+package kagiana
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Identity is a user verified by kagiana, for the providers whose identity
+// Vault can't verify itself.
+type Identity struct {
+	User   string
+	Email  string
+	Groups []string
+}
+
+func (id Identity) memberOf(groups []string) bool {
+	for _, g := range groups {
+		for _, ug := range id.Groups {
+			if strings.EqualFold(g, ug) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkAllowedGroups(ctx context.Context, p ProviderConfig, id Identity) *APIError {
+	if len(p.AllowedGroups) == 0 || id.memberOf(p.AllowedGroups) {
+		return nil
+	}
+	return auditLoginFailure(ctx, NewAPIError(http.StatusForbidden, ErrCodeForbidden, "%s is not a member of the allowed groups", id.User))
+}
+
+// exchangeVaultToken creates a token of the user with the token of kagiana.
+// The token role decides the policies and the ttl, so kagiana can't give a
+// user more than the role allows.
+func exchangeVaultToken(ctx context.Context, base *api.Client, config *Config, p ProviderConfig, id Identity) (*Vault, error) {
+	if p.VaultTokenRole == "" {
+		return nil, fmt.Errorf("vault_token_role of provider %s is not configured", p.Name)
+	}
+	client, err := serviceClient(base, p.VaultToken, p.VaultTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	path := "auth/token/create/" + p.VaultTokenRole
+	spanCtx, span := startSpan(ctx, "vault.token_create", attribute.String("vault.path", path))
+	start := time.Now()
+	req := map[string]interface{}{
+		"display_name": id.User,
+		"meta": map[string]string{
+			"username": id.User,
+			"email":    id.Email,
+			"groups":   strings.Join(id.Groups, ","),
+			"provider": p.Name,
+		},
+	}
+	if p.VaultTokenEntityAlias {
+		// the alias is on the token auth method, so it is named after the
+		// provider as well
+		req["entity_alias"] = p.Name + ":" + id.User
+	}
+	secret, err := client.Logical().WriteWithContext(spanCtx, path, req)
+	endSpan(span, err)
+	vaultLoginDuration.WithLabelValues("token").Observe(time.Since(start).Seconds())
+	if err == nil && (secret == nil || secret.Auth == nil) {
+		err = fmt.Errorf("empty response from token create")
+	}
+	if err != nil {
+		vaultLoginErrorsTotal.WithLabelValues("token").Inc()
+		Audit(ctx, AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeFailure, User: id.User, Error: err.Error()})
+		return nil, err
+	}
+	if secret.Auth.Metadata == nil {
+		secret.Auth.Metadata = map[string]string{}
+	}
+	secret.Auth.Metadata["username"] = id.User
+	return newVaultSession(ctx, client, config, secret.Auth), nil
+}
@@ -0,0 +1,267 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// inventoryRetention is how long a record is kept after the cert expired.
+	inventoryRetention = 30 * 24 * time.Hour
+	// inventoryFlushInterval is how often the changes are written to the
+	// file, off the login path.
+	inventoryFlushInterval = 5 * time.Second
+)
+
+type InventoryCert struct {
+	SerialNumber  string    `json:"serial_number"`
+	Profile       string    `json:"profile"`
+	User          string    `json:"user"`
+	TokenAccessor string    `json:"token_accessor,omitempty"`
+	IssuedAt      time.Time `json:"issued_at"`
+	NotAfter      time.Time `json:"not_after"`
+	Revoked       bool      `json:"revoked"`
+	RevokedAt     time.Time `json:"revoked_at,omitempty"`
+	// SessionStart is when the user logged in for the first cert of a
+	// chain of renewals.
+	SessionStart time.Time `json:"session_start,omitempty"`
+	RenewedFrom  string    `json:"renewed_from,omitempty"`
+}
+
+func (c InventoryCert) sessionStart() time.Time {
+	if c.SessionStart.IsZero() {
+		return c.IssuedAt
+	}
+	return c.SessionStart
+}
+
+type InventoryFilter struct {
+	User           string
+	Profile        string
+	ExpiresBefore  time.Time
+	IncludeRevoked bool
+}
+
+func (f InventoryFilter) match(c *InventoryCert) bool {
+	if f.User != "" && c.User != f.User {
+		return false
+	}
+	if f.Profile != "" && c.Profile != f.Profile {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !c.NotAfter.Before(f.ExpiresBefore) {
+		return false
+	}
+	return f.IncludeRevoked || !c.Revoked
+}
+
+// Inventory keeps track of the issued certs, fed by the audit events. It is
+// kept in memory when path is empty, and written to path in the background
+// otherwise. Close writes the last changes.
+type Inventory struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+
+	mu    sync.Mutex
+	certs map[string]*InventoryCert
+	dirty bool
+}
+
+func OpenInventory(path string) (*Inventory, error) {
+	inv := &Inventory{
+		path:  path,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		certs: map[string]*InventoryCert{},
+	}
+	if path != "" {
+		certs := []*InventoryCert{}
+		if err := readJSONFile(path, &certs); err != nil {
+			return nil, err
+		}
+		for _, c := range certs {
+			inv.certs[c.SerialNumber] = c
+		}
+	}
+	go inv.run(inventoryFlushInterval)
+	return inv, nil
+}
+
+func (inv *Inventory) run(interval time.Duration) {
+	defer close(inv.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			inv.flush()
+		case <-inv.stop:
+			inv.flush()
+			return
+		}
+	}
+}
+
+// Close stops the background writes and writes the last changes.
+func (inv *Inventory) Close() {
+	select {
+	case <-inv.stop:
+	default:
+		close(inv.stop)
+	}
+	<-inv.done
+}
+
+// Notify records the issued and revoked certs.
+func (inv *Inventory) Notify(e AuditEvent) {
+	if e.Outcome == AuditOutcomeFailure {
+		return
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	switch e.Type {
+	case AuditTypeIssue:
+		sessionStart := e.Time
+		from := e.Details["renewed_from"]
+		if prev, ok := inv.certs[from]; ok {
+			sessionStart = prev.sessionStart()
+		}
+		for _, c := range e.Certs {
+			inv.certs[c.SerialNumber] = &InventoryCert{
+				SerialNumber:  c.SerialNumber,
+				Profile:       c.Name,
+				User:          e.User,
+				TokenAccessor: e.TokenAccessor,
+				IssuedAt:      e.Time,
+				NotAfter:      c.NotAfter,
+				SessionStart:  sessionStart,
+				RenewedFrom:   from,
+			}
+		}
+	case AuditTypeRevoke:
+		for _, c := range e.Certs {
+			if ic, ok := inv.certs[c.SerialNumber]; ok {
+				ic.Revoked = true
+				ic.RevokedAt = e.Time
+			}
+		}
+	default:
+		return
+	}
+	inv.dirty = true
+}
+
+func (inv *Inventory) List(f InventoryFilter) []InventoryCert {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	ret := []InventoryCert{}
+	for _, c := range inv.certs {
+		if f.match(c) {
+			ret = append(ret, *c)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].NotAfter.Equal(ret[j].NotAfter) {
+			return ret[i].SerialNumber < ret[j].SerialNumber
+		}
+		return ret[i].NotAfter.Before(ret[j].NotAfter)
+	})
+	return ret
+}
+
+func (inv *Inventory) Get(serial string) (InventoryCert, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	c, ok := inv.certs[serial]
+	if !ok {
+		return InventoryCert{}, false
+	}
+	return *c, true
+}
+
+// prune drops the records which expired long ago, so the inventory doesn't
+// grow forever. It must be called with mu held.
+func (inv *Inventory) prune(now time.Time) {
+	for serial, c := range inv.certs {
+		if !c.NotAfter.IsZero() && now.Sub(c.NotAfter) > inventoryRetention {
+			delete(inv.certs, serial)
+			inv.dirty = true
+		}
+	}
+}
+
+// flush prunes the inventory, and writes it to the file when it changed. The
+// file is written without mu held, so logins don't wait for the disk.
+func (inv *Inventory) flush() {
+	inv.mu.Lock()
+	inv.prune(time.Now())
+	if inv.path == "" || !inv.dirty {
+		inv.dirty = false
+		inv.mu.Unlock()
+		return
+	}
+	certs := make([]InventoryCert, 0, len(inv.certs))
+	for _, c := range inv.certs {
+		certs = append(certs, *c)
+	}
+	inv.dirty = false
+	inv.mu.Unlock()
+
+	if err := writeJSONFile(inv.path, certs); err != nil {
+		logrus.Errorf("save inventory: %s", err.Error())
+		inv.mu.Lock()
+		inv.dirty = true
+		inv.mu.Unlock()
+	}
+}
+
+func readJSONFile(path string, v interface{}) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile replaces the file atomically, so a crash never leaves a
+// truncated file behind.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
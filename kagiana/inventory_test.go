@@ -0,0 +1,72 @@
+package kagiana
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInventory_Flush(t *testing.T) {
+	now := time.Now().UTC()
+	issue := func(inv *Inventory, serial string, notAfter time.Time) {
+		inv.Notify(AuditEvent{
+			Type:    AuditTypeIssue,
+			Outcome: AuditOutcomeSuccess,
+			User:    "alice",
+			Time:    now,
+			Certs:   []AuditCert{{Name: "prod.example.com", SerialNumber: serial, NotAfter: notAfter}},
+		})
+	}
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "memory"},
+		{name: "file", path: "inventory.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.path != "" {
+				path = filepath.Join(t.TempDir(), tt.path)
+			}
+			inv, err := OpenInventory(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inv.Close()
+
+			issue(inv, "01", now.Add(time.Hour))
+			issue(inv, "02", now.Add(-inventoryRetention-time.Hour))
+			if path != "" {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("inventory is written on the login path: %v", err)
+				}
+			}
+
+			inv.flush()
+			if _, ok := inv.Get("02"); ok {
+				t.Error("expired record is not pruned")
+			}
+			if _, ok := inv.Get("01"); !ok {
+				t.Error("valid record is pruned")
+			}
+			if path == "" {
+				return
+			}
+
+			issue(inv, "03", now.Add(time.Hour))
+			inv.Close()
+			reopened, err := OpenInventory(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if len(reopened.List(InventoryFilter{})) != 2 {
+				t.Errorf("persisted = %+v, want 01 and 03", reopened.List(InventoryFilter{}))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package kagiana
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type contextKey int
+
+const (
+	requestInfoKey contextKey = iota
+	auditContextKey
+	denylistKey
+	handoffKey
+	returnToKey
+)
+
+// requestInfo is shared by the middlewares and the handlers of a request,
+// so handlers can tell the access log who the user was.
+type requestInfo struct {
+	id string
+
+	mu         sync.Mutex
+	user       string
+	authMethod string
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+	return nil
+}
+
+// WithRequestID assigns a request id to every request, taking over the
+// X-Request-Id header of the client when it is present.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{id: RequestID(r)}
+		w.Header().Set(RequestIDHeader, info.id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)))
+	})
+}
+
+// SetRequestUser records the authenticated user for the access log.
+func SetRequestUser(r *http.Request, user, authMethod string) {
+	info := requestInfoFrom(r.Context())
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	info.user = user
+	info.authMethod = authMethod
+}
+
+// Logger returns the logger carrying the request id of ctx.
+func Logger(ctx context.Context) *logrus.Entry {
+	if info := requestInfoFrom(ctx); info != nil {
+		return logrus.WithField("request_id", info.id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
+
+// WithAccessLog writes one log line per request.
+func WithAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		fields := logrus.Fields{
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.Status(),
+			"duration":    time.Since(start).Seconds(),
+			"remote_addr": r.RemoteAddr,
+			"user_agent":  r.UserAgent(),
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.mu.Lock()
+			fields["user"] = info.user
+			fields["auth_method"] = info.authMethod
+			info.mu.Unlock()
+		}
+		Logger(r.Context()).WithFields(fields).Info("access")
+	})
+}
+
+// LogFile is a log output which can be reopened after it was rotated.
+type LogFile struct {
+	path string
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	return nil
+}
+
+func (l *LogFile) Write(b []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Write(b)
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,106 @@
+package kagiana
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		wantID    string
+	}{
+		{
+			name:      "client id",
+			requestID: "client-id-1",
+			wantID:    "client-id-1",
+		},
+		{
+			name:      "invalid client id",
+			requestID: "bad id\n",
+		},
+		{
+			name: "generated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			defer hook.Reset()
+
+			var handlerID string
+			h := WithRequestID(WithAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerID = RequestID(r)
+				SetRequestUser(r, "alice", "stns")
+				w.WriteHeader(http.StatusTeapot)
+			})))
+
+			req := httptest.NewRequest("GET", "/test", nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			resp := httptest.NewRecorder()
+			h.ServeHTTP(resp, req)
+
+			got := resp.Header().Get(RequestIDHeader)
+			if got == "" || got != handlerID {
+				t.Errorf("response id = %q, handler id = %q", got, handlerID)
+			}
+			if tt.wantID != "" && got != tt.wantID {
+				t.Errorf("response id = %q, want %q", got, tt.wantID)
+			}
+
+			entry := hook.LastEntry()
+			if entry == nil {
+				t.Fatal("access log is not written")
+			}
+			if entry.Data["request_id"] != got || entry.Data["user"] != "alice" || entry.Data["auth_method"] != "stns" || entry.Data["status"] != http.StatusTeapot {
+				t.Errorf("access log fields = %v", entry.Data)
+			}
+		})
+	}
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kagiana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "kagiana.log")
+	l, err := OpenLogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(l)
+	logger.Info("before rotate")
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("after rotate")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "before rotate") || !strings.Contains(string(b), "after rotate") {
+		t.Errorf("log file = %q", b)
+	}
+}
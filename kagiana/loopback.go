@@ -0,0 +1,266 @@
+package kagiana
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+)
+
+const (
+	LoopbackCookieKey   = "kagiana_loopback"
+	CodeChallengeS256   = "S256"
+	loopbackLoginTTL    = 10 * time.Minute
+	loopbackCodeTTL     = time.Minute
+	loopbackRandomBytes = 32
+)
+
+type loopbackLogin struct {
+	redirectURI string
+	challenge   string
+	state       string
+	expiresAt   time.Time
+}
+
+type loopbackCode struct {
+	response  *APIResponse
+	challenge string
+	expiresAt time.Time
+}
+
+// LoopbackStore holds the pending `kagiana login` sessions and the codes
+// handed to their loopback listeners. It outlives config reloads.
+type LoopbackStore struct {
+	mu     sync.Mutex
+	logins map[string]*loopbackLogin
+	codes  map[string]*loopbackCode
+}
+
+func NewLoopbackStore() *LoopbackStore {
+	return &LoopbackStore{logins: map[string]*loopbackLogin{}, codes: map[string]*loopbackCode{}}
+}
+
+func randomString() string {
+	b := make([]byte, loopbackRandomBytes)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sweep must be called with mu held.
+func (s *LoopbackStore) sweep(now time.Time) {
+	for id, l := range s.logins {
+		if now.After(l.expiresAt) {
+			delete(s.logins, id)
+		}
+	}
+	for code, c := range s.codes {
+		if now.After(c.expiresAt) {
+			delete(s.codes, code)
+		}
+	}
+}
+
+func (s *LoopbackStore) start(l *loopbackLogin) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now)
+
+	id := randomString()
+	l.expiresAt = now.Add(loopbackLoginTTL)
+	s.logins[id] = l
+	return id
+}
+
+// take returns the login once, so a callback can't be replayed.
+func (s *LoopbackStore) take(id string) (*loopbackLogin, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.logins[id]
+	if !ok || time.Now().After(l.expiresAt) {
+		return nil, false
+	}
+	delete(s.logins, id)
+	return l, true
+}
+
+func (s *LoopbackStore) issue(resp *APIResponse, challenge string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := randomString()
+	s.codes[code] = &loopbackCode{response: resp, challenge: challenge, expiresAt: time.Now().Add(loopbackCodeTTL)}
+	return code
+}
+
+// redeem returns the response once, to the client holding the verifier.
+func (s *LoopbackStore) redeem(code, verifier string) (*APIResponse, *APIError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.codes[code]
+	if !ok || time.Now().After(c.expiresAt) {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "unknown or expired code")
+	}
+	// a wrong verifier burns the code too, it was intercepted
+	delete(s.codes, code)
+	if subtle.ConstantTimeCompare([]byte(codeChallenge(verifier)), []byte(c.challenge)) != 1 {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code_verifier doesn't match")
+	}
+	return c.response, nil
+}
+
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// validateLoopbackURI accepts only http on a loopback ip, as RFC 8252
+// recommends, so the certs can't be redirected off the user's machine.
+func validateLoopbackURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" || u.Port() == "" || u.User != nil || u.Fragment != "" {
+		return fmt.Errorf("redirect_uri must be http://127.0.0.1:<port>/")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("redirect_uri must be a loopback address")
+	}
+	return nil
+}
+
+// LoopbackFlow hands the certs of a browser login to `kagiana login`,
+// through a one-time code sent to its loopback listener and exchanged with
+// the PKCE verifier.
+type LoopbackFlow struct {
+	config *Config
+	store  *LoopbackStore
+}
+
+func NewLoopbackFlow(config *Config, store *LoopbackStore) *LoopbackFlow {
+	return &LoopbackFlow{config: config, store: store}
+}
+
+// WithLogin remembers the return address of a login started by the client.
+func (lf *LoopbackFlow) WithLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		redirectURI := q.Get("redirect_uri")
+		if redirectURI == "" {
+			next(w, r)
+			return
+		}
+
+		if err := validateLoopbackURI(redirectURI); err != nil {
+			renderRequestError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		challenge := q.Get("code_challenge")
+		if q.Get("code_challenge_method") != CodeChallengeS256 || len(challenge) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+			renderRequestError(w, r, http.StatusBadRequest, fmt.Errorf("code_challenge with the method S256 is required"))
+			return
+		}
+
+		id := lf.store.start(&loopbackLogin{redirectURI: redirectURI, challenge: challenge, state: q.Get("state")})
+		http.SetCookie(w, &http.Cookie{
+			Name:     LoopbackCookieKey,
+			Value:    id,
+			Path:     "/",
+			MaxAge:   int(loopbackLoginTTL.Seconds()),
+			Secure:   secureCookie(lf.config, r),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		next(w, r)
+	}
+}
+
+// WithSession routes the callback of a client login to its loopback
+// listener, instead of rendering the certs in the browser.
+func (lf *LoopbackFlow) WithSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := r.Cookie(LoopbackCookieKey)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: LoopbackCookieKey, Path: "/", MaxAge: -1})
+		l, ok := lf.store.take(c.Value)
+		if !ok {
+			next(w, r)
+			return
+		}
+		next(w, withHandoff(r, &loopbackApproval{store: lf.store, login: l}))
+	}
+}
+
+func (lf *LoopbackFlow) Token(w http.ResponseWriter, r *http.Request) {
+	requestID := RequestID(r)
+	if err := r.ParseForm(); err != nil {
+		RenderAPIError(w, requestID, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
+
+	resp, apiErr := lf.store.redeem(r.FormValue("code"), r.FormValue("code_verifier"))
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		RenderAPIError(w, requestID, apiErr)
+		return
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, http.StatusOK, resp)
+}
+
+type loopbackApproval struct {
+	store *LoopbackStore
+	login *loopbackLogin
+}
+
+// confirm needs nothing from the user, who started the login on the client.
+func (l *loopbackApproval) confirm(w http.ResponseWriter, r *http.Request, vlt *Vault) bool {
+	return true
+}
+
+// approve sends the browser back to the client with a one-time code.
+func (l *loopbackApproval) approve(w http.ResponseWriter, r *http.Request, vlt *Vault, cbs map[string]*certutil.CertBundle, failures map[string]string) {
+	resp, err := NewAPIResponse(RequestID(r), vlt, cbs, failures)
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	u, err := url.Parse(l.login.redirectURI)
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	q := u.Query()
+	q.Set("code", l.store.issue(resp, l.login.challenge))
+	q.Set("state", l.login.state)
+	u.RawQuery = q.Encode()
+	Logger(r.Context()).Infof("%s logged in with the client", vlt.UserName())
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// deny sends the browser back to the client with the error, as the error
+// response of RFC 6749, so the client stops waiting.
+func (l *loopbackApproval) deny(w http.ResponseWriter, r *http.Request, reason string) bool {
+	u, err := url.Parse(l.login.redirectURI)
+	if err != nil {
+		return false
+	}
+	q := u.Query()
+	q.Set("error", ErrCodeAccessDenied)
+	q.Set("error_description", reason)
+	q.Set("state", l.login.state)
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+	return true
+}
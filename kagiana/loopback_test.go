@@ -0,0 +1,180 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func postLoginToken(h http.Handler, code, verifier string) *httptest.ResponseRecorder {
+	values := url.Values{"code": []string{code}, "code_verifier": []string{verifier}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/login/token", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoopbackFlow(t *testing.T) {
+	base, err := NewVaultClient(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.SetToken("loopback-token")
+	vlt := &Vault{client: base, config: &Config{}, auth: &api.SecretAuth{Metadata: map[string]string{"username": "alice"}}}
+
+	provider := &fakeProvider{callback: func(w http.ResponseWriter, r *http.Request) {
+		if h := handoffFrom(r.Context()); h != nil {
+			h.approve(w, r, vlt, nil, nil)
+			return
+		}
+		w.Write([]byte("browser login"))
+	}}
+	lf := NewLoopbackFlow(&Config{}, NewLoopbackStore())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", lf.WithLogin(provider.Login))
+	mux.HandleFunc("POST /api/v1/login/token", lf.Token)
+	mux.HandleFunc("/callback", lf.WithSession(provider.Callback))
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	login := url.Values{
+		"redirect_uri":          []string{"http://127.0.0.1:8400/callback"},
+		"code_challenge":        []string{codeChallenge(verifier)},
+		"code_challenge_method": []string{CodeChallengeS256},
+		"state":                 []string{"xyz"},
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+login.Encode(), nil))
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("login status = %d, want redirect to the provider", w.Code)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Name != LoopbackCookieKey || !cookie.HttpOnly {
+		t.Errorf("cookie = %+v", cookie)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "loopback-token") {
+		t.Errorf("callback = %s, must not contain the token", w.Body.String())
+	}
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || redirect.Host != "127.0.0.1:8400" || redirect.Query().Get("state") != "xyz" {
+		t.Fatalf("callback redirect = %s", w.Header().Get("Location"))
+	}
+	code := redirect.Query().Get("code")
+
+	// the login is used once
+	req = httptest.NewRequest(http.MethodGet, "/callback", nil)
+	req.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Body.String() != "browser login" {
+		t.Errorf("replayed callback = %s, want browser login", w.Body.String())
+	}
+
+	if w := postLoginToken(mux, code, "wrong"+verifier); w.Code != http.StatusBadRequest {
+		t.Errorf("wrong verifier status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := postLoginToken(mux, code, verifier); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want the code to be burned by the wrong verifier", w.Code)
+	}
+}
+
+func TestLoopbackFlow_Denied(t *testing.T) {
+	provider := &fakeProvider{callback: func(w http.ResponseWriter, r *http.Request) {
+		failLogin(w, r, NewAPIError(http.StatusForbidden, ErrCodeForbidden, "alice is not a member of the allowed groups"))
+	}}
+	lf := NewLoopbackFlow(&Config{}, NewLoopbackStore())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", lf.WithLogin(provider.Login))
+	mux.HandleFunc("/callback", lf.WithSession(provider.Callback))
+
+	login := url.Values{
+		"redirect_uri":          []string{"http://127.0.0.1:8400/callback"},
+		"code_challenge":        []string{codeChallenge("verifier")},
+		"code_challenge_method": []string{CodeChallengeS256},
+		"state":                 []string{"xyz"},
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+login.Encode(), nil))
+	req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || redirect.Host != "127.0.0.1:8400" {
+		t.Fatalf("callback status = %d, redirect = %s", w.Code, w.Header().Get("Location"))
+	}
+	q := redirect.Query()
+	if q.Get("error") != ErrCodeAccessDenied || q.Get("state") != "xyz" || q.Get("code") != "" ||
+		q.Get("error_description") != "alice is not a member of the allowed groups" {
+		t.Errorf("callback redirect = %s", redirect)
+	}
+}
+
+func TestLoopbackFlow_Token(t *testing.T) {
+	s := NewLoopbackStore()
+	lf := NewLoopbackFlow(&Config{}, s)
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	code := s.issue(&APIResponse{Token: APIToken{Token: "loopback-token"}}, codeChallenge(verifier))
+
+	w := postLoginToken(http.HandlerFunc(lf.Token), code, verifier)
+	ret := APIResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&ret); err != nil {
+		t.Fatal(err)
+	}
+	if ret.Token.Token != "loopback-token" {
+		t.Errorf("token = %s, want loopback-token", ret.Token.Token)
+	}
+	if w := postLoginToken(http.HandlerFunc(lf.Token), code, verifier); w.Code != http.StatusBadRequest {
+		t.Errorf("second exchange status = %d, want the code to be used once", w.Code)
+	}
+}
+
+func TestLoopbackFlow_WithLogin(t *testing.T) {
+	lf := NewLoopbackFlow(&Config{}, NewLoopbackStore())
+	h := lf.WithLogin(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTemporaryRedirect) })
+	challenge := codeChallenge("verifier")
+	tests := []struct {
+		name        string
+		redirectURI string
+		challenge   string
+		method      string
+		wantStatus  int
+	}{
+		{name: "browser", wantStatus: http.StatusTemporaryRedirect},
+		{name: "ipv4", redirectURI: "http://127.0.0.1:8400/callback", challenge: challenge, method: "S256", wantStatus: http.StatusTemporaryRedirect},
+		{name: "ipv6", redirectURI: "http://[::1]:8400/callback", challenge: challenge, method: "S256", wantStatus: http.StatusTemporaryRedirect},
+		{name: "remote host", redirectURI: "http://evil.example.com:8400/callback", challenge: challenge, method: "S256", wantStatus: http.StatusBadRequest},
+		{name: "https", redirectURI: "https://127.0.0.1:8400/callback", challenge: challenge, method: "S256", wantStatus: http.StatusBadRequest},
+		{name: "no port", redirectURI: "http://127.0.0.1/callback", challenge: challenge, method: "S256", wantStatus: http.StatusBadRequest},
+		{name: "plain", redirectURI: "http://127.0.0.1:8400/callback", challenge: challenge, method: "plain", wantStatus: http.StatusBadRequest},
+		{name: "no challenge", redirectURI: "http://127.0.0.1:8400/callback", method: "S256", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := url.Values{}
+			if tt.redirectURI != "" {
+				q = url.Values{
+					"redirect_uri":          []string{tt.redirectURI},
+					"code_challenge":        []string{tt.challenge},
+					"code_challenge_method": []string{tt.method},
+				}
+			}
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
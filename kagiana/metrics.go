@@ -0,0 +1,196 @@
+package kagiana
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "kagiana"
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "Number of http requests by route and status code.",
+	}, []string{"route", "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of http requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+
+	oauthExchangeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oauth_exchange_failures_total",
+		Help:      "Number of failed oauth code exchanges by provider.",
+	}, []string{"provider"})
+
+	stnsVerifyTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stns_verify_total",
+		Help:      "Number of stns signature verifications by result.",
+	}, []string{"result"})
+
+	vaultLoginDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_login_duration_seconds",
+		Help:      "Latency of vault logins by auth path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"auth_path"})
+
+	vaultLoginErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_login_errors_total",
+		Help:      "Number of failed vault logins by auth path.",
+	}, []string{"auth_path"})
+
+	vaultIssueDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_issue_duration_seconds",
+		Help:      "Latency of certificate issuance by pki path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path"})
+
+	vaultIssueErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "vault_issue_errors_total",
+		Help:      "Number of failed certificate issuance by pki path.",
+	}, []string{"path"})
+
+	configReloadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of config reloads by result.",
+	}, []string{"result"})
+
+	configLastReloadSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config reload succeeded.",
+	})
+
+	loginLockoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "login_lockouts_total",
+		Help:      "Number of users locked out of a password provider by provider.",
+	}, []string{"provider"})
+
+	certificatesIssuedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "certificates_issued_total",
+		Help:      "Number of issued certificates by profile.",
+	}, []string{"profile"})
+
+	auditWriteErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_write_errors_total",
+		Help:      "Number of audit events which couldn't be written by sink.",
+	}, []string{"sink"})
+
+	auditEventsDroppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_events_dropped_total",
+		Help:      "Number of audit events dropped by sink as its queue was full.",
+	}, []string{"sink"})
+
+	tlsRotationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tls_cert_rotations_total",
+		Help:      "Number of serving cert loads by source and result.",
+	}, []string{"source", "result"})
+
+	tlsCertExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tls_cert_expiry_timestamp_seconds",
+		Help:      "Expiry of the serving cert in unix time.",
+	})
+)
+
+const (
+	stnsVerifySuccess  = "success"
+	stnsVerifyFailure  = "failure"
+	stnsVerifyMismatch = "mismatch"
+)
+
+// RegisterSTNSCacheMetrics exposes the statistics of the stns user key cache.
+// stats is called on every scrape, so it can follow the current STNS after a
+// config reload.
+func RegisterSTNSCacheMetrics(stats func() CacheStats) error {
+	for name, f := range map[string]func(CacheStats) uint64{
+		"hits":          func(c CacheStats) uint64 { return c.Hits },
+		"negative_hits": func(c CacheStats) uint64 { return c.NegativeHits },
+		"misses":        func(c CacheStats) uint64 { return c.Misses },
+		"evictions":     func(c CacheStats) uint64 { return c.Evictions },
+	} {
+		f := f
+		err := prometheus.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stns_cache_" + name + "_total",
+			Help:      "Number of " + name + " of the stns user key cache.",
+		}, func() float64 {
+			return float64(f(stats()))
+		}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ObserveConfigReload(err error) {
+	if err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		configLastReloadSuccess.Set(0)
+		return
+	}
+	configReloadsTotal.WithLabelValues("success").Inc()
+	configLastReloadSuccess.Set(1)
+}
+
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// InstrumentHandler records the request count and latency of the route.
+func InstrumentHandler(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequestsTotal.WithLabelValues(route, strconv.Itoa(rec.Status())).Inc()
+	}
+}
@@ -0,0 +1,43 @@
+package kagiana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		route    string
+		status   int
+		wantCode string
+	}{
+		{
+			name:     "ok",
+			route:    "/test/ok",
+			status:   http.StatusOK,
+			wantCode: "200",
+		},
+		{
+			name:     "unauthorized",
+			route:    "/test/unauthorized",
+			status:   http.StatusUnauthorized,
+			wantCode: "401",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := InstrumentHandler(tt.route, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+			h(httptest.NewRecorder(), httptest.NewRequest("GET", tt.route, nil))
+
+			if got := testutil.ToFloat64(httpRequestsTotal.WithLabelValues(tt.route, tt.wantCode)); got != 1 {
+				t.Errorf("http_requests_total = %v, want 1", got)
+			}
+		})
+	}
+}
@@ -2,77 +2,82 @@ package kagiana
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"net/http"
-	"time"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
 )
 
-func NewGitHub(config *Config) *AuthGitHub {
+func NewGitHub(config *Config, vault *api.Client) *AuthGitHub {
 	return &AuthGitHub{
 		config:  config,
+		vault:   vault,
 		getCert: getCert,
 	}
 }
 
 type AuthGitHub struct {
 	config  *Config
+	vault   *api.Client
 	getCert func(http.ResponseWriter, *http.Request, *Vault)
 }
 
 func (g *AuthGitHub) Login(w http.ResponseWriter, r *http.Request) {
-	oAuthState := g.generateStateOAuthCookie(w)
-	u := g.config.OAuth.AuthCodeURL(oAuthState)
+	u, err := startOAuthLogin(w, r, g.config, &g.config.OAuth)
+	if err != nil {
+		failLogin(w, r, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
 	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 }
 
 func (g *AuthGitHub) Callback(w http.ResponseWriter, r *http.Request) {
-	oAuthState, err := r.Cookie(CookieKey)
-	if err != nil {
-		RenderError(w, http.StatusInternalServerError, err)
+	SetRequestUser(r, "", "github")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{}); apiErr != nil {
+		failLogin(w, r, apiErr)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		RenderError(w, http.StatusUnauthorized, err)
+	state, apiErr := finishOAuthLogin(w, r, g.config)
+	if apiErr != nil {
+		failLogin(w, r, apiErr)
 		return
 	}
 
-	if r.FormValue("state") != oAuthState.Value {
-		RenderError(w, http.StatusUnauthorized, err)
+	token, err := g.getAccessToken(r.Context(), r.FormValue("code"), state.Verifier)
+	if err != nil {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err.Error())))
 		return
 	}
 
-	token, err := g.getAccessToken(r.FormValue("code"))
-	if err != nil {
-		RenderError(w, http.StatusUnauthorized, err)
+	if apiErr := checkGitHubToken(r.Context(), g.config, "", token); apiErr != nil {
+		failLogin(w, r, apiErr)
 		return
 	}
 
-	vlt, err := NewVault(g.config, map[string]string{"github_token": token})
+	vlt, err := NewVault(r.Context(), g.vault, g.config, map[string]string{"github_token": token})
 	if err != nil {
-		RenderError(w, http.StatusUnauthorized, err)
+		failLogin(w, r, withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err.Error())))
+		return
+	}
+	SetRequestUser(r, vlt.UserName(), "github")
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		failLogin(w, r, apiErr)
 		return
 	}
 
-	g.getCert(w, r, vlt)
-}
-
-func (g *AuthGitHub) generateStateOAuthCookie(w http.ResponseWriter) string {
-	var expiration = time.Now().Add(3 * time.Minute)
-	b := make([]byte, 16)
-	rand.Read(b)
-	state := base64.URLEncoding.EncodeToString(b)
-	cookie := http.Cookie{Name: CookieKey, Value: state, Expires: expiration}
-	http.SetCookie(w, &cookie)
-
-	return state
+	g.getCert(w, withReturnTo(r, state.ReturnTo), vlt)
 }
 
-func (g *AuthGitHub) getAccessToken(code string) (string, error) {
-	token, err := g.config.OAuth.Exchange(context.Background(), code)
+func (g *AuthGitHub) getAccessToken(ctx context.Context, code, verifier string) (string, error) {
+	ctx, span := startSpan(ctx, "oauth.exchange", attribute.String("oauth.provider", "github"))
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, tracedHTTPClient)
+	token, err := g.config.OAuth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	endSpan(span, err)
 	if err != nil {
+		oauthExchangeFailuresTotal.WithLabelValues("github").Inc()
 		return "", fmt.Errorf("code exchange wrong: %s", err.Error())
 	}
 	return token.AccessToken, nil
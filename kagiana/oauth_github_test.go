@@ -2,7 +2,6 @@ package kagiana
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +9,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"golang.org/x/oauth2"
@@ -19,6 +19,22 @@ func TestAuthGitHub_Callback(t *testing.T) {
 	type fields struct {
 		config *Config
 	}
+	config := &Config{
+		OAuthProvider: "github",
+		OAuth: oauth2.Config{
+			RedirectURL:  "REDIRECT_URL",
+			ClientID:     "id",
+			ClientSecret: "secret",
+		},
+	}
+	sealed := func(s *oauthState) string {
+		v, err := sealOAuthState(config, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	valid := sealed(&oauthState{Nonce: "test state", Verifier: "test verifier", ExpiresAt: time.Now().Add(time.Minute).Unix()})
 	tests := []struct {
 		name       string
 		fields     fields
@@ -26,24 +42,55 @@ func TestAuthGitHub_Callback(t *testing.T) {
 		cookie     string
 		state      string
 		code       string
+		error      string
 	}{
 		{
-			name: "callback ok",
-			fields: fields{
-				config: &Config{
-					OAuthProvider: "github",
-					OAuth: oauth2.Config{
-						RedirectURL:  "REDIRECT_URL",
-						ClientID:     "id",
-						ClientSecret: "secret",
-					},
-				},
-			},
+			name:       "callback ok",
+			fields:     fields{config: config},
 			wantStatus: http.StatusOK,
+			cookie:     valid,
+			state:      "test state",
+			code:       "test code",
+		},
+		{
+			name:       "state mismatch",
+			fields:     fields{config: config},
+			wantStatus: http.StatusUnauthorized,
+			cookie:     valid,
+			state:      "other state",
+			code:       "test code",
+		},
+		{
+			name:       "no cookie",
+			fields:     fields{config: config},
+			wantStatus: http.StatusBadRequest,
+			state:      "test state",
+			code:       "test code",
+		},
+		{
+			name:       "forged cookie",
+			fields:     fields{config: config},
+			wantStatus: http.StatusBadRequest,
 			cookie:     "test state",
 			state:      "test state",
 			code:       "test code",
 		},
+		{
+			name:       "expired",
+			fields:     fields{config: config},
+			wantStatus: http.StatusBadRequest,
+			cookie:     sealed(&oauthState{Nonce: "test state", ExpiresAt: time.Now().Add(-time.Minute).Unix()}),
+			state:      "test state",
+			code:       "test code",
+		},
+		{
+			name:       "denied by the provider",
+			fields:     fields{config: config},
+			wantStatus: http.StatusUnauthorized,
+			cookie:     valid,
+			state:      "test state",
+			error:      "access_denied",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -60,10 +107,15 @@ func TestAuthGitHub_Callback(t *testing.T) {
 			values := url.Values{}
 			values.Set("state", tt.state)
 			values.Set("code", tt.code)
+			if tt.error != "" {
+				values.Set("error", tt.error)
+			}
 
 			req := httptest.NewRequest("POST", "/callback", strings.NewReader(values.Encode()))
 			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			req.Header.Add("Cookie", fmt.Sprintf("%s=%s", CookieKey, tt.cookie))
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: CookieKey, Value: tt.cookie})
+			}
 			resp := httptest.NewRecorder()
 
 			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -82,7 +134,7 @@ func TestAuthGitHub_Callback(t *testing.T) {
 				if err != nil {
 					t.Errorf("Failed reading request body: %s.", err)
 				}
-				if string(body) != "code=test+code&grant_type=authorization_code&redirect_uri=REDIRECT_URL" {
+				if string(body) != "code=test+code&code_verifier=test+verifier&grant_type=authorization_code&redirect_uri=REDIRECT_URL" {
 					t.Errorf("Unexpected exchange payload; got %q", body)
 				}
 				w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
@@ -110,13 +162,128 @@ func TestAuthGitHub_Callback(t *testing.T) {
 			}))
 			defer tv.Close()
 			os.Setenv("VAULT_ADDR", tv.URL)
+			vault, err := NewVaultClient(tt.fields.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.vault = vault
 
 			g.Callback(resp, req)
 
 			if resp.Code != tt.wantStatus {
 				t.Errorf("callback status code does not match, expected %d, got %d", tt.wantStatus, resp.Code)
 			}
+			if tt.cookie != "" {
+				if c := resp.Result().Cookies(); len(c) == 0 || c[0].Name != CookieKey || c[0].MaxAge >= 0 {
+					t.Errorf("state cookie is not cleared: %+v", c)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthGitHub_Login(t *testing.T) {
+	config := &Config{
+		ExternalURL: "https://kagiana.example.com",
+		OAuth:       oauth2.Config{ClientID: "id", Endpoint: oauth2.Endpoint{AuthURL: "https://github.com/login/oauth/authorize"}},
+	}
+	g := NewGitHub(config, nil)
+	tests := []struct {
+		name       string
+		returnTo   string
+		wantStatus int
+	}{
+		{name: "login", wantStatus: http.StatusTemporaryRedirect},
+		{name: "return to", returnTo: "/device", wantStatus: http.StatusTemporaryRedirect},
+		{name: "open redirect", returnTo: "//evil.example.com/", wantStatus: http.StatusBadRequest},
+		{name: "absolute url", returnTo: "https://evil.example.com/", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := httptest.NewRecorder()
+			g.Login(resp, httptest.NewRequest(http.MethodGet, "/?"+url.Values{"return_to": []string{tt.returnTo}}.Encode(), nil))
+			if resp.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusTemporaryRedirect {
+				return
+			}
 
+			cookie := resp.Result().Cookies()[0]
+			if !cookie.Secure || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+				t.Errorf("cookie = %+v", cookie)
+			}
+			s, err := openOAuthState(config, cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.ReturnTo != tt.returnTo {
+				t.Errorf("return to = %q, want %q", s.ReturnTo, tt.returnTo)
+			}
+			u, _ := url.Parse(resp.Header().Get("Location"))
+			if q := u.Query(); q.Get("state") != s.Nonce || q.Get("code_challenge") != oauth2.S256ChallengeFromVerifier(s.Verifier) || q.Get("code_challenge_method") != "S256" {
+				t.Errorf("authorization url = %s", u)
+			}
+		})
+	}
+}
+
+func TestAuthGitHub_CallbackDeniesHandoff(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "test code" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+		w.Write([]byte("access_token=github-token&token_type=bearer"))
+	}))
+	defer ts.Close()
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+	}))
+	defer tv.Close()
+
+	config := &Config{
+		OAuthProvider: "github",
+		VaultAddr:     tv.URL,
+		OAuth:         oauth2.Config{ClientID: "id", ClientSecret: "secret", Endpoint: oauth2.Endpoint{TokenURL: ts.URL + "/token"}},
+	}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+	g := NewGitHub(config, vault)
+	cookie, err := sealOAuthState(config, &oauthState{Nonce: "test state", Verifier: "test verifier", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		code string
+	}{
+		{name: "code exchange fails", code: "wrong code"},
+		{name: "vault login fails", code: "test code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewDeviceStore()
+			d := store.create(time.Minute, time.Millisecond)
+
+			req := httptest.NewRequest(http.MethodGet, "/callback?"+url.Values{"state": {"test state"}, "code": {tt.code}}.Encode(), nil)
+			req.AddCookie(&http.Cookie{Name: CookieKey, Value: cookie})
+			w := httptest.NewRecorder()
+			g.Callback(w, withHandoff(req, &deviceApproval{store: store, userCode: d.userCode}))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+
+			time.Sleep(time.Millisecond)
+			if _, apiErr := store.poll(d.deviceCode); apiErr == nil || apiErr.Code != ErrCodeAccessDenied {
+				t.Errorf("poll = %v, want %s", apiErr, ErrCodeAccessDenied)
+			}
 		})
 	}
 }
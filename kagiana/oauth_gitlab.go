@@ -0,0 +1,223 @@
+package kagiana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+)
+
+const (
+	DefaultGitLabURL    = "https://gitlab.com"
+	gitlabGroupsPerPage = 100
+)
+
+// DefaultGitLabScopes reads the user and its groups, and gets an id token
+// for the jwt login of Vault.
+var DefaultGitLabScopes = []string{"openid", "read_user", "read_api"}
+
+func gitlabBaseURL(p ProviderConfig) string {
+	if p.BaseURL == "" {
+		return DefaultGitLabURL
+	}
+	return strings.TrimSuffix(p.BaseURL, "/")
+}
+
+// gitlabOAuthDefaults fills the endpoints and scopes of base_url.
+func gitlabOAuthDefaults(oauth *oauth2.Config, p ProviderConfig) {
+	if oauth.Endpoint.AuthURL == "" {
+		oauth.Endpoint.AuthURL = gitlabBaseURL(p) + "/oauth/authorize"
+	}
+	if oauth.Endpoint.TokenURL == "" {
+		oauth.Endpoint.TokenURL = gitlabBaseURL(p) + "/oauth/token"
+	}
+	if len(oauth.Scopes) == 0 {
+		oauth.Scopes = DefaultGitLabScopes
+	}
+}
+
+// NewGitLab returns a provider of gitlab.com or a self-hosted GitLab.
+func NewGitLab(config *Config, p ProviderConfig, vault *api.Client) *AuthGitLab {
+	return &AuthGitLab{
+		config:   config,
+		provider: p,
+		baseURL:  gitlabBaseURL(p),
+		vault:    vault,
+		getCert:  getCert,
+	}
+}
+
+type AuthGitLab struct {
+	config   *Config
+	provider ProviderConfig
+	baseURL  string
+	vault    *api.Client
+	getCert  func(http.ResponseWriter, *http.Request, *Vault)
+}
+
+type gitlabUser struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	State    string `json:"state"`
+}
+
+type gitlabGroup struct {
+	FullPath string `json:"full_path"`
+}
+
+func (g *AuthGitLab) Login(w http.ResponseWriter, r *http.Request) {
+	u, err := startOAuthLogin(w, r, g.config, &g.config.OAuth)
+	if err != nil {
+		failLogin(w, r, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
+	http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+}
+
+func (g *AuthGitLab) Callback(w http.ResponseWriter, r *http.Request) {
+	SetRequestUser(r, "", "gitlab")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	state, apiErr := finishOAuthLogin(w, r, g.config)
+	if apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	token, err := g.getToken(r.Context(), r.FormValue("code"), state.Verifier)
+	if err != nil {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err.Error())))
+		return
+	}
+
+	id, err := g.identity(r.Context(), token.AccessToken)
+	if err != nil {
+		failLogin(w, r, withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeUnauthorized, "can't get gitlab user: %s", err.Error())))
+		return
+	}
+	SetRequestUser(r, id.User, "gitlab")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: id.User}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+	if apiErr := checkAllowedGroups(r.Context(), g.provider, id); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	vlt, err := g.loginVault(r.Context(), token, id)
+	if err != nil {
+		failLogin(w, r, withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err.Error())))
+		return
+	}
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	g.getCert(w, withReturnTo(r, state.ReturnTo), vlt)
+}
+
+// loginVault logs in with the id token to the jwt auth method, or has kagiana
+// create the token when vault_login is token.
+func (g *AuthGitLab) loginVault(ctx context.Context, token *oauth2.Token, id Identity) (*Vault, error) {
+	if g.provider.VaultLogin == "token" {
+		return exchangeVaultToken(ctx, g.vault, g.config, g.provider, id)
+	}
+
+	idToken, _ := token.Extra("id_token").(string)
+	if idToken == "" {
+		return nil, fmt.Errorf("gitlab returned no id token, add the openid scope")
+	}
+	vlt, err := loginVault(ctx, g.vault, g.config, vaultAuthPath(g.config, "jwt"), map[string]interface{}{
+		"role": g.provider.VaultRole,
+		"jwt":  idToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the jwt method reports the claims of claim_mappings only
+	if vlt.auth.Metadata == nil {
+		vlt.auth.Metadata = map[string]string{}
+	}
+	if vlt.auth.Metadata["username"] == "" {
+		vlt.auth.Metadata["username"] = id.User
+	}
+	return vlt, nil
+}
+
+func (g *AuthGitLab) getToken(ctx context.Context, code, verifier string) (*oauth2.Token, error) {
+	ctx, span := startSpan(ctx, "oauth.exchange", attribute.String("oauth.provider", "gitlab"))
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, tracedHTTPClient)
+	token, err := g.config.OAuth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	endSpan(span, err)
+	if err != nil {
+		oauthExchangeFailuresTotal.WithLabelValues("gitlab").Inc()
+		return nil, fmt.Errorf("code exchange wrong: %s", err.Error())
+	}
+	return token, nil
+}
+
+func (g *AuthGitLab) get(ctx context.Context, token, p string, query url.Values, v interface{}) (*http.Response, error) {
+	u := g.baseURL + "/api/v4" + p
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := tracedHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s status code=%d", p, resp.StatusCode)
+	}
+	return resp, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// identity reads the username and the full paths of the groups of the user.
+func (g *AuthGitLab) identity(ctx context.Context, token string) (Identity, error) {
+	ctx, span := startSpan(ctx, "gitlab.user")
+	defer span.End()
+
+	user := gitlabUser{}
+	if _, err := g.get(ctx, token, "/user", nil, &user); err != nil {
+		return Identity{}, err
+	}
+	if user.State != "" && user.State != "active" {
+		return Identity{}, fmt.Errorf("user %s is %s", user.Username, user.State)
+	}
+	id := Identity{User: user.Username, Email: user.Email}
+
+	query := url.Values{"min_access_level": []string{"10"}, "per_page": []string{fmt.Sprint(gitlabGroupsPerPage)}, "page": []string{"1"}}
+	for {
+		groups := []gitlabGroup{}
+		resp, err := g.get(ctx, token, "/groups", query, &groups)
+		if err != nil {
+			return Identity{}, err
+		}
+		for _, group := range groups {
+			id.Groups = append(id.Groups, group.FullPath)
+		}
+		next := resp.Header.Get("X-Next-Page")
+		if next == "" {
+			return id, nil
+		}
+		query.Set("page", next)
+	}
+}
@@ -0,0 +1,194 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func newTestGitLab(t *testing.T, state string, idToken bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" && r.Header.Get("Authorization") != "Bearer gitlab-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/oauth/token":
+			r.ParseForm()
+			if r.FormValue("code_verifier") != "test verifier" {
+				t.Errorf("code_verifier = %q", r.FormValue("code_verifier"))
+			}
+			ret := map[string]interface{}{"access_token": "gitlab-token", "token_type": "bearer"}
+			if idToken {
+				ret["id_token"] = "gitlab-id-token"
+			}
+			json.NewEncoder(w).Encode(ret)
+		case "/api/v4/user":
+			json.NewEncoder(w).Encode(gitlabUser{Username: "alice", Email: "alice@example.com", State: state})
+		case "/api/v4/groups":
+			if r.URL.Query().Get("page") == "1" {
+				w.Header().Set("X-Next-Page", "2")
+				json.NewEncoder(w).Encode([]gitlabGroup{{FullPath: "infra"}})
+				return
+			}
+			json.NewEncoder(w).Encode([]gitlabGroup{{FullPath: "infra/SRE"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAuthGitLab_Callback(t *testing.T) {
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		var auth *api.SecretAuth
+		switch r.URL.Path {
+		case "/v1/auth/gitlab-jwt/login":
+			if body["jwt"] != "gitlab-id-token" || body["role"] != "developer" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			auth = &api.SecretAuth{ClientToken: "jwt-token", Metadata: map[string]string{"role": "developer"}}
+		case "/v1/auth/token/create/kagiana-gitlab":
+			meta, _ := body["meta"].(map[string]interface{})
+			if r.Header.Get("X-Vault-Token") != "kagiana-token" || meta["groups"] != "infra,infra/SRE" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			auth = &api.SecretAuth{ClientToken: "exchanged-token", Metadata: map[string]string{"username": "alice"}}
+		case "/v1/auth/token/create/kagiana-gitlab-entity":
+			if body["entity_alias"] != "gitlab:alice" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			auth = &api.SecretAuth{ClientToken: "entity-token", Metadata: map[string]string{"username": "alice"}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&api.Secret{Auth: auth})
+	}))
+	defer tv.Close()
+
+	tests := []struct {
+		name       string
+		provider   ProviderConfig
+		state      string
+		noIDToken  bool
+		wantStatus int
+		wantToken  string
+	}{
+		{
+			name:       "jwt",
+			provider:   ProviderConfig{VaultAuthPath: "gitlab-jwt", VaultRole: "developer", AllowedGroups: []string{"infra/sre"}},
+			wantStatus: http.StatusOK,
+			wantToken:  "jwt-token",
+		},
+		{
+			name:       "token exchange",
+			provider:   ProviderConfig{VaultLogin: "token", VaultToken: "kagiana-token", VaultTokenRole: "kagiana-gitlab"},
+			wantStatus: http.StatusOK,
+			wantToken:  "exchanged-token",
+		},
+		{
+			name:       "token exchange with entity alias",
+			provider:   ProviderConfig{VaultLogin: "token", VaultToken: "kagiana-token", VaultTokenRole: "kagiana-gitlab-entity", VaultTokenEntityAlias: true},
+			wantStatus: http.StatusOK,
+			wantToken:  "entity-token",
+		},
+		{
+			name:       "not in allowed groups",
+			provider:   ProviderConfig{VaultAuthPath: "gitlab-jwt", VaultRole: "developer", AllowedGroups: []string{"contractors"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "blocked user",
+			provider:   ProviderConfig{VaultAuthPath: "gitlab-jwt", VaultRole: "developer"},
+			state:      "blocked",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "no id token",
+			provider:   ProviderConfig{VaultAuthPath: "gitlab-jwt", VaultRole: "developer"},
+			noIDToken:  true,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gl := newTestGitLab(t, tt.state, !tt.noIDToken)
+			defer gl.Close()
+
+			tt.provider.Name, tt.provider.Type, tt.provider.BaseURL = "gitlab", "gitlab", gl.URL
+			config := &Config{VaultAddr: tv.URL, ExternalURL: "https://kagiana.example.com"}
+			vault, err := NewVaultClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vault.SetMaxRetries(0)
+			g := NewGitLab(config.ForProvider(tt.provider), tt.provider, vault)
+			g.getCert = func(w http.ResponseWriter, r *http.Request, vlt *Vault) {
+				if vlt.Token() != tt.wantToken || vlt.UserName() != "alice" {
+					t.Errorf("vault = %s %s, want %s alice", vlt.Token(), vlt.UserName(), tt.wantToken)
+				}
+				w.WriteHeader(http.StatusOK)
+			}
+
+			cookie, err := sealOAuthState(g.config, &oauthState{Nonce: "test state", Verifier: "test verifier", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := url.Values{"state": []string{"test state"}, "code": []string{"test code"}}
+			req := httptest.NewRequest(http.MethodPost, "/auth/gitlab/callback", strings.NewReader(values.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(&http.Cookie{Name: CookieKey, Value: cookie})
+			resp := httptest.NewRecorder()
+			g.Callback(resp, req)
+
+			if resp.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.Code, tt.wantStatus, resp.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthGitLab_LoginDeniesHandoff(t *testing.T) {
+	p := ProviderConfig{Name: "gitlab", Type: "gitlab"}
+	g := NewGitLab((&Config{ExternalURL: "https://kagiana.example.com"}).ForProvider(p), p, nil)
+	store := NewDeviceStore()
+	d := store.create(time.Minute, time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/gitlab/login?return_to=//evil.example.com", nil)
+	w := httptest.NewRecorder()
+	g.Login(w, withHandoff(req, &deviceApproval{store: store, userCode: d.userCode}))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	time.Sleep(time.Millisecond)
+	if _, apiErr := store.poll(d.deviceCode); apiErr == nil || apiErr.Code != ErrCodeAccessDenied {
+		t.Errorf("poll = %v, want %s", apiErr, ErrCodeAccessDenied)
+	}
+}
+
+func TestNewGitLab(t *testing.T) {
+	p := ProviderConfig{Name: "gitlab", Type: "gitlab", BaseURL: "https://gitlab.example.com/"}
+	config := (&Config{ExternalURL: "https://kagiana.example.com"}).ForProvider(p)
+	if config.OAuth.Endpoint.AuthURL != "https://gitlab.example.com/oauth/authorize" || config.OAuth.Endpoint.TokenURL != "https://gitlab.example.com/oauth/token" {
+		t.Errorf("endpoint = %+v", config.OAuth.Endpoint)
+	}
+	if strings.Join(config.OAuth.Scopes, " ") != "openid read_user read_api" {
+		t.Errorf("scopes = %v", config.OAuth.Scopes)
+	}
+	if config.OAuth.RedirectURL != "https://kagiana.example.com/auth/gitlab/callback" {
+		t.Errorf("redirect url = %s", config.OAuth.RedirectURL)
+	}
+}
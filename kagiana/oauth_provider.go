@@ -1,6 +1,14 @@
 package kagiana
 
-import "net/http"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+)
 
 const CookieKey = "kagiana_oauth_state"
 
@@ -9,12 +17,144 @@ type OAuthProvider interface {
 	Callback(w http.ResponseWriter, r *http.Request)
 }
 
+// oauthProviderTypes are the providers configured with an oauth client.
+var oauthProviderTypes = map[string]bool{"github": true, "gitlab": true}
+
+// Provider is a configured login method.
+type Provider struct {
+	ProviderConfig
+	OAuthProvider
+}
+
+func (p *Provider) LoginPath() string {
+	return "/auth/" + p.Name + "/login"
+}
+
+func (p *Provider) CallbackPath() string {
+	return "/auth/" + p.Name + "/callback"
+}
+
+func (p *Provider) MetadataPath() string {
+	return "/auth/" + p.Name + "/metadata"
+}
+
+// MetadataProvider publishes the metadata of kagiana for the provider, like
+// the SP metadata of SAML.
+type MetadataProvider interface {
+	Metadata(w http.ResponseWriter, r *http.Request)
+}
+
+// NewProvider returns the provider of p. passwords keeps the lockouts of the
+// password providers across config reloads.
+func NewProvider(config *Config, p ProviderConfig, vault *api.Client, passwords *PasswordStore) (*Provider, error) {
+	pc := config.ForProvider(p)
+	switch p.Type {
+	case "github":
+		return &Provider{ProviderConfig: p, OAuthProvider: NewGitHub(pc, vault)}, nil
+	case "gitlab":
+		return &Provider{ProviderConfig: p, OAuthProvider: NewGitLab(pc, p, vault)}, nil
+	case "saml":
+		s, err := NewSAML(pc, p, vault)
+		if err != nil {
+			return nil, err
+		}
+		return &Provider{ProviderConfig: p, OAuthProvider: s}, nil
+	case "header":
+		h, err := NewHeader(pc, p, vault)
+		if err != nil {
+			return nil, err
+		}
+		return &Provider{ProviderConfig: p, OAuthProvider: h}, nil
+	case "ldap", "userpass":
+		return &Provider{ProviderConfig: p, OAuthProvider: NewPassword(pc, p, vault, passwords)}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %s", p.Type)
+}
+
+func NewProviders(config *Config, vault *api.Client, passwords *PasswordStore) ([]*Provider, error) {
+	names := map[string]bool{}
+	var providers []*Provider
+	for _, pc := range config.ProviderConfigs() {
+		if names[pc.Name] {
+			return nil, fmt.Errorf("provider %s is configured twice", pc.Name)
+		}
+		names[pc.Name] = true
+
+		p, err := NewProvider(config, pc, vault, passwords)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
+
+// LandingHandler lists the providers to log in with.
+func LandingHandler(providers []*Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		renderLanding(w, providers)
+	}
+}
+
+// certHandoff delivers the certs issued in the browser to the client which
+// started the login, instead of rendering them in the page.
+type certHandoff interface {
+	// confirm is called before the certs are issued. It returns false when
+	// it wrote the response instead.
+	confirm(w http.ResponseWriter, r *http.Request, vlt *Vault) bool
+	approve(w http.ResponseWriter, r *http.Request, vlt *Vault, cbs map[string]*certutil.CertBundle, failures map[string]string)
+	// deny stops the client waiting for the login. It returns true when it
+	// wrote the response instead of the error page.
+	deny(w http.ResponseWriter, r *http.Request, reason string) bool
+}
+
+func withHandoff(r *http.Request, h certHandoff) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), handoffKey, h))
+}
+
+func handoffFrom(ctx context.Context) certHandoff {
+	h, _ := ctx.Value(handoffKey).(certHandoff)
+	return h
+}
+
+// secureCookie tells whether the browser reaches kagiana over https.
+func secureCookie(config *Config, r *http.Request) bool {
+	return r.TLS != nil || strings.HasPrefix(externalURL(config, ""), "https://")
+}
+
+// failLogin renders the error of a login, and stops the client waiting for
+// its result.
+func failLogin(w http.ResponseWriter, r *http.Request, apiErr *APIError) {
+	if h := handoffFrom(r.Context()); h != nil && h.deny(w, r, apiErr.Message) {
+		logRequestError(r, apiErr)
+		return
+	}
+	renderRequestError(w, r, apiErr.Status, apiErr)
+}
+
 func getCert(w http.ResponseWriter, r *http.Request, vlt *Vault) {
-	certBundles, err := vlt.CreateCert()
-	if err != nil {
-		RenderError(w, http.StatusUnauthorized, err)
+	handoff := handoffFrom(r.Context())
+	if handoff != nil && !handoff.confirm(w, r, vlt) {
+		return
+	}
+	certBundles, err := vlt.CreateCert(r.Context())
+	if len(certBundles) == 0 && err != nil {
+		if handoff != nil && handoff.deny(w, r, err.Error()) {
+			logRequestError(r, err)
+			return
+		}
+		renderRequestError(w, r, http.StatusUnauthorized, err)
 		return
 	}
 
-	RenderSuccess(w, certBundles, vlt.Token())
+	var failures map[string]string
+	if issueErr, ok := err.(*IssueError); ok {
+		Logger(r.Context()).Warnf("create cert partially failed: %s", issueErr.Error())
+		failures = issueErr.Failures()
+	}
+	if handoff != nil {
+		handoff.approve(w, r, vlt, certBundles, failures)
+		return
+	}
+	RenderSuccess(w, certBundles, vlt.Token(), failures, returnToFrom(r.Context()))
 }
@@ -0,0 +1,97 @@
+package kagiana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestNewProviders(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       *Config
+		wantNames    []string
+		wantRedirect []string
+		wantErr      bool
+	}{
+		{
+			name: "single provider",
+			config: &Config{
+				OAuthProvider: "github",
+				VaultAuthPath: "github-staff",
+				OAuth:         oauth2.Config{RedirectURL: "https://kagiana.example.com/callback"},
+			},
+			wantNames:    []string{"github"},
+			wantRedirect: []string{"https://kagiana.example.com/callback"},
+		},
+		{
+			name: "providers",
+			config: &Config{
+				ExternalURL: "https://kagiana.example.com",
+				Providers: []ProviderConfig{
+					{Name: "staff", Type: "github", VaultAuthPath: "github-staff"},
+					{Name: "contractors", Type: "github", VaultAuthPath: "github-contractors", OAuth: oauth2.Config{RedirectURL: "https://login.example.com/cb"}},
+				},
+			},
+			wantNames:    []string{"staff", "contractors"},
+			wantRedirect: []string{"https://kagiana.example.com/auth/staff/callback", "https://login.example.com/cb"},
+		},
+		{
+			name:    "duplicate",
+			config:  &Config{Providers: []ProviderConfig{{Name: "staff", Type: "github"}, {Name: "staff", Type: "github"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			config:  &Config{Providers: []ProviderConfig{{Name: "staff", Type: "bitbucket"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			providers, err := NewProviders(tt.config, nil, NewPasswordStore())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProviders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(providers) != len(tt.wantNames) {
+				t.Fatalf("providers = %d, want %d", len(providers), len(tt.wantNames))
+			}
+			for i, p := range providers {
+				g := p.OAuthProvider.(*AuthGitHub)
+				if p.Name != tt.wantNames[i] || g.config.OAuth.RedirectURL != tt.wantRedirect[i] {
+					t.Errorf("provider %d = %s %s, want %s %s", i, p.Name, g.config.OAuth.RedirectURL, tt.wantNames[i], tt.wantRedirect[i])
+				}
+				if g.config.VaultAuthPath != p.VaultAuthPath || g.config.OAuthProvider != p.Type {
+					t.Errorf("provider %s config = %s %s", p.Name, g.config.OAuthProvider, g.config.VaultAuthPath)
+				}
+			}
+		})
+	}
+}
+
+func TestLandingHandler(t *testing.T) {
+	providers, err := NewProviders(&Config{
+		ExternalURL: "https://kagiana.example.com",
+		Providers: []ProviderConfig{
+			{Name: "staff", Type: "github", DisplayName: "GitHub"},
+			{Name: "contractors", Type: "github"},
+		},
+	}, nil, NewPasswordStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	LandingHandler(providers)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{`href="/auth/staff/login">Sign in with GitHub`, `href="/auth/contractors/login">Sign in with contractors`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("landing page doesn't contain %s", want)
+		}
+	}
+}
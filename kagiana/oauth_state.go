@@ -0,0 +1,206 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const oauthStateTTL = 10 * time.Minute
+
+// defaultStateKey seals the state when oauth_state_secret isn't set. It
+// lives as long as the process, so replicas behind a load balancer need the
+// secret.
+var defaultStateKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// oauthState is sealed into the state cookie, so the PKCE verifier and the
+// return path can't be read or changed by the browser.
+type oauthState struct {
+	Nonce    string `json:"n"`
+	Verifier string `json:"v,omitempty"`
+	// RequestID is the id of a SAML AuthnRequest.
+	RequestID string `json:"i,omitempty"`
+	ReturnTo  string `json:"r,omitempty"`
+	ExpiresAt int64  `json:"e"`
+}
+
+func stateCipher(config *Config) cipher.AEAD {
+	key := defaultStateKey
+	if config.OAuthStateSecret != "" {
+		sum := sha256.Sum256([]byte(config.OAuthStateSecret))
+		key = sum[:]
+	}
+	// a 32 bytes key never fails
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+	return aead
+}
+
+func sealOAuthState(config *Config, s *oauthState) (string, error) {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	aead := stateCipher(config)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, b, []byte(CookieKey))), nil
+}
+
+func openOAuthState(config *Config, v string) (*oauthState, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	aead := stateCipher(config)
+	if len(b) < aead.NonceSize() {
+		return nil, fmt.Errorf("too short")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(CookieKey))
+	if err != nil {
+		return nil, err
+	}
+	s := &oauthState{}
+	if err := json.Unmarshal(plain, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// validReturnTo accepts only a path on kagiana, so the login can't be used
+// as an open redirect.
+func validReturnTo(p string) bool {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return false
+	}
+	u, err := url.Parse(p)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
+
+// newLoginState starts the state of a login with the return_to of the
+// request.
+func newLoginState(r *http.Request) (*oauthState, error) {
+	returnTo := r.URL.Query().Get("return_to")
+	if returnTo != "" && !validReturnTo(returnTo) {
+		return nil, fmt.Errorf("return_to must be a path on kagiana")
+	}
+	return &oauthState{
+		Nonce:     randomString(),
+		ReturnTo:  returnTo,
+		ExpiresAt: time.Now().Add(oauthStateTTL).Unix(),
+	}, nil
+}
+
+func setLoginState(w http.ResponseWriter, r *http.Request, config *Config, s *oauthState) error {
+	v, err := sealOAuthState(config, s)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieKey,
+		Value:    v,
+		Path:     "/",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		Secure:   secureCookie(config, r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// startOAuthLogin sets the state cookie and returns the authorization url
+// of the provider, with the PKCE challenge.
+func startOAuthLogin(w http.ResponseWriter, r *http.Request, config *Config, oauth *oauth2.Config) (string, error) {
+	s, err := newLoginState(r)
+	if err != nil {
+		return "", err
+	}
+	s.Verifier = oauth2.GenerateVerifier()
+	if err := setLoginState(w, r, config, s); err != nil {
+		return "", err
+	}
+	return oauth.AuthCodeURL(s.Nonce, oauth2.S256ChallengeOption(s.Verifier)), nil
+}
+
+// takeLoginState opens the state cookie, and clears it so the state is used
+// once. state is the value returned by the provider.
+func takeLoginState(w http.ResponseWriter, r *http.Request, config *Config, state string) (*oauthState, *APIError) {
+	if _, err := r.Cookie(CookieKey); err == nil {
+		clearLoginState(w, r, config)
+	}
+	return readLoginState(r, config, state)
+}
+
+// readLoginState opens the state cookie and keeps it, for a form which can be
+// posted again.
+func readLoginState(r *http.Request, config *Config, state string) (*oauthState, *APIError) {
+	c, err := r.Cookie(CookieKey)
+	if err != nil {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "login session is not found, start the login again")
+	}
+
+	s, err := openOAuthState(config, c.Value)
+	if err != nil {
+		return nil, auditLoginFailure(r.Context(), NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "login session is invalid, start the login again"))
+	}
+	if time.Now().Unix() > s.ExpiresAt {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "login session expired, start the login again")
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(s.Nonce)) != 1 {
+		return nil, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "state mismatch"))
+	}
+	return s, nil
+}
+
+func clearLoginState(w http.ResponseWriter, r *http.Request, config *Config) {
+	http.SetCookie(w, &http.Cookie{Name: CookieKey, Path: "/", MaxAge: -1, Secure: secureCookie(config, r), HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
+
+// finishOAuthLogin checks the callback of an oauth provider against the
+// state cookie.
+func finishOAuthLogin(w http.ResponseWriter, r *http.Request, config *Config) (*oauthState, *APIError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		clearLoginState(w, r, config)
+		return nil, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeAccessDenied, "login was refused by the provider: %s", strings.TrimSpace(e+" "+r.FormValue("error_description"))))
+	}
+	s, apiErr := takeLoginState(w, r, config, r.FormValue("state"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if r.FormValue("code") == "" {
+		return nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code is required")
+	}
+	return s, nil
+}
+
+func withReturnTo(r *http.Request, returnTo string) *http.Request {
+	if returnTo == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), returnToKey, returnTo))
+}
+
+func returnToFrom(ctx context.Context) string {
+	p, _ := ctx.Value(returnToKey).(string)
+	return p
+}
@@ -0,0 +1,323 @@
+package kagiana
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	DefaultLockoutMaxFailures = 5
+	DefaultLockoutWindow      = 15 * time.Minute
+	DefaultLockoutDuration    = 15 * time.Minute
+	passwordCodeTTL           = time.Minute
+)
+
+// LockoutConfig locks a user out of a password provider after MaxFailures
+// wrong passwords within Window.
+type LockoutConfig struct {
+	MaxFailures int           `mapstructure:"max_failures"`
+	Window      time.Duration `mapstructure:"window"`
+	Duration    time.Duration `mapstructure:"duration"`
+}
+
+func (c LockoutConfig) maxFailures() int {
+	if c.MaxFailures <= 0 {
+		return DefaultLockoutMaxFailures
+	}
+	return c.MaxFailures
+}
+
+func (c LockoutConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return DefaultLockoutWindow
+	}
+	return c.Window
+}
+
+func (c LockoutConfig) duration() time.Duration {
+	if c.Duration <= 0 {
+		return DefaultLockoutDuration
+	}
+	return c.Duration
+}
+
+type lockout struct {
+	failures    int
+	resetAt     time.Time
+	lockedUntil time.Time
+}
+
+type passwordCode struct {
+	vault     *Vault
+	nonce     string
+	expiresAt time.Time
+}
+
+// PasswordStore holds the failed logins of the password providers and the
+// codes passed from their form to the callback. It outlives config reloads.
+type PasswordStore struct {
+	mu       sync.Mutex
+	lockouts map[string]*lockout
+	codes    map[string]*passwordCode
+	now      func() time.Time
+}
+
+func NewPasswordStore() *PasswordStore {
+	return &PasswordStore{lockouts: map[string]*lockout{}, codes: map[string]*passwordCode{}, now: time.Now}
+}
+
+// sweep must be called with mu held. The tokens of the codes which were never
+// redeemed are revoked, as nobody can use them anymore.
+func (s *PasswordStore) sweep(now time.Time) {
+	for key, l := range s.lockouts {
+		if now.After(l.resetAt) && now.After(l.lockedUntil) {
+			delete(s.lockouts, key)
+		}
+	}
+	for code, c := range s.codes {
+		if now.After(c.expiresAt) {
+			delete(s.codes, code)
+			revokeLater(c.vault)
+		}
+	}
+}
+
+// locked returns how long key is still locked out.
+func (s *PasswordStore) locked(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	if l, ok := s.lockouts[key]; ok && now.Before(l.lockedUntil) {
+		return l.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail counts a wrong password of key, and returns true when it locks key out.
+func (s *PasswordStore) fail(key string, c LockoutConfig) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+
+	l, ok := s.lockouts[key]
+	if !ok || now.After(l.resetAt) {
+		l = &lockout{resetAt: now.Add(c.window())}
+		s.lockouts[key] = l
+	}
+	l.failures++
+	if l.failures < c.maxFailures() {
+		return false
+	}
+	l.failures = 0
+	l.lockedUntil = now.Add(c.duration())
+	l.resetAt = l.lockedUntil
+	return true
+}
+
+func (s *PasswordStore) reset(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lockouts, key)
+}
+
+// issue keeps the logged in Vault session for the callback of the login
+// whose state is nonce.
+func (s *PasswordStore) issue(vlt *Vault, nonce string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	code := randomString()
+	s.codes[code] = &passwordCode{vault: vlt, nonce: nonce, expiresAt: now.Add(passwordCodeTTL)}
+	return code
+}
+
+// redeem returns the session of code once.
+func (s *PasswordStore) redeem(code, nonce string) (*Vault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.codes[code]
+	if !ok {
+		return nil, false
+	}
+	delete(s.codes, code)
+	if s.now().After(c.expiresAt) || c.nonce != nonce {
+		revokeLater(c.vault)
+		return nil, false
+	}
+	return c.vault, true
+}
+
+// AuthPassword logs in with a user and a password to the ldap or userpass
+// auth method of Vault. The form is posted to the login path, which passes a
+// one-time code to the callback like an oauth provider, so the callback hands
+// the certs over to a device or a client as well.
+type AuthPassword struct {
+	config   *Config
+	provider ProviderConfig
+	store    *PasswordStore
+	vault    *api.Client
+	getCert  func(http.ResponseWriter, *http.Request, *Vault)
+}
+
+func NewPassword(config *Config, p ProviderConfig, vault *api.Client, store *PasswordStore) *AuthPassword {
+	return &AuthPassword{
+		config:   config,
+		provider: p,
+		store:    store,
+		vault:    vault,
+		getCert:  getCert,
+	}
+}
+
+// renderForm renders the form with the state, whose nonce is posted back as
+// the csrf token.
+func (a *AuthPassword) renderForm(w http.ResponseWriter, r *http.Request, statusCode int, state *oauthState, user, errMsg string) {
+	if err := setLoginState(w, r, a.config, state); err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	renderPasswordForm(w, statusCode, struct {
+		Title  string
+		Action string
+		State  string
+		User   string
+		Error  string
+	}{a.provider.Title(), "/auth/" + a.provider.Name + "/login", state.Nonce, user, errMsg})
+}
+
+func (a *AuthPassword) Login(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		a.submit(w, r)
+		return
+	}
+	state, err := newLoginState(r)
+	if err != nil {
+		renderRequestError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	a.renderForm(w, r, http.StatusOK, state, "", "")
+}
+
+func (a *AuthPassword) submit(w http.ResponseWriter, r *http.Request) {
+	SetRequestUser(r, "", a.provider.Type)
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{}); apiErr != nil {
+		renderRequestError(w, r, apiErr.Status, apiErr)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		renderRequestError(w, r, http.StatusBadRequest, err)
+		return
+	}
+
+	state, apiErr := readLoginState(r, a.config, r.PostForm.Get("state"))
+	if apiErr != nil {
+		// the form wasn't rendered by this browser, start over
+		s, err := newLoginState(r)
+		if err != nil {
+			renderRequestError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		a.renderForm(w, r, apiErr.Status, s, "", apiErr.Message)
+		return
+	}
+
+	user := strings.TrimSpace(r.PostForm.Get("user"))
+	password := r.PostForm.Get("password")
+	if user == "" || password == "" {
+		a.renderForm(w, r, http.StatusBadRequest, state, user, "Enter the user and the password.")
+		return
+	}
+	SetRequestUser(r, user, a.provider.Type)
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: user}); apiErr != nil {
+		renderRequestError(w, r, apiErr.Status, apiErr)
+		return
+	}
+
+	// failures are counted for the user from each client ip, so a client
+	// guessing passwords can't lock the user out of the other addresses
+	ip := requestClientIP(r)
+	key := a.provider.Name + ":" + strings.ToLower(user) + "@" + ip
+	if wait := a.store.locked(key); wait > 0 {
+		auditLoginFailure(r.Context(), NewAPIError(http.StatusTooManyRequests, ErrCodeRateLimited, "%s is locked out", user))
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		a.renderForm(w, r, http.StatusTooManyRequests, state, user, "Too many failed logins. Try again later.")
+		return
+	}
+
+	authPath := vaultAuthPath(a.config, a.provider.Type)
+	vlt, err := loginVaultPath(r.Context(), a.vault, a.config, authPath, fmt.Sprintf("auth/%s/login/%s", authPath, url.PathEscape(user)), map[string]interface{}{
+		"password": password,
+	})
+	if err != nil {
+		var respErr *api.ResponseError
+		if !errors.As(err, &respErr) || respErr.StatusCode >= http.StatusInternalServerError {
+			apiErr := withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeUnauthorized, "%s", err.Error()))
+			renderRequestError(w, r, apiErr.Status, apiErr)
+			return
+		}
+		if a.store.fail(key, a.provider.Lockout) {
+			loginLockoutsTotal.WithLabelValues(a.provider.Name).Inc()
+			Logger(r.Context()).Warnf("%s is locked out of provider %s from %s", user, a.provider.Name, ip)
+		}
+		a.renderForm(w, r, http.StatusUnauthorized, state, user, "The user or the password is wrong.")
+		return
+	}
+	a.store.reset(key)
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		renderRequestError(w, r, apiErr.Status, apiErr)
+		return
+	}
+
+	code := a.store.issue(vlt, state.Nonce)
+	http.Redirect(w, r, a.config.OAuth.RedirectURL+"?"+url.Values{"code": []string{code}, "state": []string{state.Nonce}}.Encode(), http.StatusSeeOther)
+}
+
+// requestClientIP returns the client ip resolved by WithAuditor, or the
+// remote address.
+func requestClientIP(r *http.Request) string {
+	if ip := clientIPFrom(r.Context()); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *AuthPassword) Callback(w http.ResponseWriter, r *http.Request) {
+	SetRequestUser(r, "", a.provider.Type)
+	state, apiErr := finishOAuthLogin(w, r, a.config)
+	if apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	vlt, ok := a.store.redeem(r.FormValue("code"), state.Nonce)
+	if !ok {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "code is invalid or expired, start the login again")))
+		return
+	}
+	SetRequestUser(r, vlt.UserName(), a.provider.Type)
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	a.getCert(w, withReturnTo(r, state.ReturnTo), vlt)
+}
@@ -0,0 +1,296 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+var passwordFormState = regexp.MustCompile(`name="state" value="([^"]*)"`)
+
+func TestAuthPassword(t *testing.T) {
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case r.URL.Path == "/v1/auth/corp-ldap/login/broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/v1/auth/corp-ldap/login/alice" && body["password"] == "secret":
+			json.NewEncoder(w).Encode(&api.Secret{Auth: &api.SecretAuth{ClientToken: "ldap-token", Metadata: map[string]string{"username": "alice"}}})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid username or password"}})
+		}
+	}))
+	defer tv.Close()
+
+	config := &Config{VaultAddr: tv.URL, ExternalURL: "https://kagiana.example.com"}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+
+	p := ProviderConfig{Name: "corp", Type: "ldap", VaultAuthPath: "corp-ldap", Lockout: LockoutConfig{MaxFailures: 2}}
+	issued := ""
+	newPassword := func() *AuthPassword {
+		a := NewPassword(config.ForProvider(p), p, vault, NewPasswordStore())
+		a.getCert = func(w http.ResponseWriter, r *http.Request, vlt *Vault) {
+			issued = vlt.UserName()
+			w.WriteHeader(http.StatusOK)
+		}
+		return a
+	}
+
+	// form renders the login form, and returns its state cookie and csrf token
+	form := func(t *testing.T, a *AuthPassword) (*http.Cookie, string) {
+		w := httptest.NewRecorder()
+		a.Login(w, httptest.NewRequest(http.MethodGet, "/auth/corp/login", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("form status = %d", w.Code)
+		}
+		m := passwordFormState.FindStringSubmatch(w.Body.String())
+		if m == nil {
+			t.Fatalf("form = %s", w.Body.String())
+		}
+		return w.Result().Cookies()[0], m[1]
+	}
+	submitFrom := func(a *AuthPassword, ip string, cookie *http.Cookie, state, user, password string) *httptest.ResponseRecorder {
+		body := url.Values{"state": {state}, "user": {user}, "password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/auth/corp/login", strings.NewReader(body.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		a.Login(w, req)
+		return w
+	}
+	submit := func(a *AuthPassword, cookie *http.Cookie, state, user, password string) *httptest.ResponseRecorder {
+		return submitFrom(a, "192.0.2.1", cookie, state, user, password)
+	}
+	callback := func(a *AuthPassword, cookie *http.Cookie, location string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, location, nil)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		a.Callback(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name       string
+		run        func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder
+		wantStatus int
+		wantBody   string
+		wantIssued string
+	}{
+		{
+			name: "login",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				w := submit(a, cookie, state, "alice", "secret")
+				if w.Code != http.StatusSeeOther {
+					t.Fatalf("submit status = %d: %s", w.Code, w.Body.String())
+				}
+				return callback(a, cookie, w.Header().Get("Location"))
+			},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name: "wrong password",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				return submit(a, cookie, state, "alice", "wrong")
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "The user or the password is wrong.",
+		},
+		{
+			name: "retry after a wrong password",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				submit(a, cookie, state, "alice", "wrong")
+				w := submit(a, cookie, state, "alice", "secret")
+				return callback(a, cookie, w.Header().Get("Location"))
+			},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name: "locked out",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				submit(a, cookie, state, "alice", "wrong")
+				submit(a, cookie, state, "Alice", "wrong")
+				return submit(a, cookie, state, "alice", "secret")
+			},
+			wantStatus: http.StatusTooManyRequests,
+			wantBody:   "Too many failed logins.",
+		},
+		{
+			name: "not locked out of another address",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				submit(a, cookie, state, "alice", "wrong")
+				submit(a, cookie, state, "alice", "wrong")
+				w := submitFrom(a, "198.51.100.1", cookie, state, "alice", "secret")
+				return callback(a, cookie, w.Header().Get("Location"))
+			},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name: "no csrf cookie",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				_, state := form(t, a)
+				return submit(a, nil, state, "alice", "secret")
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "login session is not found",
+		},
+		{
+			name: "csrf token mismatch",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, _ := form(t, a)
+				return submit(a, cookie, "forged", "alice", "secret")
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "state mismatch",
+		},
+		{
+			name: "vault unavailable",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				return submit(a, cookie, state, "broken", "secret")
+			},
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name: "code replayed",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				location := submit(a, cookie, state, "alice", "secret").Header().Get("Location")
+				callback(a, cookie, location)
+				issued = ""
+				return callback(a, cookie, location)
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "code is invalid or expired",
+		},
+		{
+			name: "code of another login",
+			run: func(t *testing.T, a *AuthPassword) *httptest.ResponseRecorder {
+				cookie, state := form(t, a)
+				other, _ := form(t, a)
+				location := submit(a, cookie, state, "alice", "secret").Header().Get("Location")
+				u, _ := url.Parse(location)
+				s, _ := openOAuthState(a.config, other.Value)
+				q := u.Query()
+				q.Set("state", s.Nonce)
+				return callback(a, other, u.Path+"?"+q.Encode())
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   "code is invalid or expired",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued = ""
+			w := tt.run(t, newPassword())
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+			if issued != tt.wantIssued {
+				t.Errorf("issued = %q, want %q", issued, tt.wantIssued)
+			}
+		})
+	}
+}
+
+func TestPasswordStore_Lockout(t *testing.T) {
+	now := time.Now()
+	s := NewPasswordStore()
+	s.now = func() time.Time { return now }
+	c := LockoutConfig{MaxFailures: 3, Window: time.Minute, Duration: 10 * time.Minute}
+
+	s.fail("corp:alice", c)
+	s.fail("corp:alice", c)
+	now = now.Add(2 * time.Minute)
+	if s.fail("corp:alice", c) || s.locked("corp:alice") != 0 {
+		t.Fatal("failures out of the window are counted")
+	}
+	s.fail("corp:alice", c)
+	if !s.fail("corp:alice", c) {
+		t.Fatal("not locked out")
+	}
+	if got := s.locked("corp:alice"); got != 10*time.Minute {
+		t.Errorf("locked() = %s", got)
+	}
+	if s.locked("corp:bob") != 0 {
+		t.Error("another user is locked out")
+	}
+	now = now.Add(11 * time.Minute)
+	if s.locked("corp:alice") != 0 {
+		t.Error("still locked out")
+	}
+}
+
+func TestPasswordStore_SweepRevokes(t *testing.T) {
+	revoked := make(chan string, 2)
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/token/revoke-self" {
+			revoked <- r.Header.Get("X-Vault-Token")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer tv.Close()
+	base, err := NewVaultClient(&Config{VaultAddr: tv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newVault := func(token string) *Vault {
+		client, _ := base.Clone()
+		client.SetToken(token)
+		return &Vault{client: client, config: &Config{}, auth: &api.SecretAuth{Metadata: map[string]string{"username": "alice"}}}
+	}
+
+	now := time.Now()
+	s := NewPasswordStore()
+	s.now = func() time.Time { return now }
+	redeemed := s.issue(newVault("redeemed-token"), "nonce-1")
+	s.issue(newVault("abandoned-token"), "nonce-2")
+	if _, ok := s.redeem(redeemed, "nonce-1"); !ok {
+		t.Fatal("redeem() failed")
+	}
+
+	now = now.Add(passwordCodeTTL + time.Second)
+	s.locked("corp:alice")
+	select {
+	case token := <-revoked:
+		if token != "abandoned-token" {
+			t.Errorf("revoked %s, want abandoned-token", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the token of the expired code is not revoked")
+	}
+	if len(s.codes) != 0 {
+		t.Errorf("codes = %v", s.codes)
+	}
+	select {
+	case token := <-revoked:
+		t.Errorf("revoked %s too", token)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,277 @@
+package kagiana
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	redis "gopkg.in/redis.v5"
+)
+
+const (
+	RateLimitStoreMemory = "memory"
+	RateLimitStoreRedis  = "redis"
+	ErrCodeRateLimited   = "rate_limited"
+)
+
+type RateLimitConfig struct {
+	UserRate       float64  `mapstructure:"user_rate"`
+	UserBurst      int      `mapstructure:"user_burst"`
+	IPRate         float64  `mapstructure:"ip_rate"`
+	IPBurst        int      `mapstructure:"ip_burst"`
+	TrustedProxies []string `mapstructure:"trusted_proxies" validate:"dive,cidr"`
+	Store          string   `mapstructure:"store" validate:"omitempty,oneof=memory redis"`
+	RedisAddr      string   `mapstructure:"redis_addr"`
+	RedisPassword  string   `mapstructure:"redis_password"`
+	RedisDB        int      `mapstructure:"redis_db"`
+}
+
+var rateLimitedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "rate_limited_total",
+	Help:      "Number of requests rejected by the rate limiter by key type.",
+}, []string{"key_type"})
+
+// RateLimitStore holds the token buckets. Implementations backed by a shared
+// storage let several replicas enforce the same limit.
+type RateLimitStore interface {
+	// Take removes a token from the bucket of key. When the bucket is empty it
+	// returns false and how long to wait for the next token.
+	Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	now     func() time.Time
+	swept   time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+func (m *MemoryRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		m.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, nil
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second)), nil
+}
+
+// sweep drops the buckets which are full again, so the map doesn't grow with
+// every client ever seen.
+func (m *MemoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(m.swept) < time.Minute {
+		return
+	}
+	m.swept = now
+	for key, b := range m.buckets {
+		if now.Sub(b.last) > 10*time.Minute {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+var tokenBucketScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+type RedisRateLimitStore struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedisRateLimitStore(addr, password string, db int) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     addr,
+			Password: password,
+			DB:       db,
+		}),
+		prefix: "kagiana:ratelimit:",
+	}
+}
+
+func (s *RedisRateLimitStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, rate float64, burst int) (bool, time.Duration, error) {
+	var ret interface{}
+	err := withContext(ctx, func() error {
+		r, err := tokenBucketScript.Run(s.client, []string{s.prefix + key}, rate, burst, time.Now().UnixNano()/int64(time.Millisecond)).Result()
+		ret = r
+		return err
+	})
+	if err != nil {
+		return false, 0, err
+	}
+
+	values, ok := ret.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected response from redis: %v", ret)
+	}
+	allowed, _ := values[0].(int64)
+	wait, _ := values[1].(int64)
+	return allowed == 1, time.Duration(wait) * time.Millisecond, nil
+}
+
+type RateLimiter struct {
+	config         RateLimitConfig
+	store          RateLimitStore
+	trustedProxies []*net.IPNet
+}
+
+func NewRateLimiter(config RateLimitConfig) (*RateLimiter, error) {
+	return NewRateLimiterWithStore(config, NewRateLimitStore(config))
+}
+
+// NewRateLimitStore returns the store of the config. A redis store has to be
+// closed.
+func NewRateLimitStore(config RateLimitConfig) RateLimitStore {
+	if config.Store == RateLimitStoreRedis {
+		return NewRedisRateLimitStore(config.RedisAddr, config.RedisPassword, config.RedisDB)
+	}
+	return NewMemoryRateLimitStore()
+}
+
+func NewRateLimiterWithStore(config RateLimitConfig, store RateLimitStore) (*RateLimiter, error) {
+	l := &RateLimiter{
+		config: config,
+		store:  store,
+	}
+	for _, cidr := range config.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		l.trustedProxies = append(l.trustedProxies, n)
+	}
+	return l, nil
+}
+
+func (l *RateLimiter) trusted(ip net.IP) bool {
+	for _, n := range l.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client. X-Forwarded-For is only
+// followed through the configured trusted proxies, from right to left.
+func (l *RateLimiter) ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.trusted(ip) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !l.trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (l *RateLimiter) take(r *http.Request, keyType, key string, rate float64, burst int) (bool, time.Duration) {
+	if rate <= 0 || key == "" {
+		return true, 0
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+
+	ok, wait, err := l.store.Take(r.Context(), keyType+":"+key, rate, burst)
+	if err != nil {
+		// fail open, an outage of the shared store must not stop logins
+		Logger(r.Context()).Errorf("rate limit store: %s", err.Error())
+		return true, 0
+	}
+	if !ok {
+		rateLimitedTotal.WithLabelValues(keyType).Inc()
+	}
+	return ok, wait
+}
+
+// Limit rejects the request with 429 when the client ip, or the user in the
+// request form from the client ip, ran out of tokens. The user is anything
+// the client sends, so a bucket of the user alone would let anyone lock a
+// user out.
+func (l *RateLimiter) Limit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := l.ClientIP(r)
+		ok, wait := l.take(r, "ip", ip, l.config.IPRate, l.config.IPBurst)
+		if user := r.FormValue("user"); ok && user != "" {
+			ok, wait = l.take(r, "user", user+"@"+ip, l.config.UserRate, l.config.UserBurst)
+		}
+
+		if !ok {
+			Logger(r.Context()).Warnf("rate limited ip=%s user=%s", ip, r.FormValue("user"))
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			RenderAPIError(w, RequestID(r), NewAPIError(http.StatusTooManyRequests, ErrCodeRateLimited, "too many requests"))
+			return
+		}
+		next(w, r)
+	}
+}
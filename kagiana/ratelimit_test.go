@@ -0,0 +1,118 @@
+package kagiana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRateLimiter_ClientIP(t *testing.T) {
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		xForwardedFor string
+		want          string
+	}{
+		{
+			name:       "direct",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:          "untrusted proxy",
+			remoteAddr:    "192.0.2.1:1234",
+			xForwardedFor: "198.51.100.1",
+			want:          "192.0.2.1",
+		},
+		{
+			name:          "trusted proxy",
+			remoteAddr:    "10.0.0.1:1234",
+			xForwardedFor: "203.0.113.1, 198.51.100.1, 10.0.0.2",
+			want:          "198.51.100.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewRateLimiter(RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xForwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			}
+			if got := l.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	tests := []struct {
+		name   string
+		config RateLimitConfig
+		users  []string
+		ips    []string
+		want   []int
+	}{
+		{
+			name:   "per user",
+			config: RateLimitConfig{UserRate: 0.001, UserBurst: 2},
+			users:  []string{"alice", "alice", "alice", "bob"},
+			want:   []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:   "user from another ip",
+			config: RateLimitConfig{UserRate: 0.001, UserBurst: 1},
+			users:  []string{"alice", "alice", "alice"},
+			ips:    []string{"192.0.2.1", "192.0.2.1", "198.51.100.1"},
+			want:   []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:   "per ip",
+			config: RateLimitConfig{IPRate: 0.001, IPBurst: 1},
+			users:  []string{"alice", "bob"},
+			want:   []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:   "disabled",
+			config: RateLimitConfig{},
+			users:  []string{"alice", "alice", "alice"},
+			want:   []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewRateLimiter(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := l.Limit(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			for i, user := range tt.users {
+				values := url.Values{}
+				values.Set("user", user)
+				req := httptest.NewRequest("POST", "/auth/stns/verify", strings.NewReader(values.Encode()))
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				if tt.ips != nil {
+					req.RemoteAddr = tt.ips[i] + ":1234"
+				}
+				resp := httptest.NewRecorder()
+				h(resp, req)
+
+				if resp.Code != tt.want[i] {
+					t.Errorf("request %d status = %d, want %d", i, resp.Code, tt.want[i])
+				}
+				if resp.Code == http.StatusTooManyRequests && resp.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d has no Retry-After", i)
+				}
+			}
+		})
+	}
+}
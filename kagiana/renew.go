@@ -0,0 +1,251 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	DefaultRenewMaxSessionAge    = 7 * 24 * time.Hour
+	DefaultRenewClientCertHeader = "X-Client-Cert"
+)
+
+// RenewConfig lets a client renew its cert with the cert itself. The new
+// cert is issued with the token of kagiana, so the role of vault_path must
+// be allowed to it.
+type RenewConfig struct {
+	VaultToken     string `mapstructure:"vault_token"`
+	VaultTokenFile string `mapstructure:"vault_token_file"`
+	// MaxSessionAge caps a chain of renewals, counted from the login which
+	// issued the first cert.
+	MaxSessionAge time.Duration `mapstructure:"max_session_age"`
+	// TrustedProxies are the ingresses allowed to pass the client cert in
+	// ClientCertHeader.
+	TrustedProxies   []string `mapstructure:"trusted_proxies" validate:"dive,cidr"`
+	ClientCertHeader string   `mapstructure:"client_cert_header"`
+}
+
+func (c RenewConfig) Enabled() bool {
+	return c.VaultToken != "" || c.VaultTokenFile != ""
+}
+
+type APIRenewResponse struct {
+	Version   string  `json:"version"`
+	RequestID string  `json:"request_id"`
+	Cert      APICert `json:"cert"`
+}
+
+type Renewer struct {
+	config         *Config
+	vault          *api.Client
+	inventory      *Inventory
+	trustedProxies []*net.IPNet
+}
+
+func NewRenewer(config *Config, vault *api.Client, inventory *Inventory) (*Renewer, error) {
+	rn := &Renewer{config: config, vault: vault, inventory: inventory}
+	for _, cidr := range config.Renew.TrustedProxies {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rn.trustedProxies = append(rn.trustedProxies, n)
+	}
+	return rn, nil
+}
+
+func (rn *Renewer) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, n := range rn.trustedProxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCert returns the cert of the tls connection, or the cert passed by a
+// trusted ingress as url encoded PEM or base64 DER.
+func (rn *Renewer) clientCert(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0], nil
+	}
+
+	header := rn.config.Renew.ClientCertHeader
+	if header == "" {
+		header = DefaultRenewClientCertHeader
+	}
+	v := r.Header.Get(header)
+	if v == "" {
+		return nil, fmt.Errorf("client cert is required")
+	}
+	if !rn.trusted(r) {
+		return nil, fmt.Errorf("%s is not accepted from %s", header, r.RemoteAddr)
+	}
+
+	if unescaped, err := url.QueryUnescape(v); err == nil {
+		v = unescaped
+	}
+	if b, _ := pem.Decode([]byte(v)); b != nil {
+		return x509.ParseCertificate(b.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s", header)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func (rn *Renewer) profile(name string) (Cert, bool) {
+	for _, c := range rn.config.Certs {
+		if c.CommonName == name {
+			return c, true
+		}
+	}
+	return Cert{}, false
+}
+
+func (rn *Renewer) readCert(ctx context.Context, c Cert, serial string) (*api.Secret, error) {
+	p := path.Join(c.ToMountPath(), "cert", serial)
+	ctx, span := startSpan(ctx, "vault.read_cert", attribute.String("vault.path", p))
+	ret, err := rn.vault.Logical().ReadWithContext(ctx, p)
+	endSpan(span, err)
+	if err == nil && ret == nil {
+		err = fmt.Errorf("%s is not found", p)
+	}
+	return ret, err
+}
+
+// verifyChain checks the cert against the ca chain of the PKI mount which
+// issued it, and the revocation state in Vault, which also knows the certs
+// revoked outside of kagiana.
+func (rn *Renewer) verifyChain(ctx context.Context, c Cert, serial string, cert *x509.Certificate) error {
+	ret, err := rn.readCert(ctx, c, "ca_chain")
+	if err != nil {
+		return err
+	}
+	chain, _ := ret.Data["certificate"].(string)
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM([]byte(chain)) {
+		return fmt.Errorf("no ca in the chain of %s", c.ToMountPath())
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return err
+	}
+
+	ret, err = rn.readCert(ctx, c, serial)
+	if err != nil {
+		return err
+	}
+	if t, ok := ret.Data["revocation_time"].(json.Number); ok && t.String() != "0" {
+		return fmt.Errorf("revoked in vault")
+	}
+	return nil
+}
+
+// verify returns the inventory record of a valid, unrevoked cert within the
+// max session age.
+func (rn *Renewer) verify(r *http.Request) (InventoryCert, Cert, *APIError) {
+	cert, err := rn.clientCert(r)
+	if err != nil {
+		return InventoryCert{}, Cert{}, NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s", err.Error())
+	}
+
+	serial := certutil.GetHexFormatted(cert.SerialNumber.Bytes(), ":")
+	ic, ok := rn.inventory.Get(serial)
+	if !ok {
+		return ic, Cert{}, NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "serial %s is not issued by kagiana", serial)
+	}
+	SetRequestUser(r, ic.User, "renew")
+	if ic.Revoked {
+		return ic, Cert{}, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "serial %s is revoked", serial))
+	}
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: ic.User}); apiErr != nil {
+		return ic, Cert{}, apiErr
+	}
+
+	c, ok := rn.profile(ic.Profile)
+	if !ok {
+		return ic, Cert{}, NewAPIError(http.StatusNotFound, ErrCodeNotFound, "profile %s is not configured", ic.Profile)
+	}
+	if err := rn.verifyChain(r.Context(), c, serial, cert); err != nil {
+		return ic, Cert{}, auditLoginFailure(r.Context(), withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "verify serial %s: %s", serial, err.Error())))
+	}
+
+	maxAge := rn.config.Renew.MaxSessionAge
+	if maxAge == 0 {
+		maxAge = DefaultRenewMaxSessionAge
+	}
+	if time.Since(ic.sessionStart()) > maxAge {
+		return ic, Cert{}, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "session of serial %s is older than %s, log in again", serial, maxAge))
+	}
+	return ic, c, nil
+}
+
+func (rn *Renewer) Renew(w http.ResponseWriter, r *http.Request) {
+	requestID := RequestID(r)
+	ic, c, apiErr := rn.verify(r)
+	if apiErr == nil {
+		apiErr = rn.renew(w, r, requestID, ic, c)
+	}
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		RenderAPIError(w, requestID, apiErr)
+	}
+}
+
+func (rn *Renewer) renew(w http.ResponseWriter, r *http.Request, requestID string, ic InventoryCert, c Cert) *APIError {
+	client, err := serviceClient(rn.vault, rn.config.Renew.VaultToken, rn.config.Renew.VaultTokenFile)
+	if err != nil {
+		return NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error())
+	}
+	vlt := &Vault{client: client, config: rn.config}
+
+	cb, err := vlt.issueCert(r.Context(), c)
+	// the new cert stays with the token of the login in the inventory, so
+	// revoking the user still covers it
+	e := AuditEvent{
+		Type:          AuditTypeIssue,
+		Outcome:       AuditOutcomeSuccess,
+		User:          ic.User,
+		TokenAccessor: ic.TokenAccessor,
+		Details:       map[string]string{"renewed_from": ic.SerialNumber},
+	}
+	if err != nil {
+		e.Outcome, e.Error = AuditOutcomeFailure, err.Error()
+		Audit(r.Context(), e)
+		return withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeIssueFailed, "%s renew %s failed: %s", ic.User, c.CommonName, err.Error()))
+	}
+	e.Certs = auditCerts(map[string]*certutil.CertBundle{c.CommonName: cb})
+	Audit(r.Context(), e)
+
+	ac, err := NewAPICert(c.CommonName, cb)
+	if err != nil {
+		return NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s parse cert failed: %s", c.CommonName, err.Error())
+	}
+	Logger(r.Context()).Infof("%s renewed %s from serial %s", ic.User, c.CommonName, ic.SerialNumber)
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, http.StatusOK, &APIRenewResponse{Version: APIVersionV1, RequestID: requestID, Cert: ac})
+	return nil
+}
@@ -0,0 +1,218 @@
+package kagiana
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64) *x509.Certificate {
+	cert, _ := ca.issueWithKey(t, serial)
+	return cert
+}
+
+func (ca *testCA) issueWithKey(t *testing.T, serial int64) (*x509.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "prod.example.com"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestRenewer_Renew(t *testing.T) {
+	ca := newTestCA(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data map[string]interface{}
+		switch r.URL.Path {
+		case "/v1/pki/cert/ca_chain":
+			data = map[string]interface{}{"certificate": ca.pem()}
+		case "/v1/pki/cert/05":
+			data = map[string]interface{}{"revocation_time": 1700000000}
+		case "/v1/pki/cert/01", "/v1/pki/cert/02", "/v1/pki/cert/04", "/v1/pki/cert/06":
+			data = map[string]interface{}{"revocation_time": 0}
+		case "/v1/pki/issue/prod":
+			if r.Header.Get("X-Vault-Token") != "renew-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			cert, key := ca.issueWithKey(t, 10)
+			data = map[string]interface{}{"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), "private_key": key}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		s, _ := json.Marshal(&api.Secret{Data: data})
+		w.Write(s)
+	}))
+	defer ts.Close()
+
+	config := &Config{
+		VaultAddr: ts.URL,
+		Certs:     []Cert{{CommonName: "prod.example.com", Path: "pki/issue/prod"}},
+		Renew: RenewConfig{
+			VaultToken:     "renew-token",
+			MaxSessionAge:  24 * time.Hour,
+			TrustedProxies: []string{"10.0.0.0/8"},
+		},
+	}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+
+	inventory, err := OpenInventory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inventory.Close()
+	now := time.Now().UTC()
+	for serial, issuedAt := range map[string]time.Time{
+		"01": now.Add(-time.Hour),
+		"02": now.Add(-time.Hour),
+		"04": now.Add(-48 * time.Hour),
+		"05": now.Add(-time.Hour),
+		"06": now.Add(-time.Hour),
+	} {
+		inventory.Notify(AuditEvent{
+			Type:          AuditTypeIssue,
+			Outcome:       AuditOutcomeSuccess,
+			User:          "alice",
+			TokenAccessor: "accessor-1",
+			Time:          issuedAt,
+			Certs:         []AuditCert{{Name: "prod.example.com", SerialNumber: serial, NotAfter: now.Add(time.Hour)}},
+		})
+	}
+	inventory.Notify(AuditEvent{Type: AuditTypeRevoke, Outcome: AuditOutcomeSuccess, Time: now, Certs: []AuditCert{{SerialNumber: "06"}}})
+
+	rn, err := NewRenewer(config, vault, inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Auditor{}
+	a.AddNotifier(inventory)
+	h := WithRequestID(WithAuditor(a, func(*http.Request) string { return "192.0.2.1" }, http.HandlerFunc(rn.Renew)))
+
+	certPEM := func(c *x509.Certificate) string {
+		return url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})))
+	}
+	tests := []struct {
+		name       string
+		peer       *x509.Certificate
+		header     string
+		remoteAddr string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "mtls", peer: ca.issue(t, 1), wantStatus: http.StatusOK, wantBody: `"serial_number":"0a"`},
+		{name: "trusted header", header: certPEM(ca.issue(t, 2)), remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusOK},
+		{name: "untrusted header", header: certPEM(ca.issue(t, 2)), remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusUnauthorized},
+		{name: "no cert", wantStatus: http.StatusUnauthorized},
+		{name: "unknown serial", peer: ca.issue(t, 3), wantStatus: http.StatusUnauthorized, wantBody: "not issued by kagiana"},
+		{name: "session too old", peer: ca.issue(t, 4), wantStatus: http.StatusUnauthorized, wantBody: "log in again"},
+		{name: "revoked in vault", peer: ca.issue(t, 5), wantStatus: http.StatusUnauthorized, wantBody: "revoked in vault"},
+		{name: "revoked in inventory", peer: ca.issue(t, 6), wantStatus: http.StatusUnauthorized, wantBody: "is revoked"},
+		{name: "other ca", peer: newTestCA(t).issue(t, 1), wantStatus: http.StatusUnauthorized, wantBody: "unknown authority"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/renew", nil)
+			if tt.peer != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tt.peer}}
+			}
+			if tt.header != "" {
+				req.Header.Set(DefaultRenewClientCertHeader, tt.header)
+			}
+			if tt.remoteAddr != "" {
+				req.RemoteAddr = tt.remoteAddr
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	renewed, ok := inventory.Get("0a")
+	if !ok {
+		t.Fatal("renewed cert is not in the inventory")
+	}
+	if renewed.User != "alice" || renewed.TokenAccessor != "accessor-1" {
+		t.Errorf("renewed = %+v, want the identity of the login", renewed)
+	}
+	if from, _ := inventory.Get(renewed.RenewedFrom); !renewed.SessionStart.Equal(from.sessionStart()) {
+		t.Errorf("session start = %s, want %s", renewed.SessionStart, from.sessionStart())
+	}
+}
@@ -0,0 +1,260 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	DefaultSAMLEmailAttribute  = "email"
+	DefaultSAMLGroupsAttribute = "groups"
+	samlMetadataTimeout        = 10 * time.Second
+)
+
+// SAMLConfig configures kagiana as a SAML service provider. The user is
+// NameID unless UserAttribute is set. Attributes match by name or friendly
+// name.
+type SAMLConfig struct {
+	IDPMetadataURL  string `mapstructure:"idp_metadata_url"`
+	IDPMetadataFile string `mapstructure:"idp_metadata_file"`
+	EntityID        string `mapstructure:"entity_id"`
+	CertFile        string `mapstructure:"cert_file"`
+	KeyFile         string `mapstructure:"key_file"`
+	UserAttribute   string `mapstructure:"user_attribute"`
+	EmailAttribute  string `mapstructure:"email_attribute"`
+	GroupsAttribute string `mapstructure:"groups_attribute"`
+}
+
+type AuthSAML struct {
+	config   *Config
+	provider ProviderConfig
+	sp       *saml.ServiceProvider
+	vault    *api.Client
+	getCert  func(http.ResponseWriter, *http.Request, *Vault)
+}
+
+func loadIDPMetadata(ctx context.Context, c SAMLConfig) (*saml.EntityDescriptor, error) {
+	if c.IDPMetadataFile != "" {
+		b, err := os.ReadFile(c.IDPMetadataFile)
+		if err != nil {
+			return nil, err
+		}
+		return samlsp.ParseMetadata(b)
+	}
+	if c.IDPMetadataURL == "" {
+		return nil, fmt.Errorf("idp_metadata_url or idp_metadata_file is required")
+	}
+	u, err := url.Parse(c.IDPMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, samlMetadataTimeout)
+	defer cancel()
+	return samlsp.FetchMetadata(ctx, tracedHTTPClient, *u)
+}
+
+func NewSAML(config *Config, p ProviderConfig, vault *api.Client) (*AuthSAML, error) {
+	keyPair, err := tls.LoadX509KeyPair(p.SAML.CertFile, p.SAML.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %s", p.Name, err.Error())
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("provider %s: key_file must be a rsa key", p.Name)
+	}
+	cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	idp, err := loadIDPMetadata(context.Background(), p.SAML)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: idp metadata: %s", p.Name, err.Error())
+	}
+
+	prefix := externalURL(config, "/auth/"+p.Name)
+	metadataURL, err := url.Parse(prefix + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(prefix + "/callback")
+	if err != nil {
+		return nil, err
+	}
+	return &AuthSAML{
+		config:   config,
+		provider: p,
+		sp: &saml.ServiceProvider{
+			EntityID:    p.SAML.EntityID,
+			Key:         key,
+			Certificate: cert,
+			MetadataURL: *metadataURL,
+			AcsURL:      *acsURL,
+			IDPMetadata: idp,
+			HTTPClient:  tracedHTTPClient,
+		},
+		vault:   vault,
+		getCert: getCert,
+	}, nil
+}
+
+func (s *AuthSAML) Metadata(w http.ResponseWriter, r *http.Request) {
+	b, err := xml.MarshalIndent(s.sp.Metadata(), "", "  ")
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(b)
+}
+
+// Login redirects to the IdP with an AuthnRequest, whose id is kept in the
+// state cookie to check the InResponseTo of the assertion.
+func (s *AuthSAML) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := newLoginState(r)
+	if err != nil {
+		renderRequestError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	req, err := s.sp.MakeAuthenticationRequest(s.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	state.RequestID = req.ID
+	u, err := req.Redirect(state.Nonce, s.sp)
+	if err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := setLoginState(w, r, s.config, state); err != nil {
+		renderRequestError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Callback is the assertion consumer service of the POST binding.
+func (s *AuthSAML) Callback(w http.ResponseWriter, r *http.Request) {
+	SetRequestUser(r, "", "saml")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+	if r.Method != http.MethodPost {
+		failLogin(w, r, NewAPIError(http.StatusMethodNotAllowed, ErrCodeInvalidRequest, "the SAML response must be posted"))
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		failLogin(w, r, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
+		return
+	}
+
+	// the POST from the IdP is cross-site, so the browser holds back the
+	// cookies until it is posted again from here
+	if _, err := r.Cookie(CookieKey); err != nil && r.PostForm.Get("reposted") == "" {
+		renderSAMLPost(w, r.URL.Path, r.PostForm.Get("SAMLResponse"), r.PostForm.Get("RelayState"))
+		return
+	}
+
+	state, apiErr := takeLoginState(w, r, s.config, r.PostForm.Get("RelayState"))
+	if apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	assertion, err := s.sp.ParseResponse(r, []string{state.RequestID})
+	if err != nil {
+		var ire *saml.InvalidResponseError
+		if errors.As(err, &ire) && ire.PrivateErr != nil {
+			err = ire.PrivateErr
+		}
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "invalid SAML response: %s", err.Error())))
+		return
+	}
+
+	id := s.identity(assertion)
+	if id.User == "" {
+		failLogin(w, r, auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "SAML assertion has no user")))
+		return
+	}
+	SetRequestUser(r, id.User, "saml")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: id.User}); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+	if apiErr := checkAllowedGroups(r.Context(), s.provider, id); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	vlt, err := exchangeVaultToken(r.Context(), s.vault, s.config, s.provider, id)
+	if err != nil {
+		failLogin(w, r, withContextAPIError(r.Context(), NewAPIError(http.StatusBadGateway, ErrCodeUnauthorized, "%s", err.Error())))
+		return
+	}
+	if apiErr := checkVaultUser(r.Context(), vlt); apiErr != nil {
+		failLogin(w, r, apiErr)
+		return
+	}
+
+	s.getCert(w, withReturnTo(r, state.ReturnTo), vlt)
+}
+
+func samlAttribute(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, stmt := range assertion.AttributeStatements {
+		for _, attr := range stmt.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, v := range attr.Values {
+				if v.Value != "" {
+					values = append(values, v.Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+func (s *AuthSAML) identity(assertion *saml.Assertion) Identity {
+	c := s.provider.SAML
+	id := Identity{}
+	if c.UserAttribute != "" {
+		if v := samlAttribute(assertion, c.UserAttribute); len(v) > 0 {
+			id.User = v[0]
+		}
+	} else if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		id.User = strings.TrimSpace(assertion.Subject.NameID.Value)
+	}
+
+	emailAttribute := c.EmailAttribute
+	if emailAttribute == "" {
+		emailAttribute = DefaultSAMLEmailAttribute
+	}
+	if v := samlAttribute(assertion, emailAttribute); len(v) > 0 {
+		id.Email = v[0]
+	}
+
+	groupsAttribute := c.GroupsAttribute
+	if groupsAttribute == "" {
+		groupsAttribute = DefaultSAMLGroupsAttribute
+	}
+	id.Groups = samlAttribute(assertion, groupsAttribute)
+	return id
+}
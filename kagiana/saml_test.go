@@ -0,0 +1,270 @@
+package kagiana
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/hashicorp/vault/api"
+)
+
+func newTestRSAKeyPair(t *testing.T, cn string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+type testSAMLSession struct{ session *saml.Session }
+
+func (s *testSAMLSession) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	return s.session
+}
+
+type testSAMLServiceProviders struct{ sp *AuthSAML }
+
+func (p *testSAMLServiceProviders) GetServiceProvider(r *http.Request, id string) (*saml.EntityDescriptor, error) {
+	return p.sp.sp.Metadata(), nil
+}
+
+var samlFormValue = regexp.MustCompile(`name="(SAMLResponse|RelayState)" value="([^"]*)"`)
+
+func TestAuthSAML(t *testing.T) {
+	idpKey, idpCert := newTestRSAKeyPair(t, "idp.example.com")
+	spKey, spCert := newTestRSAKeyPair(t, "kagiana.example.com")
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "sp.crt"), filepath.Join(dir, "sp.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: spCert.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(spKey)}), 0600)
+
+	session := &testSAMLSession{}
+	providers := &testSAMLServiceProviders{}
+	idp := &saml.IdentityProvider{
+		Key:                     idpKey,
+		Certificate:             idpCert,
+		Logger:                  logger.DefaultLogger,
+		SessionProvider:         session,
+		ServiceProviderProvider: providers,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			idp.ServeMetadata(w, r)
+		case "/sso":
+			idp.ServeSSO(w, r)
+		}
+	}))
+	defer ts.Close()
+	metadataURL, _ := url.Parse(ts.URL + "/metadata")
+	ssoURL, _ := url.Parse(ts.URL + "/sso")
+	idp.MetadataURL, idp.SSOURL = *metadataURL, *ssoURL
+
+	tv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&body)
+		meta, _ := body["meta"].(map[string]interface{})
+		if r.URL.Path != "/v1/auth/token/create/kagiana-saml" || r.Header.Get("X-Vault-Token") != "kagiana-token" || meta["groups"] != "staff,sre" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(&api.Secret{Auth: &api.SecretAuth{ClientToken: "saml-token", Metadata: map[string]string{"username": "alice"}}})
+	}))
+	defer tv.Close()
+
+	config := &Config{VaultAddr: tv.URL, ExternalURL: "https://kagiana.example.com"}
+	vault, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+	p := ProviderConfig{
+		Name:           "corp",
+		Type:           "saml",
+		VaultLogin:     "token",
+		VaultToken:     "kagiana-token",
+		VaultTokenRole: "kagiana-saml",
+		AllowedGroups:  []string{"sre"},
+		SAML: SAMLConfig{
+			IDPMetadataURL:  metadataURL.String(),
+			CertFile:        certFile,
+			KeyFile:         keyFile,
+			UserAttribute:   "uid",
+			GroupsAttribute: "eduPersonAffiliation",
+		},
+	}
+	sp, err := NewSAML(config.ForProvider(p), p, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers.sp = sp
+	issued := ""
+	sp.getCert = func(w http.ResponseWriter, r *http.Request, vlt *Vault) {
+		issued = vlt.UserName()
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	sp.Metadata(w, httptest.NewRequest(http.MethodGet, "/auth/corp/metadata", nil))
+	if !strings.Contains(w.Body.String(), `Location="https://kagiana.example.com/auth/corp/callback"`) {
+		t.Errorf("metadata = %s", w.Body.String())
+	}
+
+	// login returns the state cookie and the form posted by the IdP
+	login := func(t *testing.T, s *saml.Session) (*http.Cookie, url.Values) {
+		session.session = s
+		w := httptest.NewRecorder()
+		sp.Login(w, httptest.NewRequest(http.MethodGet, "/auth/corp/login", nil))
+		if w.Code != http.StatusFound {
+			t.Fatalf("login status = %d", w.Code)
+		}
+		w2 := httptest.NewRecorder()
+		idp.ServeSSO(w2, httptest.NewRequest(http.MethodGet, w.Header().Get("Location"), nil))
+		form := url.Values{}
+		for _, m := range samlFormValue.FindAllStringSubmatch(w2.Body.String(), -1) {
+			form.Set(m[1], html.UnescapeString(m[2]))
+		}
+		if form.Get("SAMLResponse") == "" {
+			t.Fatalf("idp response = %s", w2.Body.String())
+		}
+		return w.Result().Cookies()[0], form
+	}
+	callback := func(cookie *http.Cookie, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/corp/callback", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		sp.Callback(w, req)
+		return w
+	}
+	alice := &saml.Session{ID: "1", NameID: "alice@example.com", UserName: "alice", Groups: []string{"staff", "sre"}}
+
+	tests := []struct {
+		name       string
+		run        func(t *testing.T) *httptest.ResponseRecorder
+		wantStatus int
+		wantBody   string
+		wantIssued string
+	}{
+		{
+			name: "cross-site post is posted again",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				_, form := login(t, alice)
+				return callback(nil, form)
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `name="reposted"`,
+		},
+		{
+			name: "login",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, form := login(t, alice)
+				form.Set("reposted", "1")
+				return callback(cookie, form)
+			},
+			wantStatus: http.StatusOK,
+			wantIssued: "alice",
+		},
+		{
+			name: "response of another login",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, _ := login(t, alice)
+				_, form := login(t, alice)
+				return callback(cookie, form)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "state mismatch",
+		},
+		{
+			name: "replayed request id",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, _ := login(t, alice)
+				_, form := login(t, alice)
+				s, _ := openOAuthState(sp.config, cookie.Value)
+				s.Nonce = form.Get("RelayState")
+				v, _ := sealOAuthState(sp.config, s)
+				return callback(&http.Cookie{Name: CookieKey, Value: v}, form)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "possible request IDs",
+		},
+		{
+			name: "tampered response",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, form := login(t, alice)
+				b, _ := base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+				form.Set("SAMLResponse", base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(b), "Success", "Succes", 1))))
+				return callback(cookie, form)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "invalid SAML response",
+		},
+		{
+			name: "expired",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, form := login(t, alice)
+				saml.TimeNow = func() time.Time { return time.Now().Add(time.Hour) }
+				defer func() { saml.TimeNow = time.Now }()
+				return callback(cookie, form)
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "expired",
+		},
+		{
+			name: "not in allowed groups",
+			run: func(t *testing.T) *httptest.ResponseRecorder {
+				cookie, form := login(t, &saml.Session{ID: "2", NameID: "bob@example.com", UserName: "bob", Groups: []string{"staff"}})
+				return callback(cookie, form)
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued = ""
+			w := tt.run(t)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want %s", w.Body.String(), tt.wantBody)
+			}
+			if issued != tt.wantIssued {
+				t.Errorf("issued = %q, want %q", issued, tt.wantIssued)
+			}
+		})
+	}
+}
@@ -1,25 +1,141 @@
 package kagiana
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/STNS/libstns-go/libstns"
-	"github.com/sirupsen/logrus"
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type STNS struct {
 	config    *Config
 	tokenType string
+	client    *libstns.STNS
+	keys      *UserKeyCache
+	vault     *api.Client
 }
 
-func NewSTNS(config *Config, tokenType string) *STNS {
+func NewSTNS(config *Config, tokenType string, vault *api.Client) (*STNS, error) {
+	keys, err := NewSTNSKeyCache(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewSTNSWithCache(config, tokenType, vault, keys)
+}
+
+// NewSTNSWithCache shares the key cache, which can outlive the config.
+func NewSTNSWithCache(config *Config, tokenType string, vault *api.Client, keys *UserKeyCache) (*STNS, error) {
+	client, err := newSTNSClient(config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &STNS{
 		config:    config,
 		tokenType: tokenType,
+		client:    client,
+		keys:      keys,
+		vault:     vault,
+	}, nil
+}
+
+// NewSTNSKeyCache caches the keys of the users of the stns server of the
+// config.
+func NewSTNSKeyCache(config *Config) (*UserKeyCache, error) {
+	client, err := newSTNSClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewUserKeyCache(config.STNSCacheTTL, config.STNSNegativeCacheTTL, config.STNSCacheSize, func(userName string) ([]string, error) {
+		user, err := client.GetUserByName(userName)
+		if err != nil {
+			return nil, err
+		}
+		return user.Keys, nil
+	}), nil
+}
+
+// newSTNSClient passes a copy of the options, which libstns fills with the
+// defaults, so the config is left as loaded.
+func newSTNSClient(config *Config) (*libstns.STNS, error) {
+	opt := config.STNSOptions
+	return libstns.NewSTNS(config.STNSEndpoint, &opt)
+}
+
+func (s *STNS) InvalidateUser(userName string) {
+	s.keys.Invalidate(userName)
+}
+
+// stnsRefetchMinAge keeps bad signatures from refetching the keys of a user
+// from STNS on every request.
+const stnsRefetchMinAge = 30 * time.Second
+
+// verifyWithUser verifies the signature with the cached public keys of the user.
+// When the cached keys don't match, they are refetched once because the user
+// may have just registered a new key, unless they were fetched within
+// stnsRefetchMinAge.
+func (s *STNS) verifyWithUser(ctx context.Context, userName string, msg, signature []byte) error {
+	var keys []string
+	var cached bool
+	err := withContext(ctx, func() error {
+		k, c, err := s.getUserKeys(ctx, userName)
+		keys, cached = k, c
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.verify(ctx, msg, keys, signature)
+	if err == nil || !cached {
+		return err
+	}
+
+	if !s.keys.InvalidateOlderThan(userName, stnsRefetchMinAge) {
+		return err
+	}
+	err = withContext(ctx, func() error {
+		k, _, err := s.getUserKeys(ctx, userName)
+		keys = k
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.verify(ctx, msg, keys, signature)
+}
+
+func (s *STNS) getUserKeys(ctx context.Context, userName string) ([]string, bool, error) {
+	_, span := startSpan(ctx, "stns.get_user_keys", attribute.String("stns.user", userName))
+	keys, cached, err := s.keys.Get(userName)
+	span.SetAttributes(attribute.Bool("stns.cached", cached))
+	endSpan(span, err)
+	return keys, cached, err
+}
+
+func (s *STNS) verify(ctx context.Context, msg []byte, keys []string, signature []byte) error {
+	if d := denylistFrom(ctx); d != nil {
+		var denied []DenyEntry
+		keys, denied = d.FilterKeys(keys)
+		for _, e := range denied {
+			Logger(ctx).Warnf("skip the denied key %s", e.Value)
+		}
+		if len(keys) == 0 && len(denied) > 0 {
+			return fmt.Errorf("all keys are denied")
+		}
 	}
+
+	_, span := startSpan(ctx, "stns.verify", attribute.Int("stns.keys", len(keys)))
+	err := s.client.Verify(msg, []byte(strings.Join(keys, "\n")), signature)
+	endSpan(span, err)
+	return err
 }
 
 type STNSResponce struct {
@@ -27,148 +143,255 @@ type STNSResponce struct {
 	Certs map[string]map[string]string
 }
 
-func (s *STNS) getCertsAndToken(userName, userToken string) (map[string]map[string]string, string, error) {
-	vlt, err := NewVault(s.config, map[string]string{s.tokenType: userToken})
+func (s *STNS) issue(ctx context.Context, userName, userToken string) (*Vault, map[string]*certutil.CertBundle, map[string]string, *APIError) {
+	if apiErr := checkGitHubToken(ctx, s.config, userName, userToken); apiErr != nil {
+		return nil, nil, nil, apiErr
+	}
+	vlt, err := NewVault(ctx, s.vault, s.config, map[string]string{s.tokenType: userToken})
 	if err != nil {
-		return nil, "", fmt.Errorf("%s vault login failed: %s", userName, err.Error())
+		return nil, nil, nil, withContextAPIError(ctx, NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s vault login failed: %s", userName, err.Error()))
+	}
+	if apiErr := checkVaultUser(ctx, vlt); apiErr != nil {
+		return nil, nil, nil, apiErr
 	}
 
-	cbs, err := vlt.CreateCert()
-	if err != nil {
-		return nil, "", fmt.Errorf("%s create cert failed: %s", userName, err.Error())
+	cbs, err := vlt.CreateCert(ctx)
+	if len(cbs) == 0 && err != nil {
+		return nil, nil, nil, withContextAPIError(ctx, NewAPIError(http.StatusUnauthorized, ErrCodeIssueFailed, "%s create cert failed: %s", userName, err.Error()))
 	}
 
+	var failures map[string]string
+	if issueErr, ok := err.(*IssueError); ok {
+		Logger(ctx).Warnf("%s create cert partially failed: %s", userName, issueErr.Error())
+		failures = issueErr.Failures()
+	}
+	return vlt, cbs, failures, nil
+}
+
+func (s *STNS) getCertsAndToken(ctx context.Context, userName, userToken string) (map[string]map[string]string, string, *APIError) {
+	vlt, cbs, _, apiErr := s.issue(ctx, userName, userToken)
+	if apiErr != nil {
+		return nil, "", apiErr
+	}
+
+	return legacyCerts(cbs), vlt.Token(), nil
+}
+
+// legacyCerts returns the certs in the format of the legacy endpoints.
+func legacyCerts(cbs map[string]*certutil.CertBundle) map[string]map[string]string {
 	certs := map[string]map[string]string{}
 	for name, cb := range cbs {
 		certs[name] = map[string]string{
-			"ca":   strings.Join(cb.CAChain, "\\n"),
+			"ca":   CAChainPEM(cb.CAChain),
 			"cert": cb.Certificate,
 			"key":  cb.PrivateKey,
 		}
 	}
+	return certs
+}
 
-	return certs, vlt.Token(), nil
+func (s *STNS) challenge(r *http.Request) (string, []byte, *APIError) {
+	if err := r.ParseForm(); err != nil {
+		return "", nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
+	}
 
-}
-func (s *STNS) Call(w http.ResponseWriter, r *http.Request) {
-	stns, err := libstns.NewSTNS(s.config.STNSEndpoint, &s.config.STNSOptions)
+	userName := r.FormValue("user")
+	if userName == "" {
+		return "", nil, NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "should set userName")
+	}
 
+	SetRequestUser(r, userName, "stns")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: userName}); apiErr != nil {
+		return userName, nil, apiErr
+	}
+	var code []byte
+	err := withContext(r.Context(), func() error {
+		_, span := startSpan(r.Context(), "stns.create_challenge_code", attribute.String("stns.user", userName))
+		c, err := s.client.CreateUserChallengeCode(userName)
+		endSpan(span, err)
+		code = c
+		return err
+	})
+	outcome, msg := auditOutcome(err)
+	Audit(r.Context(), AuditEvent{Type: AuditTypeChallenge, Outcome: outcome, Error: msg})
 	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return userName, nil, withContextAPIError(r.Context(), NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error()))
 	}
+
+	Logger(r.Context()).Infof("%s get challenge code", userName)
+	return userName, code, nil
+}
+
+// verifyChallenge checks the signature of a challenge code previously
+// handed out by challenge and returns the user name and token.
+func (s *STNS) verifyChallenge(r *http.Request) (string, string, *APIError) {
 	if err := r.ParseForm(); err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return "", "", NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
 	}
 
 	userName := r.FormValue("user")
 	userToken := r.FormValue("token")
-	if err := stns.VerifyWithUser(userName, []byte(userToken), []byte(r.FormValue("signature"))); err != nil {
-		logrus.Errorf("%s verify failed: %s", userName, err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	SetRequestUser(r, userName, "stns")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: userName}); apiErr != nil {
+		return userName, "", apiErr
+	}
+	challengeCode := r.FormValue("code")
+	if err := s.verifyWithUser(r.Context(), userName, []byte(challengeCode), []byte(r.FormValue("signature"))); err != nil {
+		stnsVerifyTotal.WithLabelValues(stnsVerifyFailure).Inc()
+		return userName, "", auditLoginFailure(r.Context(), withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s verify failed: %s", userName, err.Error())))
 	}
 
-	logrus.Infof("login successfully %s", userName)
-	s.ResponceCerts(w, r, userName, userToken)
+	_, span := startSpan(r.Context(), "stns.pop_challenge_code", attribute.String("stns.user", userName))
+	code, err := s.client.PopUserChallengeCode(userName)
+	endSpan(span, err)
+	if err != nil {
+		return userName, "", auditLoginFailure(r.Context(), NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s can't pop challenge code", userName))
+	}
+
+	if string(code) != challengeCode {
+		stnsVerifyTotal.WithLabelValues(stnsVerifyMismatch).Inc()
+		return userName, "", auditLoginFailure(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeChallengeMismatch, "%s missmatch challenge code", userName))
+	}
+
+	stnsVerifyTotal.WithLabelValues(stnsVerifySuccess).Inc()
+	Logger(r.Context()).Infof("%s verify success", userName)
+	return userName, userToken, nil
 }
 
-func (s *STNS) Challenge(w http.ResponseWriter, r *http.Request) {
-	stns, err := libstns.NewSTNS(s.config.STNSEndpoint, &s.config.STNSOptions)
+func auditLoginFailure(ctx context.Context, apiErr *APIError) *APIError {
+	Audit(ctx, AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeFailure, Error: apiErr.Message})
+	return apiErr
+}
 
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+// verifyToken checks a signature made directly over the user token.
+func (s *STNS) verifyToken(r *http.Request) (string, string, *APIError) {
 	if err := r.ParseForm(); err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+		return "", "", NewAPIError(http.StatusBadRequest, ErrCodeInvalidRequest, "%s", err.Error())
 	}
 
 	userName := r.FormValue("user")
+	userToken := r.FormValue("token")
+	SetRequestUser(r, userName, "stns")
+	if apiErr := CheckDenylist(r.Context(), DenyQuery{User: userName}); apiErr != nil {
+		return userName, "", apiErr
+	}
+	if err := s.verifyWithUser(r.Context(), userName, []byte(userToken), []byte(r.FormValue("signature"))); err != nil {
+		stnsVerifyTotal.WithLabelValues(stnsVerifyFailure).Inc()
+		return userName, "", auditLoginFailure(r.Context(), withContextAPIError(r.Context(), NewAPIError(http.StatusUnauthorized, ErrCodeUnauthorized, "%s verify failed: %s", userName, err.Error())))
+	}
 
-	if userName == "" {
-		logrus.Error("should set userName")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	stnsVerifyTotal.WithLabelValues(stnsVerifySuccess).Inc()
+	Logger(r.Context()).Infof("login successfully %s", userName)
+	return userName, userToken, nil
+}
 
-	}
-	code, err := stns.CreateUserChallengeCode(userName)
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
+func (s *STNS) Call(w http.ResponseWriter, r *http.Request) {
+	userName, userToken, apiErr := s.verifyToken(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		w.WriteHeader(apiErr.Status)
 		return
 	}
+	s.ResponceCerts(w, r, userName, userToken)
+}
 
-	logrus.Infof("%s get challenge code", userName)
-	fmt.Fprintf(w, string(code))
+func (s *STNS) Challenge(w http.ResponseWriter, r *http.Request) {
+	_, code, apiErr := s.challenge(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		w.WriteHeader(apiErr.Status)
+		return
+	}
+	w.Write(code)
 }
 
 func (s *STNS) Verify(w http.ResponseWriter, r *http.Request) {
-	stns, err := libstns.NewSTNS(s.config.STNSEndpoint, &s.config.STNSOptions)
-
-	if err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusInternalServerError)
+	userName, userToken, apiErr := s.verifyChallenge(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		w.WriteHeader(apiErr.Status)
 		return
 	}
-	if err := r.ParseForm(); err != nil {
-		logrus.Error(err)
-		w.WriteHeader(http.StatusBadRequest)
+	s.ResponceCerts(w, r, userName, userToken)
+}
+
+func (s *STNS) ResponceCerts(w http.ResponseWriter, r *http.Request, userName, userToken string) {
+	certs, token, apiErr := s.getCertsAndToken(r.Context(), userName, userToken)
+	if apiErr != nil {
+		logRequestError(r, fmt.Errorf("%s vault auth failed: %s", userName, apiErr.Message))
+		w.WriteHeader(apiErr.Status)
 		return
 	}
 
-	userName := r.FormValue("user")
-	userToken := r.FormValue("token")
-	challengeCode := r.FormValue("code")
-	if err := stns.VerifyWithUser(userName, []byte(challengeCode), []byte(r.FormValue("signature"))); err != nil {
-		logrus.Errorf("%s verify failed: %s", userName, err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+	ret := STNSResponce{
+		Token: token,
+		Certs: certs,
 	}
 
-	code, err := stns.PopUserChallengeCode(userName)
+	b, err := json.Marshal(&ret)
 	if err != nil {
+		Logger(r.Context()).Errorf("%s json marshal failed: %s", userName, err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
-		logrus.Warnf("%s can't pop challenge code", userName)
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
 
-	if string(code) == r.FormValue("code") {
-		s.ResponceCerts(w, r, userName, userToken)
-		logrus.Infof("%s verify success", userName)
+func (s *STNS) ChallengeV1(w http.ResponseWriter, r *http.Request) {
+	requestID := RequestID(r)
+	userName, code, apiErr := s.challenge(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		RenderAPIError(w, requestID, apiErr)
 		return
 	}
-	logrus.Warnf("%s missmatch challenge code", userName)
 
-	w.WriteHeader(http.StatusInternalServerError)
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, http.StatusOK, &APIChallengeResponse{
+		Version:   APIVersionV1,
+		RequestID: requestID,
+		User:      userName,
+		Challenge: string(code),
+	})
 }
 
-func (s *STNS) ResponceCerts(w http.ResponseWriter, r *http.Request, userName, userToken string) {
-	certs, token, err := s.getCertsAndToken(userName, userToken)
-	if err != nil {
-		logrus.Errorf("%s vault auth failed: %s", userName, err.Error())
-		w.WriteHeader(http.StatusUnauthorized)
+func (s *STNS) VerifyV1(w http.ResponseWriter, r *http.Request) {
+	userName, userToken, apiErr := s.verifyChallenge(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		RenderAPIError(w, RequestID(r), apiErr)
 		return
 	}
+	s.responseV1(w, r, userName, userToken)
+}
 
-	ret := STNSResponce{
-		Token: token,
+func (s *STNS) CallV1(w http.ResponseWriter, r *http.Request) {
+	userName, userToken, apiErr := s.verifyToken(r)
+	if apiErr != nil {
+		logRequestError(r, apiErr)
+		RenderAPIError(w, RequestID(r), apiErr)
+		return
 	}
+	s.responseV1(w, r, userName, userToken)
+}
 
-	ret.Certs = certs
-	w.WriteHeader(http.StatusOK)
+func (s *STNS) responseV1(w http.ResponseWriter, r *http.Request, userName, userToken string) {
+	requestID := RequestID(r)
+	vlt, cbs, failures, apiErr := s.issue(r.Context(), userName, userToken)
+	if apiErr != nil {
+		logRequestError(r, fmt.Errorf("%s vault auth failed: %s", userName, apiErr.Message))
+		RenderAPIError(w, requestID, apiErr)
+		return
+	}
 
-	b, err := json.Marshal(&ret)
+	ret, err := NewAPIResponse(requestID, vlt, cbs, failures)
 	if err != nil {
-		logrus.Errorf("%s json marshal failed: %s", userName, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		Logger(r.Context()).Error(err)
+		RenderAPIError(w, requestID, NewAPIError(http.StatusInternalServerError, ErrCodeInternal, "%s", err.Error()))
 		return
 	}
-	fmt.Fprintf(w, string(b))
+
+	w.Header().Set(RequestIDHeader, requestID)
+	RenderJSON(w, http.StatusOK, ret)
 }
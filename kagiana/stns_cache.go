@@ -0,0 +1,212 @@
+package kagiana
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultSTNSCacheTTL         = 5 * time.Minute
+	DefaultSTNSNegativeCacheTTL = 30 * time.Second
+	DefaultSTNSCacheSize        = 10000
+)
+
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Evictions    uint64
+}
+
+func (s CacheStats) Add(o CacheStats) CacheStats {
+	return CacheStats{
+		Hits:         s.Hits + o.Hits,
+		NegativeHits: s.NegativeHits + o.NegativeHits,
+		Misses:       s.Misses + o.Misses,
+		Evictions:    s.Evictions + o.Evictions,
+	}
+}
+
+type userKeyEntry struct {
+	keys    []string
+	err     error
+	fetched time.Time
+	expires time.Time
+}
+
+type userKeyCall struct {
+	wg   sync.WaitGroup
+	keys []string
+	err  error
+}
+
+// UserKeyCache caches public keys of STNS users. Lookups of unknown users
+// are cached for a shorter period, and concurrent misses for the same user
+// share a single request to the STNS server. Expired entries are swept once
+// per ttl, and the entry closest to expiry is evicted when the cache is full,
+// so names made up by clients can't grow it without bound.
+type UserKeyCache struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	nextSweep   time.Time
+	entries     map[string]*userKeyEntry
+	inflight    map[string]*userKeyCall
+	fetch       func(string) ([]string, error)
+	now         func() time.Time
+
+	hits         uint64
+	negativeHits uint64
+	misses       uint64
+	evictions    uint64
+}
+
+func NewUserKeyCache(ttl, negativeTTL time.Duration, size int, fetch func(string) ([]string, error)) *UserKeyCache {
+	if ttl == 0 {
+		ttl = DefaultSTNSCacheTTL
+	}
+	if negativeTTL == 0 {
+		negativeTTL = DefaultSTNSNegativeCacheTTL
+	}
+	if size == 0 {
+		size = DefaultSTNSCacheSize
+	}
+	return &UserKeyCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		entries:     map[string]*userKeyEntry{},
+		inflight:    map[string]*userKeyCall{},
+		fetch:       fetch,
+		now:         time.Now,
+	}
+}
+
+// Get returns the keys of the user and whether they came from the cache.
+func (c *UserKeyCache) Get(name string) ([]string, bool, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[name]; ok {
+		if c.now().Before(e.expires) {
+			c.mu.Unlock()
+			if e.err != nil {
+				atomic.AddUint64(&c.negativeHits, 1)
+			} else {
+				atomic.AddUint64(&c.hits, 1)
+			}
+			return e.keys, true, e.err
+		}
+		delete(c.entries, name)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+
+	if call, ok := c.inflight[name]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		atomic.AddUint64(&c.hits, 1)
+		return call.keys, true, call.err
+	}
+
+	call := &userKeyCall{}
+	call.wg.Add(1)
+	c.inflight[name] = call
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	call.keys, call.err = c.fetch(name)
+	call.wg.Done()
+
+	c.mu.Lock()
+	delete(c.inflight, name)
+	switch {
+	case call.err == nil:
+		c.add(name, &userKeyEntry{keys: call.keys, fetched: c.now(), expires: c.now().Add(c.ttl)})
+	case isUserNotFound(call.err):
+		c.add(name, &userKeyEntry{err: call.err, fetched: c.now(), expires: c.now().Add(c.negativeTTL)})
+	}
+	c.mu.Unlock()
+
+	return call.keys, false, call.err
+}
+
+// add stores the entry with c.mu held.
+func (c *UserKeyCache) add(name string, e *userKeyEntry) {
+	now := c.now()
+	if !now.Before(c.nextSweep) {
+		c.sweep(now)
+		c.nextSweep = now.Add(c.ttl)
+	}
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= c.size {
+		c.evictOldest()
+	}
+	c.entries[name] = e
+}
+
+func (c *UserKeyCache) sweep(now time.Time) {
+	for name, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, name)
+			atomic.AddUint64(&c.evictions, 1)
+		}
+	}
+}
+
+func (c *UserKeyCache) evictOldest() {
+	var oldest string
+	var expires time.Time
+	for name, e := range c.entries {
+		if oldest == "" || e.expires.Before(expires) {
+			oldest, expires = name, e.expires
+		}
+	}
+	delete(c.entries, oldest)
+	atomic.AddUint64(&c.evictions, 1)
+}
+
+func (c *UserKeyCache) Invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[name]; ok {
+		delete(c.entries, name)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// InvalidateOlderThan drops the keys of the user only when they were fetched
+// at least minAge ago, and returns whether they are no longer cached.
+func (c *UserKeyCache) InvalidateOlderThan(name string, minAge time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return true
+	}
+	if c.now().Sub(e.fetched) < minAge {
+		return false
+	}
+	delete(c.entries, name)
+	atomic.AddUint64(&c.evictions, 1)
+	return true
+}
+
+func (c *UserKeyCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	atomic.AddUint64(&c.evictions, uint64(len(c.entries)))
+	c.entries = map[string]*userKeyEntry{}
+}
+
+func (c *UserKeyCache) Stats() CacheStats {
+	return CacheStats{
+		Hits:         atomic.LoadUint64(&c.hits),
+		NegativeHits: atomic.LoadUint64(&c.negativeHits),
+		Misses:       atomic.LoadUint64(&c.misses),
+		Evictions:    atomic.LoadUint64(&c.evictions),
+	}
+}
+
+func isUserNotFound(err error) bool {
+	return err.Error() == "user not found" || strings.HasPrefix(err.Error(), "status code=404")
+}
@@ -0,0 +1,177 @@
+package kagiana
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserKeyCache_Get(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      string
+		advance   time.Duration
+		wantKeys  []string
+		wantErr   bool
+		wantFetch int
+	}{
+		{
+			name:      "hit",
+			user:      "alice",
+			wantKeys:  []string{"ssh-ed25519 alice"},
+			wantFetch: 1,
+		},
+		{
+			name:      "expired",
+			user:      "alice",
+			advance:   2 * time.Minute,
+			wantKeys:  []string{"ssh-ed25519 alice"},
+			wantFetch: 2,
+		},
+		{
+			name:      "negative hit",
+			user:      "unknown",
+			wantErr:   true,
+			wantFetch: 1,
+		},
+		{
+			name:      "negative expired",
+			user:      "unknown",
+			advance:   20 * time.Second,
+			wantErr:   true,
+			wantFetch: 2,
+		},
+		{
+			name:      "transport error is not cached",
+			user:      "broken",
+			wantErr:   true,
+			wantFetch: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetched := 0
+			now := time.Now()
+			c := NewUserKeyCache(time.Minute, 10*time.Second, 0, func(name string) ([]string, error) {
+				fetched++
+				switch name {
+				case "alice":
+					return []string{"ssh-ed25519 alice"}, nil
+				case "unknown":
+					return nil, errors.New("user not found")
+				}
+				return nil, errors.New("connection refused")
+			})
+			c.now = func() time.Time { return now }
+
+			c.Get(tt.user)
+			now = now.Add(tt.advance)
+			keys, _, err := c.Get(tt.user)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) {
+				t.Errorf("Get() = %v, want %v", keys, tt.wantKeys)
+			}
+			if fetched != tt.wantFetch {
+				t.Errorf("fetch count = %d, want %d", fetched, tt.wantFetch)
+			}
+		})
+	}
+}
+
+func TestUserKeyCache_Concurrent(t *testing.T) {
+	var mu sync.Mutex
+	fetched := 0
+	release := make(chan struct{})
+	c := NewUserKeyCache(time.Minute, time.Minute, 0, func(name string) ([]string, error) {
+		mu.Lock()
+		fetched++
+		mu.Unlock()
+		<-release
+		return []string{"key"}, nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Get("alice")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetched != 1 {
+		t.Errorf("fetch count = %d, want 1", fetched)
+	}
+
+	c.Invalidate("alice")
+	if _, cached, _ := c.Get("alice"); cached {
+		t.Error("Get() returned cached keys after Invalidate()")
+	}
+
+	stats := c.Stats()
+	if stats.Misses != 2 || stats.Hits != 9 || stats.Evictions != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestUserKeyCache_Sweep(t *testing.T) {
+	now := time.Now()
+	c := NewUserKeyCache(time.Minute, 10*time.Second, 0, func(name string) ([]string, error) {
+		if name == "unknown" {
+			return nil, errors.New("user not found")
+		}
+		return []string{"key"}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	c.Get("alice")
+	c.Get("unknown")
+	now = now.Add(30 * time.Second)
+	c.Get("bob")
+	if _, ok := c.entries["unknown"]; !ok {
+		t.Error("unknown is swept before the sweep interval")
+	}
+
+	now = now.Add(30 * time.Second)
+	c.Get("carol")
+	for _, name := range []string{"alice", "unknown"} {
+		if _, ok := c.entries[name]; ok {
+			t.Errorf("%s is not swept", name)
+		}
+	}
+	if len(c.entries) != 2 {
+		t.Errorf("entries = %d, want 2", len(c.entries))
+	}
+	if got := c.Stats().Evictions; got != 2 {
+		t.Errorf("evictions = %d, want 2", got)
+	}
+}
+
+func TestUserKeyCache_Size(t *testing.T) {
+	now := time.Now()
+	c := NewUserKeyCache(time.Minute, 10*time.Second, 2, func(name string) ([]string, error) {
+		return []string{"key"}, nil
+	})
+	c.now = func() time.Time { return now }
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		c.Get(name)
+		now = now.Add(time.Second)
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("entries = %d, want 2", len(c.entries))
+	}
+	if _, ok := c.entries["alice"]; ok {
+		t.Error("alice is not evicted")
+	}
+	if got := c.Stats().Evictions; got != 1 {
+		t.Errorf("evictions = %d, want 1", got)
+	}
+}
@@ -0,0 +1,117 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/STNS/libstns-go/libstns"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSTNS_verifyWithUser(t *testing.T) {
+	newKey := func(t *testing.T) (ssh.Signer, string) {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signer, string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	}
+	sign := func(t *testing.T, signer ssh.Signer, msg []byte) []byte {
+		sig, err := signer.Sign(rand.Reader, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(sig)
+		return b
+	}
+
+	client, err := libstns.NewSTNS("http://127.0.0.1:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, oldPub := newKey(t)
+	newSigner, newPub := newKey(t)
+	otherKey, _ := newKey(t)
+	msg := []byte("challenge")
+
+	fetched := 0
+	keys := []string{oldPub}
+	now := time.Now()
+	s := &STNS{client: client}
+	s.keys = NewUserKeyCache(time.Hour, time.Minute, 0, func(string) ([]string, error) {
+		fetched++
+		return keys, nil
+	})
+	s.keys.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	if err := s.verifyWithUser(ctx, "alice", msg, sign(t, oldKey, msg)); err != nil || fetched != 1 {
+		t.Fatalf("verifyWithUser() = %v, fetched %d", err, fetched)
+	}
+
+	// bad signatures right after the fetch are rejected from the cache
+	for i := 0; i < 5; i++ {
+		if err := s.verifyWithUser(ctx, "alice", msg, sign(t, otherKey, msg)); err == nil {
+			t.Fatal("verifyWithUser() accepted a bad signature")
+		}
+	}
+	if fetched != 1 {
+		t.Errorf("bad signatures fetched %d times, want 1", fetched)
+	}
+
+	// after the min age, one bad signature refetches once, and finds the
+	// newly registered key
+	keys = []string{newPub}
+	now = now.Add(stnsRefetchMinAge)
+	for i := 0; i < 5; i++ {
+		s.verifyWithUser(ctx, "alice", msg, sign(t, otherKey, msg))
+	}
+	if fetched != 2 {
+		t.Errorf("bad signatures after the min age fetched %d times, want 2", fetched)
+	}
+	if err := s.verifyWithUser(ctx, "alice", msg, sign(t, newSigner, msg)); err != nil || fetched != 2 {
+		t.Errorf("verifyWithUser() with the new key = %v, fetched %d", err, fetched)
+	}
+}
+
+func TestLegacyCerts(t *testing.T) {
+	ca, _ := testCertPEM(t, "ca.example.com")
+	root, _ := testCertPEM(t, "root.example.com")
+	cert, key := testCertPEM(t, "prod.example.com")
+	certs := legacyCerts(map[string]*certutil.CertBundle{
+		"prod.example.com": {Certificate: cert, PrivateKey: key, CAChain: []string{strings.TrimSpace(ca), strings.TrimSpace(root)}},
+	})
+
+	rest := []byte(certs["prod.example.com"]["ca"])
+	names := []string{}
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, c.Subject.CommonName)
+	}
+	if strings.Join(names, ",") != "ca.example.com,root.example.com" || len(strings.TrimSpace(string(rest))) != 0 {
+		t.Errorf("ca = %q, parsed %v", certs["prod.example.com"]["ca"], names)
+	}
+	if certs["prod.example.com"]["cert"] != cert || certs["prod.example.com"]["key"] != key {
+		t.Errorf("certs = %v", certs)
+	}
+}
@@ -0,0 +1,273 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/hashicorp/vault/sdk/helper/certutil"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	TLSClientAuthNone             = "none"
+	TLSClientAuthRequest          = "request"
+	TLSClientAuthVerifyIfGiven    = "verify_if_given"
+	TLSClientAuthRequireAndVerify = "require_and_verify"
+)
+
+const DefaultTLSCheckInterval = time.Minute
+
+// TLSConfig serves the listener over TLS with a cert read from files, or
+// issued from Vault PKI with the token of kagiana itself.
+type TLSConfig struct {
+	CertFile       string `mapstructure:"cert_file"`
+	KeyFile        string `mapstructure:"key_file"`
+	VaultPath      string `mapstructure:"vault_path"`
+	VaultToken     string `mapstructure:"vault_token"`
+	VaultTokenFile string `mapstructure:"vault_token_file"`
+	CommonName     string `mapstructure:"common_name"`
+	AltNames       string `mapstructure:"alt_names"`
+	IPSans         string `mapstructure:"ip_sans"`
+	TTL            string `mapstructure:"ttl"`
+	// RenewBefore is how long before the expiry a cert from Vault is
+	// rotated. It defaults to a third of the lifetime.
+	RenewBefore  time.Duration `mapstructure:"renew_before"`
+	ClientCAFile string        `mapstructure:"client_ca_file"`
+	ClientAuth   string        `mapstructure:"client_auth" validate:"omitempty,oneof=none request verify_if_given require_and_verify"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.VaultPath != ""
+}
+
+// TLSCertificate holds the serving cert and replaces it when the files
+// change or the cert from Vault is close to the expiry.
+type TLSCertificate struct {
+	config   TLSConfig
+	vault    *api.Client
+	interval time.Duration
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	renewAt  time.Time
+	modTime  time.Time
+}
+
+func NewTLSCertificate(ctx context.Context, config TLSConfig, vault *api.Client) (*TLSCertificate, error) {
+	switch {
+	case config.CertFile != "" && config.VaultPath != "":
+		return nil, fmt.Errorf("tls cert_file and vault_path are exclusive")
+	case config.CertFile != "" && config.KeyFile == "":
+		return nil, fmt.Errorf("tls key_file is required")
+	case config.VaultPath != "" && config.CommonName == "":
+		return nil, fmt.Errorf("tls common_name is required")
+	}
+
+	c := &TLSCertificate{config: config, vault: vault, interval: DefaultTLSCheckInterval}
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *TLSCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+func (c *TLSCertificate) NotAfter() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.notAfter
+}
+
+// Run checks the cert until ctx is done. A failed rotation keeps the current
+// cert and is retried on the next check.
+func (c *TLSCertificate) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.refresh(ctx); err != nil {
+				logrus.Errorf("rotate tls cert: %s", err)
+			}
+		}
+	}
+}
+
+func (c *TLSCertificate) refresh(ctx context.Context) error {
+	if c.config.VaultPath != "" {
+		c.mu.RLock()
+		due := !time.Now().Before(c.renewAt)
+		c.mu.RUnlock()
+		if !due {
+			return nil
+		}
+		return c.load(ctx)
+	}
+
+	modTime, err := c.fileModTime()
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return c.load(ctx)
+}
+
+func (c *TLSCertificate) fileModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{c.config.CertFile, c.config.KeyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *TLSCertificate) load(ctx context.Context) error {
+	var (
+		cert    tls.Certificate
+		modTime time.Time
+		err     error
+	)
+	if c.config.VaultPath != "" {
+		cert, err = c.issue(ctx)
+	} else {
+		// stat first, so a write during the load is picked up next time
+		modTime, err = c.fileModTime()
+		if err == nil {
+			cert, err = tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+		}
+	}
+	if err != nil {
+		tlsRotationsTotal.WithLabelValues(tlsSource(c.config), "failure").Inc()
+		return err
+	}
+	tlsRotationsTotal.WithLabelValues(tlsSource(c.config), "success").Inc()
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	renewBefore := c.config.RenewBefore
+	if renewBefore == 0 {
+		renewBefore = leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.notAfter = leaf.NotAfter
+	c.renewAt = leaf.NotAfter.Add(-renewBefore)
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	tlsCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	logrus.Infof("loaded tls cert %s, expires at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+func (c *TLSCertificate) issue(ctx context.Context) (tls.Certificate, error) {
+	client, err := serviceClient(c.vault, c.config.VaultToken, c.config.VaultTokenFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cc := Cert{
+		CommonName: c.config.CommonName,
+		Path:       c.config.VaultPath,
+		TTL:        c.config.TTL,
+		AltNames:   c.config.AltNames,
+		IPSans:     c.config.IPSans,
+	}
+	ctx, span := startSpan(ctx, "vault.issue", attribute.String("vault.path", cc.Path), attribute.String("cert.name", cc.CommonName))
+	ret, err := client.Logical().WriteWithContext(ctx, cc.Path, cc.ToVaultOptions())
+	endSpan(span, err)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if ret == nil {
+		return tls.Certificate{}, fmt.Errorf("empty response from %s", cc.Path)
+	}
+	pc, err := certutil.ParsePKIMap(ret.Data)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	b, err := pc.ToCertBundle()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	chain := append([]string{b.Certificate}, b.CAChain...)
+	if len(b.CAChain) == 0 && b.IssuingCA != "" {
+		chain = append(chain, b.IssuingCA)
+	}
+	return tls.X509KeyPair([]byte(strings.Join(chain, "\n")), []byte(b.PrivateKey))
+}
+
+func tlsSource(config TLSConfig) string {
+	if config.VaultPath != "" {
+		return "vault"
+	}
+	return "file"
+}
+
+// NewServerTLSConfig returns the tls config of the listeners. Client certs
+// are verified against client_ca_file.
+func NewServerTLSConfig(config TLSConfig, cert *TLSCertificate) (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+
+	switch config.ClientAuth {
+	case "", TLSClientAuthNone:
+		tc.ClientAuth = tls.NoClientCert
+	case TLSClientAuthRequest:
+		tc.ClientAuth = tls.RequestClientCert
+	case TLSClientAuthVerifyIfGiven:
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequireAndVerify:
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown tls client_auth %s", config.ClientAuth)
+	}
+
+	if config.ClientCAFile != "" {
+		b, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificate in %s", config.ClientCAFile)
+		}
+		tc.ClientCAs = pool
+	} else if tc.ClientAuth >= tls.VerifyClientCertIfGiven {
+		return nil, fmt.Errorf("tls client_ca_file is required to verify client certs")
+	}
+	return tc, nil
+}
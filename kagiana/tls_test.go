@@ -0,0 +1,167 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	cert, key := testCertPEM(t, cn)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, []byte(cert), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte(key), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func servingCN(t *testing.T, c *TLSCertificate) string {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestTLSCertificate_File(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old.example.com")
+
+	c, err := NewTLSCertificate(context.Background(), TLSConfig{CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn := servingCN(t, c); cn != "old.example.com" {
+		t.Errorf("cn = %s, want old.example.com", cn)
+	}
+
+	if err := c.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cn := servingCN(t, c); cn != "old.example.com" {
+		t.Errorf("cn = %s, want old.example.com", cn)
+	}
+
+	writeTestCert(t, dir, "new.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if err := c.refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if cn := servingCN(t, c); cn != "new.example.com" {
+		t.Errorf("cn = %s, want new.example.com", cn)
+	}
+
+	os.WriteFile(certFile, []byte("broken"), 0600)
+	os.Chtimes(certFile, future.Add(time.Minute), future.Add(time.Minute))
+	if err := c.refresh(context.Background()); err == nil {
+		t.Error("refresh() must fail with a broken cert")
+	}
+	if cn := servingCN(t, c); cn != "new.example.com" {
+		t.Errorf("cn = %s, want the current cert to be kept", cn)
+	}
+}
+
+func TestTLSCertificate_Vault(t *testing.T) {
+	issued := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/pki/issue/kagiana" || r.Header.Get("X-Vault-Token") != "kagiana-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		issued++
+		cert, key := testCertPEM(t, "kagiana.example.com")
+		s, _ := json.Marshal(&api.Secret{Data: map[string]interface{}{
+			"certificate":   cert,
+			"private_key":   key,
+			"serial_number": "01",
+		}})
+		w.Write(s)
+	}))
+	defer ts.Close()
+
+	vault, err := NewVaultClient(&Config{VaultAddr: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault.SetMaxRetries(0)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	os.WriteFile(tokenFile, []byte("kagiana-token\n"), 0600)
+
+	tests := []struct {
+		name        string
+		renewBefore time.Duration
+		wantIssued  int
+	}{
+		{name: "not due", renewBefore: time.Minute, wantIssued: 1},
+		{name: "due", renewBefore: 2 * time.Hour, wantIssued: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issued = 0
+			config := TLSConfig{
+				VaultPath:      "pki/issue/kagiana",
+				VaultTokenFile: tokenFile,
+				CommonName:     "kagiana.example.com",
+				RenewBefore:    tt.renewBefore,
+			}
+			c, err := NewTLSCertificate(context.Background(), config, vault)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if issued != tt.wantIssued {
+				t.Errorf("issued = %d, want %d", issued, tt.wantIssued)
+			}
+			if cn := servingCN(t, c); cn != "kagiana.example.com" {
+				t.Errorf("cn = %s, want kagiana.example.com", cn)
+			}
+		})
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "kagiana.example.com")
+	c, err := NewTLSCertificate(context.Background(), TLSConfig{CertFile: certFile, KeyFile: keyFile}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  TLSConfig
+		want    tls.ClientAuthType
+		wantErr bool
+	}{
+		{name: "default", config: TLSConfig{}, want: tls.NoClientCert},
+		{name: "verify", config: TLSConfig{ClientAuth: TLSClientAuthRequireAndVerify, ClientCAFile: certFile}, want: tls.RequireAndVerifyClientCert},
+		{name: "verify without ca", config: TLSConfig{ClientAuth: TLSClientAuthVerifyIfGiven}, wantErr: true},
+		{name: "unknown", config: TLSConfig{ClientAuth: "always"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := NewServerTLSConfig(tt.config, c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewServerTLSConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && tc.ClientAuth != tt.want {
+				t.Errorf("ClientAuth = %v, want %v", tc.ClientAuth, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package kagiana
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName                = "github.com/pyama86/kagiana"
+	DefaultTracingServiceName = "kagiana"
+)
+
+type TracingConfig struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector, tracing is
+	// disabled when it is empty.
+	Endpoint    string            `mapstructure:"endpoint"`
+	URLPath     string            `mapstructure:"url_path"`
+	Insecure    bool              `mapstructure:"insecure"`
+	Headers     map[string]string `mapstructure:"headers"`
+	SampleRatio float64           `mapstructure:"sample_ratio" validate:"min=0,max=1"`
+	ServiceName string            `mapstructure:"service_name"`
+}
+
+// SetupTracing installs the global tracer provider exporting over OTLP.
+// The W3C trace context propagator is always installed, so an incoming
+// trace is handed on to Vault even when kagiana doesn't export itself.
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(config.URLPath))
+	}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(config.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	name := config.ServiceName
+	if name == "" {
+		name = DefaultTracingServiceName
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(name)))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on the span before ending it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceHandler starts a server span for every request of the route.
+func TraceHandler(route string, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, route)
+}
+
+// tracedHTTPClient is used for the calls to the OAuth provider.
+var tracedHTTPClient = &http.Client{Transport: tracingTransport(http.DefaultTransport)}
+
+// tracingTransport injects the trace context into the outgoing requests and
+// records a client span for each of them.
+func tracingTransport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
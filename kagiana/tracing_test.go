@@ -0,0 +1,63 @@
+package kagiana
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestNewVault_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceparent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		s, _ := json.Marshal(&api.Secret{Auth: &api.SecretAuth{ClientToken: "test-token"}})
+		w.Write(s)
+	}))
+	defer ts.Close()
+
+	config := &Config{OAuthProvider: "github", VaultAddr: ts.URL}
+	base, err := NewVaultClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "request")
+	if _, err := NewVault(ctx, base, config, map[string]string{"github_token": "token"}); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	if traceparent == "" {
+		t.Fatal("traceparent is not propagated to vault")
+	}
+
+	var login sdktrace.ReadOnlySpan
+	for _, s := range exporter.GetSpans().Snapshots() {
+		if s.Name() == "vault.login" {
+			login = s
+		}
+	}
+	if login == nil {
+		t.Fatal("vault.login span is not recorded")
+	}
+	if login.Parent().TraceID() != span.SpanContext().TraceID() {
+		t.Errorf("vault.login trace id = %s, want %s", login.Parent().TraceID(), span.SpanContext().TraceID())
+	}
+	if got := login.SpanContext().TraceID().String(); traceparent[3:35] != got {
+		t.Errorf("traceparent = %s, want trace id %s", traceparent, got)
+	}
+}
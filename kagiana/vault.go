@@ -1,88 +1,378 @@
 package kagiana
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/vault/api"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/hashicorp/vault/sdk/helper/certutil"
 )
 
-const VaultTimeout = 30
+const (
+	DefaultIssueConcurrency = 4
+	IssueFailureModePartial = "partial"
+	IssueFailureModeRevoke  = "revoke"
+)
+
+const (
+	DefaultVaultTimeout         = 30 * time.Second
+	DefaultVaultMaxIdleConns    = 100
+	DefaultVaultIdleConnTimeout = 90 * time.Second
+)
 
 type Vault struct {
 	client *api.Client
 	config *Config
-	token  string
+	auth   *api.SecretAuth
 }
 
-func NewVault(config *Config, m map[string]string) (*Vault, error) {
-	var httpClient = &http.Client{
-		Timeout: VaultTimeout * time.Second,
+// NewVaultClient returns the base Vault client shared by every login.
+// It holds the connection pool and is never given a user token itself.
+func NewVaultClient(config *Config) (*api.Client, error) {
+	vc := api.DefaultConfig()
+	if vc.Error != nil {
+		return nil, vc.Error
 	}
 
-	client, err := api.NewClient(&api.Config{
-		Address:    os.Getenv("VAULT_ADDR"),
-		HttpClient: httpClient,
-	})
+	timeout := config.VaultTimeout
+	if timeout == 0 {
+		timeout = DefaultVaultTimeout
+	}
+	vc.Timeout = timeout
+	vc.HttpClient.Timeout = timeout
+
+	transport := vc.HttpClient.Transport.(*http.Transport)
+	transport.MaxIdleConns = DefaultVaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = DefaultVaultMaxIdleConns
+	if config.VaultMaxIdleConns != 0 {
+		transport.MaxIdleConns = config.VaultMaxIdleConns
+		transport.MaxIdleConnsPerHost = config.VaultMaxIdleConns
+	}
+	transport.IdleConnTimeout = DefaultVaultIdleConnTimeout
+	if config.VaultIdleConnTimeout != 0 {
+		transport.IdleConnTimeout = config.VaultIdleConnTimeout
+	}
 
+	if config.VaultAddr != "" {
+		vc.Address = config.VaultAddr
+	}
+
+	client, err := api.NewClient(vc)
 	if err != nil {
 		return nil, err
 	}
-	var secret *api.Secret
-	switch config.OAuthProvider {
-	case "github":
-		authPath := "github"
-		if config.VaultAuthPath != "" {
-			authPath = config.VaultAuthPath
+	// wrapped after NewClient, which expects a *http.Transport
+	vc.HttpClient.Transport = tracingTransport(transport)
+	client.ClearToken()
+	return client, nil
+}
 
-		}
-		s, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", authPath), map[string]interface{}{
-			"token": strings.TrimSpace(m["github_token"]),
-		})
+// serviceClient returns a clone of the base client with the token of kagiana
+// itself. The file is read every time, so a token renewed by an agent is used.
+func serviceClient(base *api.Client, token, tokenFile string) (*api.Client, error) {
+	if tokenFile != "" {
+		b, err := os.ReadFile(tokenFile)
 		if err != nil {
 			return nil, err
 		}
-		if s == nil {
-			return nil, fmt.Errorf("empty response from credential provider")
-		}
-		secret = s
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return nil, fmt.Errorf("vault token of kagiana is not configured")
+	}
+
+	client, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(token)
+	return client, nil
+}
 
+// NewVault logs in to Vault with a clone of the base client, so the token of
+// the user is never shared between requests.
+func NewVault(ctx context.Context, base *api.Client, config *Config, m map[string]string) (*Vault, error) {
+	switch config.OAuthProvider {
+	case "github":
+		return loginVault(ctx, base, config, vaultAuthPath(config, "github"), map[string]interface{}{
+			"token": strings.TrimSpace(m["github_token"]),
+		})
 	default:
 		return nil, fmt.Errorf("unknown provider %s", config.OAuthProvider)
 	}
+}
+
+func vaultAuthPath(config *Config, defaultPath string) string {
+	if config.VaultAuthPath != "" {
+		return config.VaultAuthPath
+	}
+	return defaultPath
+}
+
+// loginVault logs in to the auth method mounted at authPath.
+func loginVault(ctx context.Context, base *api.Client, config *Config, authPath string, data map[string]interface{}) (*Vault, error) {
+	return loginVaultPath(ctx, base, config, authPath, fmt.Sprintf("auth/%s/login", authPath), data)
+}
+
+// loginVaultPath logs in at path of the auth method mounted at authPath, for
+// the methods which take the user in the path like ldap and userpass.
+func loginVaultPath(ctx context.Context, base *api.Client, config *Config, authPath, path string, data map[string]interface{}) (*Vault, error) {
+	client, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	spanCtx, span := startSpan(ctx, "vault.login", attribute.String("vault.path", path))
+	start := time.Now()
+	secret, err := client.Logical().WriteWithContext(spanCtx, path, data)
+	endSpan(span, err)
+	vaultLoginDuration.WithLabelValues(authPath).Observe(time.Since(start).Seconds())
+	if err == nil && (secret == nil || secret.Auth == nil) {
+		err = fmt.Errorf("empty response from credential provider")
+	}
+	if err != nil {
+		vaultLoginErrorsTotal.WithLabelValues(authPath).Inc()
+		Audit(ctx, AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeFailure, Error: err.Error()})
+		return nil, err
+	}
+	return newVaultSession(ctx, client, config, secret.Auth), nil
+}
 
-	client.SetToken(secret.Auth.ClientToken)
-	return &Vault{
+func newVaultSession(ctx context.Context, client *api.Client, config *Config, auth *api.SecretAuth) *Vault {
+	client.SetToken(auth.ClientToken)
+	v := &Vault{
 		client: client,
 		config: config,
-	}, nil
+		auth:   auth,
+	}
+	Audit(ctx, AuditEvent{
+		Type:          AuditTypeLogin,
+		Outcome:       AuditOutcomeSuccess,
+		User:          v.UserName(),
+		TokenAccessor: v.TokenAccessor(),
+	})
+	return v
 }
 
 func (v *Vault) Token() string {
 	return v.client.Token()
 }
-func (v *Vault) CreateCert() (map[string]*certutil.CertBundle, error) {
-	cbs := map[string]*certutil.CertBundle{}
+
+// UserName returns the login name reported by the Vault auth method.
+func (v *Vault) UserName() string {
+	return v.auth.Metadata["username"]
+}
+
+// TokenAccessor returns the accessor of the token, which is safe to log.
+func (v *Vault) TokenAccessor() string {
+	return v.auth.Accessor
+}
+
+func (v *Vault) RevokeToken(ctx context.Context) error {
+	return v.client.Auth().Token().RevokeSelfWithContext(ctx, "")
+}
+
+// revokeLater revokes the token of a login which was never handed out.
+func revokeLater(v *Vault) {
+	go func() {
+		if err := v.RevokeToken(context.Background()); err != nil {
+			logrus.Errorf("%s revoke token failed: %s", v.UserName(), err.Error())
+		}
+	}()
+}
+
+func (v *Vault) TokenTTL() int {
+	return v.auth.LeaseDuration
+}
+
+func (v *Vault) Renewable() bool {
+	return v.auth.Renewable
+}
+
+func (v *Vault) Policies() []string {
+	if v.auth.Policies == nil {
+		return []string{}
+	}
+	return v.auth.Policies
+}
+
+// IssueError holds the errors of the certs which couldn't be issued.
+type IssueError struct {
+	Errors map[string]error
+}
+
+func (e *IssueError) Error() string {
+	msgs := []string{}
+	for _, name := range sortedErrorNames(e.Errors) {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e.Errors[name].Error()))
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// Failures returns the error message of each cert which couldn't be issued.
+func (e *IssueError) Failures() map[string]string {
+	if e == nil {
+		return nil
+	}
+	r := map[string]string{}
+	for name, err := range e.Errors {
+		r[name] = err.Error()
+	}
+	return r
+}
+
+// CreateCert issues the configured certs in parallel. When some of them fail,
+// it returns an *IssueError together with the certs which were issued in the
+// partial mode, or revokes them and returns nothing in the revoke mode.
+func (v *Vault) CreateCert(ctx context.Context) (map[string]*certutil.CertBundle, error) {
+	concurrency := v.config.IssueConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultIssueConcurrency
+	}
+
+	type result struct {
+		cert   Cert
+		bundle *certutil.CertBundle
+		err    error
+	}
+
+	results := make(chan result, len(v.config.Certs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
 	for _, c := range v.config.Certs {
-		ret, err := v.client.Logical().Write(c.Path, c.ToVaultOptions())
-		if err != nil {
-			return nil, err
+		wg.Add(1)
+		go func(c Cert) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results <- result{cert: c, err: ctx.Err()}
+				return
+			}
+			b, err := v.issueCert(ctx, c)
+			results <- result{cert: c, bundle: b, err: err}
+		}(c)
+	}
+	wg.Wait()
+	close(results)
+
+	cbs := map[string]*certutil.CertBundle{}
+	issued := map[string]Cert{}
+	issueErr := &IssueError{Errors: map[string]error{}}
+	for r := range results {
+		if r.err != nil {
+			issueErr.Errors[r.cert.CommonName] = r.err
+			continue
 		}
-		cert, err := certutil.ParsePKIMap(ret.Data)
-		if err != nil {
-			return nil, err
+		cbs[r.cert.CommonName] = r.bundle
+		issued[r.cert.CommonName] = r.cert
+	}
+
+	v.auditIssue(ctx, cbs, issueErr)
+	if len(issueErr.Errors) == 0 {
+		return cbs, nil
+	}
+
+	if v.config.IssueFailureMode == IssueFailureModeRevoke {
+		for name, b := range cbs {
+			err := v.revokeCert(context.Background(), issued[name], b.SerialNumber)
+			outcome, msg := auditOutcome(err)
+			Audit(ctx, AuditEvent{
+				Type:          AuditTypeRevoke,
+				Outcome:       outcome,
+				TokenAccessor: v.TokenAccessor(),
+				Certs:         []AuditCert{{Name: name, SerialNumber: b.SerialNumber}},
+				Error:         msg,
+			})
+			if err != nil {
+				Logger(ctx).Errorf("%s revoke serial %s failed: %s", name, b.SerialNumber, err.Error())
+			}
 		}
-		b, err := cert.ToCertBundle()
-		if err != nil {
-			return nil, err
+		return nil, issueErr
+	}
+	return cbs, issueErr
+}
+
+func (v *Vault) auditIssue(ctx context.Context, cbs map[string]*certutil.CertBundle, issueErr *IssueError) {
+	e := AuditEvent{
+		Type:          AuditTypeIssue,
+		Outcome:       AuditOutcomeSuccess,
+		User:          v.UserName(),
+		TokenAccessor: v.TokenAccessor(),
+		Certs:         auditCerts(cbs),
+	}
+	if len(issueErr.Errors) > 0 {
+		e.Outcome = AuditOutcomePartial
+		if len(cbs) == 0 {
+			e.Outcome = AuditOutcomeFailure
 		}
+		e.Error = issueErr.Error()
+	}
+	Audit(ctx, e)
+}
+
+func (v *Vault) issueCert(ctx context.Context, c Cert) (*certutil.CertBundle, error) {
+	start := time.Now()
+	b, err := v.writeCert(ctx, c)
+	vaultIssueDuration.WithLabelValues(c.Path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		vaultIssueErrorsTotal.WithLabelValues(c.Path).Inc()
+		return nil, err
+	}
+	certificatesIssuedTotal.WithLabelValues(c.CommonName).Inc()
+	return b, nil
+}
+
+func (v *Vault) writeCert(ctx context.Context, c Cert) (*certutil.CertBundle, error) {
+	ctx, span := startSpan(ctx, "vault.issue", attribute.String("vault.path", c.Path), attribute.String("cert.name", c.CommonName))
+	ret, err := v.client.Logical().WriteWithContext(ctx, c.Path, c.ToVaultOptions())
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("empty response from %s", c.Path)
+	}
+	cert, err := certutil.ParsePKIMap(ret.Data)
+	if err != nil {
+		return nil, err
+	}
+	return cert.ToCertBundle()
+}
+
+func (v *Vault) revokeCert(ctx context.Context, c Cert, serial string) error {
+	ctx, span := startSpan(ctx, "vault.revoke", attribute.String("vault.path", c.ToRevokePath()))
+	_, err := v.client.Logical().WriteWithContext(ctx, c.ToRevokePath(), map[string]interface{}{
+		"serial_number": serial,
+	})
+	endSpan(span, err)
+	return err
+}
+
+func sortedErrorNames(errs map[string]error) []string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-		cbs[c.CommonName] = b
+func sortedCertNames(cbs map[string]*certutil.CertBundle) []string {
+	names := make([]string, 0, len(cbs))
+	for name := range cbs {
+		names = append(names, name)
 	}
-	return cbs, nil
+	sort.Strings(names)
+	return names
 }
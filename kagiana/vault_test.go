@@ -0,0 +1,214 @@
+package kagiana
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func newBenchVaultServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _ := json.Marshal(&api.Secret{
+			Auth: &api.SecretAuth{
+				ClientToken:   "test-token",
+				LeaseDuration: 3600,
+			},
+		})
+		w.Write(s)
+	}))
+}
+
+func benchRootCAs(ts *httptest.Server) *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return pool
+}
+
+func BenchmarkNewVault_Shared(b *testing.B) {
+	ts := newBenchVaultServer()
+	defer ts.Close()
+
+	caCert := filepath.Join(b.TempDir(), "ca.pem")
+	if err := os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600); err != nil {
+		b.Fatal(err)
+	}
+	b.Setenv(api.EnvVaultCACert, caCert)
+
+	config := &Config{OAuthProvider: "github", VaultAddr: ts.URL}
+	base, err := NewVaultClient(config)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := NewVault(context.Background(), base, config, map[string]string{"github_token": "token"}); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+// BenchmarkNewVault_Fresh builds a new http and vault client per login,
+// which is what kagiana did before the base client was shared.
+func BenchmarkNewVault_Fresh(b *testing.B) {
+	ts := newBenchVaultServer()
+	defer ts.Close()
+
+	config := &Config{OAuthProvider: "github", VaultAddr: ts.URL}
+	rootCAs := benchRootCAs(ts)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			base, err := api.NewClient(&api.Config{
+				Address: ts.URL,
+				HttpClient: &http.Client{
+					Timeout: DefaultVaultTimeout,
+					Transport: &http.Transport{
+						TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+					},
+				},
+			})
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if _, err := NewVault(context.Background(), base, config, map[string]string{"github_token": "token"}); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func testCertPEM(t *testing.T, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestVault_CreateCert(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		wantCerts   []string
+		wantErr     bool
+		wantRevoked bool
+	}{
+		{
+			name:      "partial",
+			mode:      IssueFailureModePartial,
+			wantCerts: []string{"ok1.example.com", "ok2.example.com"},
+			wantErr:   true,
+		},
+		{
+			name:        "revoke",
+			mode:        IssueFailureModeRevoke,
+			wantCerts:   []string{},
+			wantErr:     true,
+			wantRevoked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			revoked := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/v1/auth/github/login":
+					s, _ := json.Marshal(&api.Secret{Auth: &api.SecretAuth{ClientToken: "test-token"}})
+					w.Write(s)
+				case "/v1/pki/issue/ok1", "/v1/pki/issue/ok2":
+					cert, key := testCertPEM(t, r.URL.Path)
+					s, _ := json.Marshal(&api.Secret{Data: map[string]interface{}{
+						"certificate":   cert,
+						"private_key":   key,
+						"serial_number": "01",
+					}})
+					w.Write(s)
+				case "/v1/pki/revoke":
+					mu.Lock()
+					revoked++
+					mu.Unlock()
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.WriteHeader(http.StatusForbidden)
+					w.Write([]byte(`{"errors":["permission denied"]}`))
+				}
+			}))
+			defer ts.Close()
+
+			config := &Config{
+				OAuthProvider:    "github",
+				VaultAddr:        ts.URL,
+				IssueConcurrency: 2,
+				IssueFailureMode: tt.mode,
+				Certs: []Cert{
+					{CommonName: "ok1.example.com", Path: "pki/issue/ok1"},
+					{CommonName: "ng.example.com", Path: "pki/issue/ng"},
+					{CommonName: "ok2.example.com", Path: "pki/issue/ok2"},
+				},
+			}
+			base, err := NewVaultClient(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			base.SetMaxRetries(0)
+			vlt, err := NewVault(context.Background(), base, config, map[string]string{"github_token": "token"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cbs, err := vlt.CreateCert(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CreateCert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if issueErr, ok := err.(*IssueError); ok {
+				if _, ok := issueErr.Errors["ng.example.com"]; !ok || len(issueErr.Errors) != 1 {
+					t.Errorf("CreateCert() errors = %v", issueErr.Errors)
+				}
+			}
+			if names := sortedCertNames(cbs); !reflect.DeepEqual(names, tt.wantCerts) {
+				t.Errorf("CreateCert() = %v, want %v", names, tt.wantCerts)
+			}
+			if (revoked == 2) != tt.wantRevoked {
+				t.Errorf("revoked = %d, wantRevoked %v", revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
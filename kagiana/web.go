@@ -143,11 +143,115 @@ var successTemplate = `
 <button class="button is-primary is-outlined copy-value mb-5" data-clipboard-text="{{ .Command }}">
     Copy to clipboard
 </button>
+{{- if .Failures }}
+                <article class="message is-warning">
+                  <div class="message-body">
+                    The following certificates could not be issued.
+                    <ul>
+{{- range $name, $msg := .Failures }}
+                      <li>{{ $name }}: {{ $msg }}</li>
+{{- end }}
+                    </ul>
+                  </div>
+                </article>
+{{- end }}
                 <pre><code class="language-bash">
 {{- range  $v := .MaskCommands }}
 $ {{ $v -}}
 {{- end -}}
                 </code></pre>
+{{- if .ReturnTo }}
+                <a class="button is-link is-outlined" href="{{ .ReturnTo }}">Continue</a>
+{{- end }}
+              </div>
+            </div>
+          </div>
+        </div>
+      </div>
+    </section>
+`
+
+var deviceTemplate = `
+    <section class="section">
+      <div class="container">
+        <div class="columns">
+          <div class="column">
+            <div class="content is-medium">
+{{- if .Approved }}
+              <h3 class="title is-3">Device Approved.</h3>
+              <div class="box">
+                <article class="message is-primary">
+                  <div class="message-body">
+                    The certificates are sent to your device. Return to your terminal.
+                  </div>
+                </article>
+              </div>
+{{- else if .Denied }}
+              <h3 class="title is-3">Device Denied.</h3>
+              <div class="box">
+                <article class="message is-warning">
+                  <div class="message-body">
+                    The device showing {{ .UserCode }} gets nothing. Return to your terminal.
+                  </div>
+                </article>
+              </div>
+{{- else if .Confirm }}
+              <h3 class="title is-3">Confirm Device</h3>
+              <div class="box">
+                <p>You are signed in as <strong>{{ .User }}</strong>. The device showing the code below gets your certificates and Vault token.</p>
+                <p class="title is-4">{{ .UserCode }}</p>
+                <p>Only approve the code if it is shown on your own device.</p>
+                <form method="post" action="/device">
+                  <input type="hidden" name="user_code" value="{{ .UserCode }}">
+                  <input type="hidden" name="state" value="{{ .State }}">
+                  <div class="buttons">
+                    <button class="button is-info" type="submit" name="confirm" value="approve">Approve</button>
+                    <button class="button is-danger is-outlined" type="submit" name="confirm" value="deny">Deny</button>
+                  </div>
+                </form>
+              </div>
+{{- else }}
+              <h3 class="title is-3">Approve Device</h3>
+              <div class="box">
+{{- if .Error }}
+                <article class="message is-danger">
+                  <div class="message-body">
+{{ .Error }}
+                  </div>
+                </article>
+{{- end }}
+                <p>Enter the code shown on your device. Only approve a code which you requested yourself.</p>
+                <form method="post" action="/device">
+                  <input type="hidden" name="state" value="{{ .State }}">
+                  <div class="field has-addons">
+                    <div class="control">
+                      <input class="input" type="text" name="user_code" value="{{ .UserCode }}" placeholder="XXXX-XXXX" autocomplete="off" required>
+                    </div>
+                    <div class="control">
+                      <button class="button is-info" type="submit">Sign in</button>
+                    </div>
+                  </div>
+                </form>
+              </div>
+{{- end }}
+            </div>
+          </div>
+        </div>
+      </div>
+    </section>
+`
+
+var landingTemplate = `
+    <section class="section">
+      <div class="container">
+        <div class="columns">
+          <div class="column">
+            <div class="content is-medium">
+              <h3 class="title is-3">Sign in</h3>
+              <div class="box">
+{{- range .Providers }}
+                <a class="button is-info is-outlined is-fullwidth mb-3" href="{{ .LoginPath }}">Sign in with {{ .Title }}</a>
+{{- end }}
               </div>
             </div>
           </div>
@@ -156,9 +260,69 @@ $ {{ $v -}}
     </section>
 `
 
+var passwordTemplate = `
+    <section class="section">
+      <div class="container">
+        <div class="columns">
+          <div class="column is-half">
+            <div class="content is-medium">
+              <h3 class="title is-3">Sign in with {{ .Title }}</h3>
+              <div class="box">
+{{- if .Error }}
+                <article class="message is-danger">
+                  <div class="message-body">
+{{ .Error }}
+                  </div>
+                </article>
+{{- end }}
+                <form method="post" action="{{ .Action }}">
+                  <input type="hidden" name="state" value="{{ .State }}">
+                  <div class="field">
+                    <label class="label">User</label>
+                    <div class="control">
+                      <input class="input" type="text" name="user" value="{{ .User }}" autocomplete="username" required autofocus>
+                    </div>
+                  </div>
+                  <div class="field">
+                    <label class="label">Password</label>
+                    <div class="control">
+                      <input class="input" type="password" name="password" autocomplete="current-password" required>
+                    </div>
+                  </div>
+                  <div class="field">
+                    <div class="control">
+                      <button class="button is-info" type="submit">Sign in</button>
+                    </div>
+                  </div>
+                </form>
+              </div>
+            </div>
+          </div>
+        </div>
+      </div>
+    </section>
+`
+
+// samlPostTemplate posts the SAML response again from kagiana itself, so the
+// browser sends the SameSite=Lax cookies which it held back on the POST of
+// the IdP.
+var samlPostTemplate = `
+    <section class="section">
+      <div class="container">
+        <form id="saml-response" method="post" action="{{ .Action }}">
+          <input type="hidden" name="SAMLResponse" value="{{ .SAMLResponse }}">
+          <input type="hidden" name="RelayState" value="{{ .RelayState }}">
+          <input type="hidden" name="reposted" value="1">
+          <noscript><button class="button is-info" type="submit">Continue</button></noscript>
+        </form>
+        <script>document.getElementById("saml-response").submit();</script>
+      </div>
+    </section>
+`
+
 var echoContentPattern *regexp.Regexp = regexp.MustCompile(`".*"`)
 
-func RenderSuccess(w http.ResponseWriter, cbs map[string]*certutil.CertBundle, token string) {
+func RenderSuccess(w http.ResponseWriter, cbs map[string]*certutil.CertBundle, token string, failures map[string]string, returnTo string) {
 	commands := []string{
 		`mkdir -p  ~/.kagiana`,
 		fmt.Sprintf(`echo -e "%s" > ~/.kagiana/token`, token),
@@ -188,9 +352,13 @@ func RenderSuccess(w http.ResponseWriter, cbs map[string]*certutil.CertBundle, t
 	err = tmpl.Execute(w, struct {
 		MaskCommands []string
 		Command      string
+		Failures     map[string]string
+		ReturnTo     string
 	}{
 		MaskCommands: maskCommands,
 		Command:      strings.Join(commands, ";\n"),
+		Failures:     failures,
+		ReturnTo:     returnTo,
 	})
 	if err != nil {
 		logrus.Error(err)
@@ -200,6 +368,23 @@ func RenderSuccess(w http.ResponseWriter, cbs map[string]*certutil.CertBundle, t
 }
 
 func RenderError(w http.ResponseWriter, statusCode int, displayError error) {
+	if displayError != nil {
+		logrus.Error(displayError)
+	}
+	renderError(w, statusCode, displayError)
+}
+
+// renderRequestError renders displayError, or the timeout error when the
+// request was cancelled or its deadline was exceeded.
+func renderRequestError(w http.ResponseWriter, r *http.Request, statusCode int, displayError error) {
+	logRequestError(r, displayError)
+	if apiErr := contextAPIError(r.Context()); apiErr != nil {
+		statusCode = apiErr.Status
+	}
+	renderError(w, statusCode, displayError)
+}
+
+func renderError(w http.ResponseWriter, statusCode int, displayError error) {
 	w.WriteHeader(statusCode)
 	tmpl, err := template.New("error").Parse(header + errorTemplate + footer)
 	if err != nil {
@@ -207,7 +392,6 @@ func RenderError(w http.ResponseWriter, statusCode int, displayError error) {
 	}
 	errString := "unknown error"
 	if displayError != nil {
-		logrus.Error(displayError)
 		errString = displayError.Error()
 	}
 	err = tmpl.Execute(w, struct {
@@ -221,3 +405,74 @@ func RenderError(w http.ResponseWriter, statusCode int, displayError error) {
 		logrus.Error(err)
 	}
 }
+
+// deviceView is the step of a device login shown by the device page.
+type deviceView struct {
+	Approved bool
+	Denied   bool
+	Confirm  bool
+	UserCode string
+	User     string
+	State    string
+	Error    string
+}
+
+func renderDevice(w http.ResponseWriter, statusCode int, data deviceView) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(statusCode)
+	tmpl, err := template.New("device").Parse(header + deviceTemplate + footer)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func renderLanding(w http.ResponseWriter, providers []*Provider) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	tmpl, err := template.New("landing").Parse(header + landingTemplate + footer)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if err := tmpl.Execute(w, struct{ Providers []*Provider }{providers}); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func renderPasswordForm(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(statusCode)
+	tmpl, err := template.New("password").Parse(header + passwordTemplate + footer)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if err := tmpl.Execute(w, data); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func renderSAMLPost(w http.ResponseWriter, action, samlResponse, relayState string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	tmpl, err := template.New("saml").Parse(header + samlPostTemplate + footer)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	if err := tmpl.Execute(w, struct {
+		Action       string
+		SAMLResponse string
+		RelayState   string
+	}{action, samlResponse, relayState}); err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,321 @@
+package kagiana
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WebhookSignatureHeader  = "X-Kagiana-Signature"
+	WebhookTimestampHeader  = "X-Kagiana-Timestamp"
+	webhookContentType      = "application/cloudevents+json"
+	DefaultWebhookRetries   = 3
+	DefaultWebhookTimeout   = 5 * time.Second
+	DefaultWebhookBackoff   = time.Second
+	DefaultWebhookQueueSize = 1000
+	DefaultFailureWindow    = 10 * time.Minute
+	// maxWebhookFailureKeys caps the users whose failures are held back, so
+	// failures of random users can't grow the map without bound.
+	maxWebhookFailureKeys = 10000
+)
+
+var webhookDeliveriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Name:      "webhook_deliveries_total",
+	Help:      "Number of webhook deliveries by webhook and result.",
+}, []string{"webhook", "result"})
+
+type WebhookConfig struct {
+	Name       string   `mapstructure:"name" validate:"required"`
+	URL        string   `mapstructure:"url" validate:"required,url"`
+	Secret     string   `mapstructure:"secret"`
+	EventTypes []string `mapstructure:"event_types" validate:"dive,oneof=login challenge issue revoke admin"`
+	Outcomes   []string `mapstructure:"outcomes" validate:"dive,oneof=success failure partial"`
+	Profiles   []string `mapstructure:"profiles"`
+	Users      []string `mapstructure:"users"`
+	// MinFailures holds back failure events until the user failed that many
+	// times within FailureWindow.
+	MinFailures   int           `mapstructure:"min_failures"`
+	FailureWindow time.Duration `mapstructure:"failure_window"`
+	MaxRetries    int           `mapstructure:"max_retries"`
+	Timeout       time.Duration `mapstructure:"timeout"`
+}
+
+// CloudEvent is the structured mode JSON of CloudEvents 1.0.
+type CloudEvent struct {
+	SpecVersion     string     `json:"specversion"`
+	ID              string     `json:"id"`
+	Source          string     `json:"source"`
+	Type            string     `json:"type"`
+	Subject         string     `json:"subject,omitempty"`
+	Time            time.Time  `json:"time"`
+	DataContentType string     `json:"datacontenttype"`
+	Data            AuditEvent `json:"data"`
+}
+
+func NewCloudEvent(e AuditEvent) *CloudEvent {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return &CloudEvent{
+		SpecVersion:     "1.0",
+		ID:              hex.EncodeToString(b),
+		Source:          "kagiana",
+		Type:            fmt.Sprintf("kagiana.%s.%s", e.Type, e.Outcome),
+		Subject:         e.User,
+		Time:            e.Time,
+		DataContentType: "application/json",
+		Data:            e,
+	}
+}
+
+// SignWebhook returns the signature header value of body sent at timestamp,
+// the value of the timestamp header. The timestamp is signed, so receivers
+// can reject replayed deliveries.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhook struct {
+	config  WebhookConfig
+	client  *http.Client
+	backoff time.Duration
+	queue   chan AuditEvent
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newWebhook(config WebhookConfig) *webhook {
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultWebhookRetries
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	if config.FailureWindow == 0 {
+		config.FailureWindow = DefaultFailureWindow
+	}
+	return &webhook{
+		config:   config,
+		client:   &http.Client{Timeout: config.Timeout, Transport: tracingTransport(http.DefaultTransport)},
+		backoff:  DefaultWebhookBackoff,
+		queue:    make(chan AuditEvent, DefaultWebhookQueueSize),
+		failures: map[string][]time.Time{},
+		now:      time.Now,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *webhook) match(e AuditEvent) bool {
+	if len(w.config.EventTypes) > 0 && !contains(w.config.EventTypes, e.Type) {
+		return false
+	}
+	if len(w.config.Outcomes) > 0 && !contains(w.config.Outcomes, e.Outcome) {
+		return false
+	}
+	if len(w.config.Users) > 0 && !contains(w.config.Users, e.User) {
+		return false
+	}
+	if len(w.config.Profiles) > 0 {
+		found := false
+		for _, c := range e.Certs {
+			if contains(w.config.Profiles, c.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if e.Outcome == AuditOutcomeFailure && w.config.MinFailures > 1 {
+		return w.countFailure(e)
+	}
+	return true
+}
+
+// countFailure returns true when the user reached MinFailures, and starts
+// counting again after that.
+func (w *webhook) countFailure(e AuditEvent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	if now.Sub(w.lastSweep) >= w.config.FailureWindow {
+		w.sweepFailures(now)
+	}
+	key := e.Type + ":" + e.User
+	if _, ok := w.failures[key]; !ok && len(w.failures) >= maxWebhookFailureKeys {
+		// too many users fail at once, let it through rather than miss it
+		return true
+	}
+	recent := []time.Time{}
+	for _, t := range w.failures[key] {
+		if now.Sub(t) < w.config.FailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	if len(recent) < w.config.MinFailures {
+		w.failures[key] = recent
+		return false
+	}
+	delete(w.failures, key)
+	return true
+}
+
+// sweepFailures drops the users whose failures are all out of the window. It
+// must be called with mu held.
+func (w *webhook) sweepFailures(now time.Time) {
+	for key, times := range w.failures {
+		if now.Sub(times[len(times)-1]) >= w.config.FailureWindow {
+			delete(w.failures, key)
+		}
+	}
+	w.lastSweep = now
+}
+
+func (w *webhook) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for e := range w.queue {
+		if err := w.deliver(e); err != nil {
+			webhookDeliveriesTotal.WithLabelValues(w.config.Name, "failure").Inc()
+			logrus.Errorf("webhook %s delivery failed: %s", w.config.Name, err.Error())
+			continue
+		}
+		webhookDeliveriesTotal.WithLabelValues(w.config.Name, "success").Inc()
+	}
+}
+
+func (w *webhook) deliver(e AuditEvent) error {
+	body, err := json.Marshal(NewCloudEvent(e))
+	if err != nil {
+		return err
+	}
+
+	backoff := w.backoff
+	for i := 0; ; i++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || i >= w.config.MaxRetries {
+			return err
+		}
+		logrus.Warnf("webhook %s delivery failed, retry in %s: %s", w.config.Name, backoff, err.Error())
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post returns whether the delivery is worth retrying when it failed.
+func (w *webhook) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", webhookContentType)
+	if w.config.Secret != "" {
+		timestamp := strconv.FormatInt(w.now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, timestamp)
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(w.config.Secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < http.StatusMultipleChoices:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return true, fmt.Errorf("status code=%d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("status code=%d", resp.StatusCode)
+	}
+}
+
+// Webhooks delivers the matching audit events to the configured endpoints in
+// the background, so a slow receiver doesn't hold up logins.
+type Webhooks struct {
+	hooks []*webhook
+	wg    sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewWebhooks(configs []WebhookConfig) *Webhooks {
+	ws := &Webhooks{}
+	for _, c := range configs {
+		ws.hooks = append(ws.hooks, newWebhook(c))
+	}
+	for _, w := range ws.hooks {
+		ws.wg.Add(1)
+		go w.run(&ws.wg)
+	}
+	return ws
+}
+
+// Notify drops the events after Close, as a handler still running at
+// shutdown may audit a login.
+func (ws *Webhooks) Notify(e AuditEvent) {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+	for _, w := range ws.hooks {
+		if !w.match(e) {
+			continue
+		}
+		if ws.closed {
+			webhookDeliveriesTotal.WithLabelValues(w.config.Name, "dropped").Inc()
+			logrus.Errorf("webhook %s is closed, drop %s event", w.config.Name, e.Type)
+			continue
+		}
+		select {
+		case w.queue <- e:
+		default:
+			webhookDeliveriesTotal.WithLabelValues(w.config.Name, "dropped").Inc()
+			logrus.Errorf("webhook %s queue is full, drop %s event", w.config.Name, e.Type)
+		}
+	}
+}
+
+// Close waits for the queued events to be delivered.
+func (ws *Webhooks) Close() {
+	ws.mu.Lock()
+	if !ws.closed {
+		ws.closed = true
+		for _, w := range ws.hooks {
+			close(w.queue)
+		}
+	}
+	ws.mu.Unlock()
+	ws.wg.Wait()
+}
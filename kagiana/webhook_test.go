@@ -0,0 +1,184 @@
+package kagiana
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhooks_Notify(t *testing.T) {
+	issue := AuditEvent{
+		Type:    AuditTypeIssue,
+		Outcome: AuditOutcomeSuccess,
+		User:    "alice",
+		Certs:   []AuditCert{{Name: "prod.example.com", SerialNumber: "01"}},
+	}
+	verifyFailure := AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeFailure, User: "bob", Method: "stns"}
+
+	tests := []struct {
+		name   string
+		config WebhookConfig
+		events []AuditEvent
+		want   []string
+	}{
+		{
+			name:   "no filter",
+			config: WebhookConfig{},
+			events: []AuditEvent{issue, verifyFailure},
+			want:   []string{"kagiana.issue.success", "kagiana.login.failure"},
+		},
+		{
+			name:   "event type and profile",
+			config: WebhookConfig{EventTypes: []string{AuditTypeIssue}, Profiles: []string{"prod.example.com"}},
+			events: []AuditEvent{issue, verifyFailure, {Type: AuditTypeIssue, Outcome: AuditOutcomeSuccess, Certs: []AuditCert{{Name: "dev.example.com"}}}},
+			want:   []string{"kagiana.issue.success"},
+		},
+		{
+			name:   "user",
+			config: WebhookConfig{Users: []string{"bob"}},
+			events: []AuditEvent{issue, verifyFailure},
+			want:   []string{"kagiana.login.failure"},
+		},
+		{
+			name:   "repeated failures",
+			config: WebhookConfig{Outcomes: []string{AuditOutcomeFailure}, MinFailures: 3},
+			events: []AuditEvent{verifyFailure, issue, verifyFailure, verifyFailure, verifyFailure},
+			want:   []string{"kagiana.login.failure"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			got := []string{}
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				timestamp := r.Header.Get(WebhookTimestampHeader)
+				if r.Header.Get(WebhookSignatureHeader) != SignWebhook("secret", timestamp, body) {
+					t.Errorf("invalid signature %s", r.Header.Get(WebhookSignatureHeader))
+				}
+				if sec, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+					t.Errorf("timestamp = %s", timestamp)
+				}
+				if r.Header.Get("Content-Type") != "application/cloudevents+json" {
+					t.Errorf("content type = %s", r.Header.Get("Content-Type"))
+				}
+				ce := CloudEvent{}
+				if err := json.Unmarshal(body, &ce); err != nil {
+					t.Error(err)
+				}
+				if ce.SpecVersion != "1.0" || ce.ID == "" || ce.Source != "kagiana" {
+					t.Errorf("invalid cloudevent %+v", ce)
+				}
+				mu.Lock()
+				got = append(got, ce.Type)
+				mu.Unlock()
+			}))
+			defer ts.Close()
+
+			tt.config.Name = "test"
+			tt.config.URL = ts.URL
+			tt.config.Secret = "secret"
+			ws := NewWebhooks([]WebhookConfig{tt.config})
+			for _, e := range tt.events {
+				ws.Notify(e)
+			}
+			ws.Close()
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("delivered %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("delivered %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhooks_Retry(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    []int
+		wantCalls int
+	}{
+		{name: "recover", status: []int{500, 429, 200}, wantCalls: 3},
+		{name: "give up", status: []int{500, 500, 500, 500, 500}, wantCalls: 3},
+		{name: "no retry on client error", status: []int{400, 200}, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status[calls])
+				calls++
+			}))
+			defer ts.Close()
+
+			ws := NewWebhooks([]WebhookConfig{{Name: "test", URL: ts.URL, MaxRetries: 2}})
+			ws.hooks[0].backoff = time.Millisecond
+			ws.Notify(AuditEvent{Type: AuditTypeIssue, Outcome: AuditOutcomeSuccess})
+			ws.Close()
+
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWebhook_countFailure(t *testing.T) {
+	now := time.Now()
+	w := newWebhook(WebhookConfig{Name: "test", MinFailures: 3, FailureWindow: time.Minute})
+	w.now = func() time.Time { return now }
+	fail := func(user string) bool {
+		return w.countFailure(AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeFailure, User: user})
+	}
+
+	fail("alice")
+	now = now.Add(30 * time.Second)
+	fail("bob")
+	fail("bob")
+	if len(w.failures) != 2 {
+		t.Fatalf("failures = %v", w.failures)
+	}
+
+	// alice's failure is out of the window, and swept with the next failure
+	now = now.Add(45 * time.Second)
+	if fail("carol") {
+		t.Error("first failure of carol is delivered")
+	}
+	if _, ok := w.failures["login:alice"]; ok || len(w.failures) != 2 {
+		t.Errorf("failures after the sweep = %v", w.failures)
+	}
+	if !fail("bob") {
+		t.Error("third failure of bob within the window is held back")
+	}
+
+	// when too many users fail, new users are let through
+	for i := len(w.failures); i < maxWebhookFailureKeys; i++ {
+		w.failures[strconv.Itoa(i)] = []time.Time{now}
+	}
+	if !fail("dave") || len(w.failures) != maxWebhookFailureKeys {
+		t.Errorf("failure over the cap is held back, %d users", len(w.failures))
+	}
+}
+
+func TestWebhooks_NotifyAfterClose(t *testing.T) {
+	ws := NewWebhooks([]WebhookConfig{{Name: "closed", URL: "http://127.0.0.1:1"}})
+	ws.Close()
+	ws.Close()
+
+	dropped := testutil.ToFloat64(webhookDeliveriesTotal.WithLabelValues("closed", "dropped"))
+	ws.Notify(AuditEvent{Type: AuditTypeLogin, Outcome: AuditOutcomeSuccess})
+	if got := testutil.ToFloat64(webhookDeliveriesTotal.WithLabelValues("closed", "dropped")) - dropped; got != 1 {
+		t.Errorf("dropped = %v, want 1", got)
+	}
+}